@@ -17,6 +17,9 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"os"
 
 	"github.com/dell/csi-powermax/provider"
 	"github.com/dell/csi-powermax/service"
@@ -25,6 +28,27 @@ import (
 
 // main is ignored when this package is built as a go plug-in
 func main() {
+	// "adopt" prepares an existing device to be used as a static volume, "modify" changes the
+	// service level of a volume, and "decommission" removes the array objects of a node which
+	// left the cluster, instead of running the driver
+	if len(os.Args) > 1 {
+		var command func(context.Context, []string, io.Writer) error
+		switch os.Args[1] {
+		case service.AdoptCommand:
+			command = service.Adopt
+		case service.ModifyCommand:
+			command = service.Modify
+		case service.DecommissionCommand:
+			command = service.Decommission
+		}
+		if command != nil {
+			if err := command(context.Background(), os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
 	gocsi.Run(
 		context.Background(),
 		service.Name,
@@ -67,6 +91,118 @@ const usage = `    X_CSI_POWERMAX_ENDPOINT
 
         The default value is an empty list
 
+    X_CSI_POWERMAX_ARRAY_PORTGROUPS
+        Specifies Port Groups for individual arrays in the form
+        SYMID1:pg1,pg2;SYMID2:pg3. Arrays which are not listed use
+        X_CSI_POWERMAX_PORTGROUPS
+
+        The default value is empty
+
+    X_CSI_POWERMAX_ARRAY_CONFIG
+        Specifies the path of a YAML file holding the Port Groups, preferred
+        FC directors and transport protocol for individual arrays. These
+        override X_CSI_POWERMAX_PORTGROUPS and X_CSI_TRANSPORT_PROTOCOL
+
+        The default value is empty
+
+    X_CSI_POWERMAX_PORTGROUP_SELECTION
+        Specifies how a Port Group is selected when creating an iSCSI
+        masking view: random, round-robin, least-masking-views or
+        least-director-masking-views. The last two count the masking
+        views using the Port Groups, or their directors, which are
+        cached for 5 minutes
+
+        The default value is random
+
+    X_CSI_POWERMAX_TRANSPORT_PREFERENCE
+        Specifies the order in which transport protocols are tried when
+        X_CSI_TRANSPORT_PROTOCOL is empty, e.g. ISCSI,FC. If several are
+        listed, each node sets up a host for every listed protocol it has
+        initiators for, and if publishing a volume with the preferred
+        protocol fails, the next one is used. Otherwise each node only sets
+        up a host for the first protocol it can use.
+        NVMe/TCP and NVMe/FC are only used if NVMETCP or NVMEFC is listed
+
+        The default value is FC,ISCSI
+
+    X_CSI_POWERMAX_ISCSI_CHAP_USERNAME, X_CSI_POWERMAX_ISCSI_CHAP_PASSWORD
+        Specify the CHAP credentials used to log into iSCSI targets. The
+        driver cannot set them on the array, they must be set on the iSCSI
+        initiators of the node on the array, e.g. with symaccess
+
+        The default value is empty, disabling CHAP
+
+    X_CSI_POWERMAX_ISCSI_DISCOVERY_CHAP_USERNAME, X_CSI_POWERMAX_ISCSI_DISCOVERY_CHAP_PASSWORD
+        Specify the CHAP credentials used for iSCSI target discovery
+
+        The default value is empty, disabling discovery CHAP
+
+    X_CSI_POWERMAX_ISCSI_SESSION_CHECK_INTERVAL
+        Specifies how often the node checks its iSCSI sessions and logs back
+        into any portals which have been lost, e.g. 5m. 0 disables the check.
+        The number of sessions to each array found by the last check is
+        logged by Probe, and served as powermax_iscsi_sessions, see
+        X_CSI_POWERMAX_METRICS_ADDRESS
+
+        The default value is 2m
+
+    X_CSI_POWERMAX_STALE_DEVICE_CHECK_INTERVAL
+        Specifies how often the node removes the PowerMax devices and
+        multipath maps of the driver which the array no longer maps to the
+        node, e.g. 30m. Staged, mounted, partitioned or held devices, and
+        devices the driver never used, are kept. The devices of the driver
+        are recorded in the private directory of the node until they are
+        gone. A device is removed when two consecutive checks find it
+        stale. 0 disables the removal
+
+        The default value is 10m
+
+    X_CSI_POWERMAX_CLUSTER_FS_TYPES
+        Specifies the cluster filesystems with which volumes of StorageClasses
+        with AllowMultiWriterMount may be mounted MULTI_NODE_MULTI_WRITER,
+        e.g. gfs2. The checks which prevent a volume from being mounted
+        by several writers are skipped for these filesystems
+
+        The default value is gfs2,ocfs2
+
+    X_CSI_POWERMAX_INITIATOR_CONFLICT_POLICY
+        Specifies what the node does when one of its initiators belongs to
+        another host on an array. fail does not set up the node for the
+        array. move moves the initiator into the host of the node if the
+        other host is a host of the driver with no masking views, removing
+        it if it has no other initiators. adopt makes the node use the hosts
+        of the node of the other host, if it is a host of the driver, without
+        changing the ID of the node
+
+        The default value is fail
+
+    X_CSI_POWERMAX_ORPHAN_AUDIT_INTERVAL
+        Specifies how often the controller reports the volumes, storage groups,
+        masking views, hosts and port groups carrying the cluster prefix which
+        no longer appear to be used, e.g. 1h. 0 disables the audit
+
+        The default value is 0
+
+    X_CSI_POWERMAX_KNOWN_VOLUMES_FILE
+        Specifies the path of a file listing the volume handles of the
+        PersistentVolumes of the cluster, one per line. The volumes on the
+        arrays which are not listed are reported as orphans
+
+        The default value is empty, disabling the audit of the volumes
+
+    X_CSI_POWERMAX_ORPHAN_CLEANUP
+        Specifies if the orphan audit removes the empty storage groups and the
+        masking views of hosts with no initiators. Other orphans are only reported
+
+        The default value is false
+
+    X_CSI_POWERMAX_METRICS_ADDRESS
+        Specifies the address, e.g. :9090, on which metrics such as the number
+        of iSCSI sessions to each array, the number of stale devices
+        removed and the orphan reports are served at /debug/vars
+
+        The default value is empty, disabling the metrics
+
     X_CSI_K8S_CLUSTER_PREFIX 
         Specifies a prefix to apply to objects created via this K8s/CSI cluster
          
@@ -0,0 +1,217 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	types "github.com/dell/gopowermax/types/v90"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AdoptCommand is the command line argument which runs Adopt rather than the driver
+const AdoptCommand = "adopt"
+
+// persistentVolumeNamePattern matches the names Kubernetes accepts for a PersistentVolume
+var persistentVolumeNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// adoptRequest holds the arguments of the adopt command
+type adoptRequest struct {
+	symID         string
+	devID         string
+	name          string
+	rename        bool
+	srp           string
+	serviceLevel  string
+	fsType        string
+	volumeMode    string
+	accessMode    string
+	storageClass  string
+	reclaimPolicy string
+}
+
+// Adopt runs the adopt command, which prepares an existing PowerMax device to be managed by
+// the driver and writes a static PersistentVolume for it to out. The Unisphere connection and
+// the cluster prefix are read from the same environment variables as the driver.
+func Adopt(ctx context.Context, args []string, out io.Writer) error {
+	req := &adoptRequest{}
+	flags := flag.NewFlagSet(AdoptCommand, flag.ContinueOnError)
+	flags.StringVar(&req.symID, "symid", "", "symmetrix ID of the array of the device (required)")
+	flags.StringVar(&req.devID, "device", "", "ID of the device, e.g. 0A1B2 (required)")
+	flags.StringVar(&req.name, "name", "", "name of the PersistentVolume (required)")
+	flags.BoolVar(&req.rename, "rename", false, "rename the device to the volume naming scheme of the driver")
+	flags.StringVar(&req.srp, "srp", "", "storage resource pool of the storage group of the device (required)")
+	flags.StringVar(&req.serviceLevel, "service-level", "Optimized", "service level of the storage group of the device")
+	flags.StringVar(&req.fsType, "fstype", "ext4", "filesystem of the device")
+	flags.StringVar(&req.volumeMode, "volume-mode", "Filesystem", "volume mode of the PersistentVolume, Filesystem or Block")
+	flags.StringVar(&req.accessMode, "access-mode", "ReadWriteOnce", "access mode of the PersistentVolume")
+	flags.StringVar(&req.storageClass, "storage-class", "", "StorageClass of the PersistentVolume")
+	flags.StringVar(&req.reclaimPolicy, "reclaim-policy", "Retain", "reclaim policy of the PersistentVolume, Retain or Delete")
+	flags.SetOutput(out)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if req.symID == "" || req.devID == "" || req.name == "" || req.srp == "" {
+		return fmt.Errorf("-symid, -device, -name and -srp are required")
+	}
+	if !persistentVolumeNamePattern.MatchString(req.name) {
+		return fmt.Errorf("Invalid PersistentVolume name %s, it must consist of lower case alphanumeric characters, '-' or '.'", req.name)
+	}
+	if req.volumeMode != "Filesystem" && req.volumeMode != "Block" {
+		return fmt.Errorf("Invalid volume mode %s, it must be Filesystem or Block", req.volumeMode)
+	}
+	if req.reclaimPolicy != "Retain" && req.reclaimPolicy != "Delete" {
+		return fmt.Errorf("Invalid reclaim policy %s, it must be Retain or Delete", req.reclaimPolicy)
+	}
+
+	s := New().(*service)
+	if err := s.loadCommandOpts(ctx); err != nil {
+		return err
+	}
+	if err := s.controllerProbe(ctx); err != nil {
+		return err
+	}
+	vol, err := s.adoptVolume(req)
+	if err != nil {
+		return err
+	}
+	return s.writePersistentVolume(out, req, vol)
+}
+
+// adoptVolume prepares an existing device to be managed by the driver. The device must not be
+// in a masking view, so that it is only published by the driver. It is renamed to the volume
+// naming scheme of the driver if rename is set, and moved from its storage groups to the
+// storage group of the driver for its service level and SRP. It returns the adopted device.
+func (s *service) adoptVolume(req *adoptRequest) (*types.Volume, error) {
+	if !isValidServiceLevel(req.serviceLevel) {
+		return nil, status.Errorf(codes.InvalidArgument, "An invalid Service Level parameter was specified")
+	}
+	if err := s.validateStoragePoolID(req.symID, req.srp); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	vol, err := s.adminClient.GetVolumeByID(req.symID, req.devID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "Could not find device %s on %s: %s", req.devID, req.symID, err.Error())
+	}
+
+	volumeIdentifier := vol.VolumeIdentifier
+	csiVolumePrefix := fmt.Sprintf("%s%s-", CsiVolumePrefix, s.getClusterPrefix())
+	if req.rename {
+		// the same identifier as CreateVolume gives a volume of that name
+		volumeIdentifier = s.getVolumeIdentifier(req.name)
+	} else if !strings.HasPrefix(volumeIdentifier, csiVolumePrefix) {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"Device %s is named %q, which does not start with %s, rename it with -rename", req.devID, volumeIdentifier, csiVolumePrefix)
+	}
+
+	maskingViews, _, err := s.GetMaskingViewAndSGDetails(req.symID, vol.StorageGroupIDList)
+	if err != nil {
+		return nil, err
+	}
+	if len(maskingViews) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"Device %s is in masking views %s, it must be unmapped before it is adopted", req.devID, strings.Join(maskingViews, ","))
+	}
+
+	if vol.VolumeIdentifier != volumeIdentifier {
+		log.Infof("Renaming device %s from %q to %s", req.devID, vol.VolumeIdentifier, volumeIdentifier)
+		if _, err := s.adminClient.RenameVolume(req.symID, req.devID, volumeIdentifier); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not rename device %s: %s", req.devID, err.Error())
+		}
+	}
+
+	storageGroupName := fmt.Sprintf("%s-%s-%s-%s-SG", CSIPrefix, s.getClusterPrefix(), req.serviceLevel, req.srp)
+	if !contains(vol.StorageGroupIDList, storageGroupName) {
+		sg, err := s.adminClient.GetStorageGroup(req.symID, storageGroupName)
+		if err != nil || sg == nil {
+			if _, err := s.adminClient.CreateStorageGroup(req.symID, storageGroupName, req.srp, req.serviceLevel, false); err != nil {
+				return nil, status.Errorf(codes.Internal, "Error creating storage group: %s", err.Error())
+			}
+		}
+		// A device can only be in one storage group with a service level, so
+		// it is removed from its storage groups before it is added to the driver's
+		for _, sgID := range vol.StorageGroupIDList {
+			log.Infof("Removing device %s from storage group %s", req.devID, sgID)
+			if _, err := s.adminClient.RemoveVolumesFromStorageGroup(req.symID, sgID, req.devID); err != nil {
+				return nil, status.Errorf(codes.Internal, "Could not remove device %s from storage group %s: %s", req.devID, sgID, err.Error())
+			}
+		}
+		log.Infof("Adding device %s to storage group %s", req.devID, storageGroupName)
+		if err := s.adminClient.AddVolumesToStorageGroup(req.symID, storageGroupName, req.devID); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not add device %s to storage group %s: %s", req.devID, storageGroupName, err.Error())
+		}
+	}
+
+	vol, err = s.adminClient.GetVolumeByID(req.symID, req.devID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not read adopted device %s: %s", req.devID, err.Error())
+	}
+	return vol, nil
+}
+
+var persistentVolumeTemplate = template.Must(template.New("pv").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(
+	`apiVersion: v1
+kind: PersistentVolume
+metadata:
+  name: {{ .Name }}
+spec:
+  capacity:
+    storage: {{ .CapacityBytes }}
+  accessModes:
+    - {{ .AccessMode }}
+  persistentVolumeReclaimPolicy: {{ .ReclaimPolicy }}
+  storageClassName: {{ quote .StorageClass }}
+  volumeMode: {{ .VolumeMode }}
+  csi:
+    driver: {{ .Driver }}
+    volumeHandle: {{ quote .VolumeHandle }}
+{{- if eq .VolumeMode "Filesystem" }}
+    fsType: {{ .FsType }}
+{{- end }}
+    volumeAttributes:
+      {{ .ServiceLevelKey }}: {{ quote .ServiceLevel }}
+      {{ .StoragePoolKey }}: {{ quote .StoragePool }}
+      {{ .CapacityGBKey }}: {{ quote .CapacityGB }}
+`))
+
+// writePersistentVolume writes a static PersistentVolume for an adopted device to out
+func (s *service) writePersistentVolume(out io.Writer, req *adoptRequest, vol *types.Volume) error {
+	return persistentVolumeTemplate.Execute(out, map[string]interface{}{
+		"Name":            req.name,
+		"CapacityBytes":   int64(vol.CapacityCYL) * cylinderSizeInBytes,
+		"AccessMode":      req.accessMode,
+		"ReclaimPolicy":   req.reclaimPolicy,
+		"StorageClass":    req.storageClass,
+		"VolumeMode":      req.volumeMode,
+		"Driver":          Name,
+		"VolumeHandle":    fmt.Sprintf("%s-%s-%s", vol.VolumeIdentifier, req.symID, vol.VolumeID),
+		"FsType":          req.fsType,
+		"ServiceLevelKey": ServiceLevelParam,
+		"ServiceLevel":    req.serviceLevel,
+		"StoragePoolKey":  StoragePoolParam,
+		"StoragePool":     req.srp,
+		"CapacityGBKey":   CapacityGB,
+		"CapacityGB":      fmt.Sprintf("%.2f", vol.CapacityGB),
+	})
+}
@@ -0,0 +1,205 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// arrayConfigRecheckInterval is how often the array configuration file
+// is checked for changes (e.g. an updated ConfigMap)
+var arrayConfigRecheckInterval = 1 * time.Minute
+
+// ArrayConfig holds the driver configuration for a single array
+type ArrayConfig struct {
+	// SymmetrixID is the serial number of the array
+	SymmetrixID string `yaml:"symmetrixID"`
+	// PortGroups are the iSCSI port groups which can be used on the array
+	PortGroups []string `yaml:"portGroups"`
+	// FCDirectors are the preferred FC directors (e.g. FA-1D) used when creating port groups
+	FCDirectors []string `yaml:"fcDirectors"`
+	// TransportProtocol is the preferred transport protocol for the array: FC, ISCSI or ""
+	TransportProtocol string `yaml:"transportProtocol"`
+}
+
+// arrayConfigFile is the layout of the array configuration file, e.g.
+//
+//	arrays:
+//	  - symmetrixID: "000000000001"
+//	    portGroups: [PortGroup1, PortGroup2]
+//	    fcDirectors: [FA-1D, FA-2D]
+//	    transportProtocol: FC
+type arrayConfigFile struct {
+	Arrays []ArrayConfig `yaml:"arrays"`
+}
+
+// arrayConfigCache holds the parsed array configuration file and reloads it when it changes
+type arrayConfigCache struct {
+	sync.Mutex
+	path      string
+	modTime   time.Time
+	lastCheck time.Time
+	arrays    map[string]*ArrayConfig
+}
+
+// parseArrayConfig parses and validates the contents of an array configuration file
+func parseArrayConfig(data []byte) (map[string]*ArrayConfig, error) {
+	config := arrayConfigFile{}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+	arrays := make(map[string]*ArrayConfig)
+	for i := range config.Arrays {
+		array := config.Arrays[i]
+		array.SymmetrixID = strings.TrimSpace(array.SymmetrixID)
+		if array.SymmetrixID == "" {
+			return nil, fmt.Errorf("array entry %d has no symmetrixID", i+1)
+		}
+		if _, ok := arrays[array.SymmetrixID]; ok {
+			return nil, fmt.Errorf("array %s is specified more than once", array.SymmetrixID)
+		}
+		tp, err := normalizeTransportProtocol(array.TransportProtocol)
+		if err != nil {
+			return nil, fmt.Errorf("array %s: %s", array.SymmetrixID, err.Error())
+		}
+		array.TransportProtocol = tp
+		arrays[array.SymmetrixID] = &array
+	}
+	return arrays, nil
+}
+
+// newArrayConfigCache loads the array configuration file at path
+func newArrayConfigCache(path string) (*arrayConfigCache, error) {
+	cache := &arrayConfigCache{path: path}
+	if err := cache.load(); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// load reads the array configuration file. It must be called with the lock held
+// or before the cache is shared.
+func (c *arrayConfigCache) load() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	arrays, err := parseArrayConfig(data)
+	if err != nil {
+		return fmt.Errorf("invalid array configuration file %s: %s", c.path, err.Error())
+	}
+	c.arrays = arrays
+	c.modTime = info.ModTime()
+	c.lastCheck = time.Now()
+	log.Infof("Loaded configuration for %d arrays from %s", len(arrays), c.path)
+	return nil
+}
+
+// get returns the configuration for an array, or nil if the array is not configured.
+// If the file has changed since it was last read, it is reloaded. Should the
+// reload fail, the previous configuration remains in effect.
+func (c *arrayConfigCache) get(symID string) *ArrayConfig {
+	c.Lock()
+	defer c.Unlock()
+	if time.Since(c.lastCheck) > arrayConfigRecheckInterval {
+		c.lastCheck = time.Now()
+		if info, err := os.Stat(c.path); err != nil {
+			log.Errorf("Unable to check array configuration file %s: %s", c.path, err.Error())
+		} else if !info.ModTime().Equal(c.modTime) {
+			if err := c.load(); err != nil {
+				log.Errorf("Keeping previous array configuration: %s", err.Error())
+			}
+		}
+	}
+	return c.arrays[symID]
+}
+
+// getArrayConfig returns the configuration for an array from the array
+// configuration file, or nil if there is none
+func (s *service) getArrayConfig(symID string) *ArrayConfig {
+	if s.arrayConfig == nil {
+		return nil
+	}
+	return s.arrayConfig.get(symID)
+}
+
+// getTransportProtocolForArray returns the preferred transport protocol for an array.
+// The array configuration file takes precedence over X_CSI_TRANSPORT_PROTOCOL.
+func (s *service) getTransportProtocolForArray(symID string) string {
+	if config := s.getArrayConfig(symID); config != nil && config.TransportProtocol != "" {
+		return config.TransportProtocol
+	}
+	return s.opts.TransportProtocol
+}
+
+// getTransportProtocolOrder returns the transport protocols which may be used
+// with an array, in order of preference. If a transport protocol has been set for
+// the array, or globally, only that protocol is returned.
+func (s *service) getTransportProtocolOrder(symID string) []string {
+	if tp := s.getTransportProtocolForArray(symID); tp != "" {
+		return []string{tp}
+	}
+	if len(s.opts.TransportPreference) > 0 {
+		return s.opts.TransportPreference
+	}
+	return []string{FcTransportProtocol, IscsiTransportProtocol}
+}
+
+// hasTransportProtocolPreference returns true if a preference of several transport protocols is
+// configured for an array, in which case the nodes set up a host for each of them
+func (s *service) hasTransportProtocolPreference(symID string) bool {
+	return s.getTransportProtocolForArray(symID) == "" && len(s.opts.TransportPreference) > 1
+}
+
+// parseTransportProtocolPreference parses a comma separated list of transport protocols
+func (s *service) parseTransportProtocolPreference(values string) ([]string, error) {
+	protocols, _ := s.parseCommaSeperatedList(values)
+	preference := make([]string, 0)
+	for _, value := range protocols {
+		tp, err := normalizeTransportProtocol(value)
+		if err != nil {
+			return nil, err
+		}
+		preference = appendIfMissing(preference, tp)
+	}
+	return preference, nil
+}
+
+// filterPortsByDirectors returns the director ports (e.g. FA-1D:4) which belong to one of the directors
+func filterPortsByDirectors(dirPorts []string, directors []string) []string {
+	filtered := make([]string, 0)
+	for _, dirPort := range dirPorts {
+		director := strings.Split(dirPort, ":")[0]
+		for _, d := range directors {
+			if strings.EqualFold(strings.TrimSpace(d), director) {
+				filtered = append(filtered, dirPort)
+				break
+			}
+		}
+	}
+	return filtered
+}
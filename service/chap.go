@@ -0,0 +1,204 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dell/goiscsi"
+	csictx "github.com/rexray/gocsi/context"
+	log "github.com/sirupsen/logrus"
+)
+
+// iscsiadm settings used to configure CHAP authentication
+const (
+	chapAuthMethod                = "CHAP"
+	iscsiSessionAuthMethod        = "node.session.auth.authmethod"
+	iscsiSessionAuthUsername      = "node.session.auth.username"
+	iscsiSessionAuthPassword      = "node.session.auth.password"
+	iscsiDiscoveryAuthMethod      = "discovery.sendtargets.auth.authmethod"
+	iscsiDiscoveryAuthUsername    = "discovery.sendtargets.auth.username"
+	iscsiDiscoveryAuthPassword    = "discovery.sendtargets.auth.password"
+	iscsiDefaultPort              = "3260"
+	iscsiDiscoveryPortalSeparator = ","
+	// iscsiPasswordEnv is the environment variable in which a CHAP password is passed to iscsiadm
+	iscsiPasswordEnv = "ISCSI_CHAP_PASSWORD"
+)
+
+// chapCredentials are the username and secret used for CHAP authentication
+type chapCredentials struct {
+	Username string
+	Password string
+}
+
+// isSet returns true if CHAP authentication should be used
+func (c chapCredentials) isSet() bool {
+	return c.Username != "" && c.Password != ""
+}
+
+// parseCHAPCredentials validates that either both or neither of a username and password are set
+func parseCHAPCredentials(username, password string) (chapCredentials, error) {
+	creds := chapCredentials{Username: strings.TrimSpace(username), Password: password}
+	if (creds.Username == "") != (creds.Password == "") {
+		return chapCredentials{}, fmt.Errorf("both a CHAP username and password must be specified")
+	}
+	return creds, nil
+}
+
+// sessionCHAPOptions returns the iscsiadm node settings which enable session CHAP.
+// The password is not one of them, as iscsiadm would get it on its command line, see setISCSIPassword.
+func (s *service) sessionCHAPOptions() map[string]string {
+	return map[string]string{
+		iscsiSessionAuthMethod:   chapAuthMethod,
+		iscsiSessionAuthUsername: s.opts.ISCSICHAP.Username,
+	}
+}
+
+// setISCSIPassword sets a CHAP password in the iscsid record selected by args, using iscsiadm -o update.
+// The password is passed in the environment of a shell which runs iscsiadm, so that it is not part
+// of the command run by the driver, which may be logged, nor of any iscsid record edited directly.
+func (s *service) setISCSIPassword(name, password string, args ...string) error {
+	script := `exec iscsiadm "$@" -v "$` + iscsiPasswordEnv + `"`
+	args = append(append([]string{"-c", script, "iscsiadm"}, args...), "-o", "update", "-n", name)
+	cmdName := "sh"
+	if chroot, _ := csictx.LookupEnv(context.Background(), EnvISCSIChroot); chroot != "" {
+		args = append([]string{chroot, cmdName}, args...)
+		cmdName = "chroot"
+	}
+	cmd := execCommand(cmdName, args...)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, iscsiPasswordEnv+"="+password)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("iscsiadm failed to set %s: %s", name, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// setSessionCHAPForTargets stores the session CHAP credentials in the iscsid node
+// records of the targets, so that they are used for any subsequent login
+func (s *service) setSessionCHAPForTargets(targets []goiscsi.ISCSITarget) error {
+	if !s.opts.ISCSICHAP.isSet() {
+		return nil
+	}
+	for _, tgt := range targets {
+		log.Debugf("Setting CHAP credentials for target %s on %s", tgt.Target, tgt.Portal)
+		if err := s.iscsiClient.CreateOrUpdateNode(tgt, s.sessionCHAPOptions()); err != nil {
+			return fmt.Errorf("Unable to set CHAP credentials for target %s on %s: %s", tgt.Target, tgt.Portal, err.Error())
+		}
+		if err := s.setISCSIPassword(iscsiSessionAuthPassword, s.opts.ISCSICHAP.Password,
+			"-m", "node", "-T", tgt.Target, "-p", tgt.Portal); err != nil {
+			return fmt.Errorf("Unable to set CHAP credentials for target %s on %s: %s", tgt.Target, tgt.Portal, err.Error())
+		}
+	}
+	return nil
+}
+
+// discoverTargets discovers the iSCSI targets of a portal, and optionally logs into them,
+// using the discovery and session CHAP credentials if they have been configured
+func (s *service) discoverTargets(portal string, login bool) ([]goiscsi.ISCSITarget, error) {
+	if !s.opts.ISCSICHAP.isSet() && !s.opts.ISCSIDiscoveryCHAP.isSet() {
+		return s.iscsiClient.DiscoverTargets(portal, login)
+	}
+	var targets []goiscsi.ISCSITarget
+	var err error
+	if s.opts.ISCSIDiscoveryCHAP.isSet() {
+		targets, err = s.discoverTargetsWithCHAP(portal)
+	} else {
+		targets, err = s.iscsiClient.DiscoverTargets(portal, false)
+	}
+	if err != nil {
+		return targets, err
+	}
+	// the credentials have to be in place before logging in
+	if err = s.setSessionCHAPForTargets(targets); err != nil {
+		return targets, err
+	}
+	if login {
+		for _, tgt := range targets {
+			if e := s.iscsiClient.PerformLogin(tgt); e != nil {
+				log.Errorf("Failed to login to target %s on %s, check that the CHAP credentials of the initiators are set on the array: %s",
+					tgt.Target, tgt.Portal, e.Error())
+				err = e
+			}
+		}
+	}
+	return targets, err
+}
+
+// discoverTargetsWithCHAP runs a SendTargets discovery using the discovery CHAP credentials.
+// goiscsi uses legacy discovery, which ignores the settings in the discovery database,
+// so iscsiadm is run directly.
+func (s *service) discoverTargetsWithCHAP(portal string) ([]goiscsi.ISCSITarget, error) {
+	if !strings.Contains(portal, ":") {
+		portal = portal + ":" + iscsiDefaultPort
+	}
+	base := []string{"-m", "discoverydb", "-t", "sendtargets", "-p", portal}
+	commands := [][]string{
+		append(append([]string{}, base...), "-o", "new"),
+		append(append([]string{}, base...), "-o", "update", "-n", iscsiDiscoveryAuthMethod, "-v", chapAuthMethod),
+		append(append([]string{}, base...), "-o", "update", "-n", iscsiDiscoveryAuthUsername, "-v", s.opts.ISCSIDiscoveryCHAP.Username),
+	}
+	for i, args := range commands {
+		out, err := s.runISCSIAdm(args...)
+		// creating the record fails if it already exists, which is fine
+		if err != nil && i > 0 {
+			return nil, fmt.Errorf("iSCSI discovery with CHAP on %s failed: %s", portal, strings.TrimSpace(out))
+		}
+	}
+	if err := s.setISCSIPassword(iscsiDiscoveryAuthPassword, s.opts.ISCSIDiscoveryCHAP.Password, base...); err != nil {
+		return nil, fmt.Errorf("iSCSI discovery with CHAP on %s failed: %s", portal, err.Error())
+	}
+	out, err := s.runISCSIAdm(append(append([]string{}, base...), "--discover")...)
+	if err != nil {
+		return nil, fmt.Errorf("iSCSI discovery with CHAP on %s failed: %s", portal, strings.TrimSpace(out))
+	}
+	return parseDiscoveredTargets(out), nil
+}
+
+// runISCSIAdm runs iscsiadm, in the iSCSI chroot if one has been set
+func (s *service) runISCSIAdm(args ...string) (string, error) {
+	name := "iscsiadm"
+	if chroot, _ := csictx.LookupEnv(context.Background(), EnvISCSIChroot); chroot != "" {
+		args = append([]string{chroot, name}, args...)
+		name = "chroot"
+	}
+	out, err := execCommand(name, args...).CombinedOutput()
+	return string(out), err
+}
+
+// parseDiscoveredTargets parses the output of a SendTargets discovery, where each
+// line is of the form "10.0.0.1:3260,1 iqn.1992-04.com.emc:600009700bcbb70e3287017400000001"
+func parseDiscoveredTargets(out string) []goiscsi.ISCSITarget {
+	targets := make([]goiscsi.ISCSITarget, 0)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "iqn.") {
+			continue
+		}
+		portal := fields[0]
+		groupTag := ""
+		if i := strings.LastIndex(portal, iscsiDiscoveryPortalSeparator); i >= 0 {
+			groupTag = portal[i+1:]
+			portal = portal[:i]
+		}
+		targets = append(targets, goiscsi.ISCSITarget{Portal: portal, GroupTag: groupTag, Target: fields[1]})
+	}
+	return targets
+}
@@ -0,0 +1,118 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/dell/gofsutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultClusterFsTypes are the cluster filesystems which may be mounted by several
+// nodes at once if X_CSI_POWERMAX_CLUSTER_FS_TYPES is not set
+var defaultClusterFsTypes = []string{"gfs2", "ocfs2"}
+
+// isClusterFs returns true if fsType is one of the cluster filesystems
+func isClusterFs(fsType string, clusterFsTypes []string) bool {
+	if fsType == "" {
+		return false
+	}
+	for _, clusterFs := range clusterFsTypes {
+		if strings.EqualFold(fsType, clusterFs) {
+			return true
+		}
+	}
+	return false
+}
+
+// multiWriterMountFsTypes returns the cluster filesystems with which a volume may be
+// mounted MULTI_NODE_MULTI_WRITER, or nil if its StorageClass did not allow it
+func (s *service) multiWriterMountFsTypes(volumeContext map[string]string) []string {
+	if volumeContext[MultiWriterMountParam] != "true" {
+		return nil
+	}
+	return s.opts.ClusterFsTypes
+}
+
+// writeMultiWriterMountFile records on the node that a volume may be mounted MULTI_NODE_MULTI_WRITER,
+// as NodeUnpublishVolume is not given the volume context
+func (s *service) writeMultiWriterMountFile(id string) error {
+	multiWriterFileName := fmt.Sprintf("%s/%s.multiwriter", s.privDir, id)
+	err := ioutil.WriteFile(multiWriterFileName, []byte("true"), 0644)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Could not write multi-writer mount file: %s", multiWriterFileName)
+	}
+	return nil
+}
+
+// unpublishMultiWriterMountFsTypes returns the cluster filesystems with which a volume may have been
+// mounted MULTI_NODE_MULTI_WRITER, or nil if NodePublishVolume did not record that it was allowed
+func (s *service) unpublishMultiWriterMountFsTypes(id string) []string {
+	multiWriterFileName := fmt.Sprintf("%s/%s.multiwriter", s.privDir, id)
+	if _, err := os.Stat(multiWriterFileName); err != nil {
+		return nil
+	}
+	return s.opts.ClusterFsTypes
+}
+
+// removeMultiWriterMountFile removes the multi-writer mount file from the node local disk
+func (s *service) removeMultiWriterMountFile(id string) {
+	multiWriterFileName := fmt.Sprintf("%s/%s.multiwriter", s.privDir, id)
+	os.Remove(multiWriterFileName)
+}
+
+// validateMultiWriterMount validates the AllowMultiWriterMount parameter. When it is set,
+// the mount volume capabilities with access mode MULTI_NODE_MULTI_WRITER must use a cluster filesystem.
+func (s *service) validateMultiWriterMount(allow string, vcs []*csi.VolumeCapability) error {
+	switch allow {
+	case "", "false":
+		return nil
+	case "true":
+	default:
+		return status.Errorf(codes.InvalidArgument,
+			"An invalid %s parameter was specified: %s, it must be true or false", MultiWriterMountParam, allow)
+	}
+	for _, vc := range vcs {
+		mount := vc.GetMount()
+		if mount == nil || vc.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+			continue
+		}
+		if !isClusterFs(mount.GetFsType(), s.opts.ClusterFsTypes) {
+			return status.Errorf(codes.InvalidArgument,
+				"Mount volumes with AccessMode MULTI_NODE_MULTI_WRITER require a cluster filesystem (%s), not fstype %q",
+				strings.Join(s.opts.ClusterFsTypes, ", "), mount.GetFsType())
+		}
+	}
+	return nil
+}
+
+// privMountUsers filters the mounts of a cluster filesystem device down to the private
+// mount and the mounts which may use it. A cluster filesystem may also be mounted on
+// the node outside of the driver, and such a mount has the device itself as its source.
+func privMountUsers(mnts []gofsutil.Info, privTgt string) []gofsutil.Info {
+	users := make([]gofsutil.Info, 0)
+	for _, m := range mnts {
+		if m.Path == privTgt || m.Source != m.Device {
+			users = append(users, m)
+		}
+	}
+	return users
+}
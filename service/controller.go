@@ -75,6 +75,8 @@ const (
 	PublishContextLUNAddress        = "LUN_ADDRESS"
 	PortIdentifiers                 = "PORT_IDENTIFIERS"
 	FCSuffix                        = "-FC"
+	NVMeTCPSuffix                   = "-NVMETCP"
+	NVMeFCSuffix                    = "-NVMEFC"
 	PGSuffix                        = "PG"
 	notFound                        = "not found"       // error message from s.GetVolumeByID when volume not found
 	cannotBeFound                   = "cannot be found" // error message from pmax when volume not found
@@ -83,6 +85,9 @@ const (
 	errDeviceInStorageGrp           = "device is a member of a storage group"
 	IscsiTransportProtocol          = "ISCSI"
 	FcTransportProtocol             = "FC"
+	NvmeTCPTransportProtocol        = "NVMETCP"
+	NvmeFCTransportProtocol         = "NVMEFC"
+	PublishContextTransportProtocol = "TRANSPORT_PROTOCOL"
 	MaxSnapIdentifierLength         = 32
 	SnapDelPrefix                   = "DEL"
 	delSrcTag                       = "DS"
@@ -99,11 +104,20 @@ const (
 	StorageGroupParam      = "StorageGroup"
 	ThickVolumesParam      = "ThickVolumes" // "true" or "false" or "" (defaults thin)
 	ApplicationPrefixParam = "ApplicationPrefix"
+	FsCheckParam           = "FsCheck"               // "none", "check" or "repair" (defaults none)
+	MkfsOptionsParam       = "MkfsOptions"           // arguments passed to mkfs when the volume is first formatted
+	MultiWriterMountParam  = "AllowMultiWriterMount" // "true" allows MULTI_NODE_MULTI_WRITER mounts of cluster filesystems
 	CapacityGB             = "CapacityGB"
 	uCode5978              = 5978
 	uCodeELMSR             = 221
 )
 
+// Keys for parameters to CreateSnapshot
+const (
+	SnapshotTTLParam           = "TTL"                   // time to live of the snapshot in hours or days, e.g. "12h" or "7d"
+	MaxSnapshotsPerVolumeParam = "MaxSnapshotsPerVolume" // the oldest snapshots of a volume beyond this number are deleted
+)
+
 //Pair - structure which holds a pair
 type Pair struct {
 	first, second interface{}
@@ -119,6 +133,9 @@ type pmaxCachedInformation struct {
 	// and a timestamp indicating when this map was created
 	portIdentifiers *Pair
 	uCodeVersion    *Pair
+	// Pair of a map of the port groups to their portGroupInfo
+	// and a timestamp indicating when this map was created
+	portGroups *Pair
 }
 
 // Initializes a pmaxCachedInformation type
@@ -126,6 +143,7 @@ func (p *pmaxCachedInformation) initialize() {
 	p.knownStoragePools = make(map[string]time.Time)
 	p.portIdentifiers = nil
 	p.uCodeVersion = nil
+	p.portGroups = nil
 }
 
 func getPmaxCache(symID string) *pmaxCachedInformation {
@@ -217,6 +235,28 @@ func (s *service) GetPortIdentifier(symID string, dirPortKey string) (string, er
 	return portIdentifier, nil
 }
 
+// getNVMeTCPTargetIdentifiers returns the NVMe/TCP targets of a director port (e.g. OR-1C:001)
+// in the form <subsystem NQN>@<IP address>, one for each IP address of the port
+func (s *service) getNVMeTCPTargetIdentifiers(symID string, dirPortKey string) ([]string, error) {
+	dirPortDetails := strings.Split(dirPortKey, ":")
+	if len(dirPortDetails) != 2 {
+		return nil, fmt.Errorf("Invalid director port key: %s", dirPortKey)
+	}
+	port, err := s.adminClient.GetPort(symID, dirPortDetails[0], dirPortDetails[1])
+	if err != nil {
+		log.Errorf("Couldn't get port details for %s. Error: %s", dirPortKey, err.Error())
+		return nil, err
+	}
+	targets := make([]string, 0)
+	for _, ip := range port.SymmetrixPort.IPAddresses {
+		targets = append(targets, formatNVMeTCPTarget(port.SymmetrixPort.Identifier, ip))
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("Port %s on %s has no IP addresses", dirPortKey, symID)
+	}
+	return targets, nil
+}
+
 func (s *service) CreateVolume(
 	ctx context.Context,
 	req *csi.CreateVolumeRequest) (
@@ -249,6 +289,13 @@ func (s *service) CreateVolume(
 		applicationPrefix = params[ApplicationPrefixParam]
 	}
 
+	// Filesystem check before mount is optional
+	fsCheck := params[FsCheckParam]
+	if err := validateFsCheck(fsCheck); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
 	// Storage (resource) Pool. Validate it against exist Pools
 	storagePoolID := params[StoragePoolParam]
 	err := s.validateStoragePoolID(symmetrixID, storagePoolID)
@@ -261,13 +308,7 @@ func (s *service) CreateVolume(
 	serviceLevel := "Optimized"
 	if params[ServiceLevelParam] != "" {
 		serviceLevel = params[ServiceLevelParam]
-		found := false
-		for _, val := range validSLO {
-			if serviceLevel == val {
-				found = true
-			}
-		}
-		if !found {
+		if !isValidServiceLevel(serviceLevel) {
 			log.Error("An invalid Service Level parameter was specified")
 			return nil, status.Errorf(codes.InvalidArgument, "An invalid Service Level parameter was specified")
 		}
@@ -361,6 +402,16 @@ func (s *service) CreateVolume(
 			return nil, status.Error(codes.InvalidArgument, "Block Volume Capability is not supported")
 		}
 	}
+	mkfsOptions := params[MkfsOptionsParam]
+	if err := validateMkfsOptions(mkfsOptions, vcs); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	allowMultiWriterMount := params[MultiWriterMountParam]
+	if err := s.validateMultiWriterMount(allowMultiWriterMount, vcs); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
 
 	// Get the volume name
 	volumeName := req.GetName()
@@ -370,13 +421,8 @@ func (s *service) CreateVolume(
 			"Name cannot be empty")
 	}
 
-	// Get the Volume prefix from environment
-	volumePrefix := s.getClusterPrefix()
-	maxLength := MaxVolIdentifierLength - len(volumePrefix) - len(s.getClusterPrefix()) - len(CsiVolumePrefix) - 1
-	//First get the short volume name
-	shortVolumeName := truncateString(volumeName, maxLength)
-	//Form the volume identifier using short volume name
-	volumeIdentifier := fmt.Sprintf("%s%s-%s", CsiVolumePrefix, s.getClusterPrefix(), shortVolumeName)
+	//Form the volume identifier using the short volume name
+	volumeIdentifier := s.getVolumeIdentifier(volumeName)
 
 	// Storage Group is required to be derived from the parameters (such as service level and storage resource pool which are supplied in parameters)
 	// Storage Group Name can optionally be supplied in the parameters (for testing) to over-ride the default.
@@ -463,6 +509,15 @@ func (s *service) CreateVolume(
 				//Format the time output
 				"CreationTime": time.Now().Format("20060102150405"),
 			}
+			if fsCheck != "" {
+				attributes[FsCheckParam] = fsCheck
+			}
+			if mkfsOptions != "" {
+				attributes[MkfsOptionsParam] = mkfsOptions
+			}
+			if allowMultiWriterMount != "" {
+				attributes[MultiWriterMountParam] = allowMultiWriterMount
+			}
 			volResp.VolumeContext = attributes
 			csiResp := &csi.CreateVolumeResponse{
 				Volume: volResp,
@@ -511,6 +566,15 @@ func (s *service) CreateVolume(
 		//Format the time output
 		"CreationTime": time.Now().Format("20060102150405"),
 	}
+	if fsCheck != "" {
+		attributes[FsCheckParam] = fsCheck
+	}
+	if mkfsOptions != "" {
+		attributes[MkfsOptionsParam] = mkfsOptions
+	}
+	if allowMultiWriterMount != "" {
+		attributes[MultiWriterMountParam] = allowMultiWriterMount
+	}
 	volResp.VolumeContext = attributes
 	csiResp := &csi.CreateVolumeResponse{
 		Volume: volResp,
@@ -675,6 +739,19 @@ func (s *service) setStoragePoolCacheDuration(duration time.Duration) {
 	s.storagePoolCacheDuration = duration
 }
 
+// getVolumeIdentifier returns the identifier of the device of a volume, made of the cluster
+// prefix and the volume name, truncated so that the identifier fits in MaxVolIdentifierLength.
+// The length of the cluster prefix is subtracted twice, as it always has been, so that the
+// identifiers of the volumes do not depend on the version of the driver which created them.
+func (s *service) getVolumeIdentifier(volumeName string) string {
+	// Get the Volume prefix from environment
+	volumePrefix := s.getClusterPrefix()
+	maxLength := MaxVolIdentifierLength - len(volumePrefix) - len(s.getClusterPrefix()) - len(CsiVolumePrefix) - 1
+	//First get the short volume name
+	shortVolumeName := truncateString(volumeName, maxLength)
+	return fmt.Sprintf("%s%s-%s", CsiVolumePrefix, s.getClusterPrefix(), shortVolumeName)
+}
+
 func truncateString(str string, maxLength int) string {
 	truncatedString := str
 	newLength := 0
@@ -704,6 +781,16 @@ func splitFibreChannelInitiatorID(initiatorID string) (string, string, string, e
 	return dir, dirPort, initiator, nil
 }
 
+// splitNVMeInitiatorID splits an NVMe initiator ID of the form OR-1C:001:nqn.2014-08.org.nvmexpress:uuid:...
+// into the director, the director port and the host NQN
+func splitNVMeInitiatorID(initiatorID string) (string, string, string, error) {
+	initElements := strings.SplitN(initiatorID, ":", 3)
+	if len(initElements) != 3 || !strings.HasPrefix(initElements[2], "nqn.") {
+		return "", "", "", fmt.Errorf("Failed to parse the initiator ID - %s", initiatorID)
+	}
+	return initElements[0], initElements[0] + ":" + initElements[1], initElements[2], nil
+}
+
 // Create a CSI VolumeId from component parts.
 func (s *service) createCSIVolumeID(volumePrefix, volumeName, symID, devID string) string {
 	//return fmt.Sprintf("%s-%s-%s-%s", volumePrefix, volumeName, symID, devID)
@@ -937,7 +1024,7 @@ func (s *service) ControllerPublishVolume(
 		"CSIRequestID": reqID,
 	}
 	log.WithFields(fields).Info("Executing ControllerPublishVolume with following fields")
-	isISCSI := false
+	transportProtocol := ""
 	// Check if node ID is present in cache
 	nodeInCache := false
 	cacheID := symID + ":" + nodeID
@@ -946,17 +1033,15 @@ func (s *service) ControllerPublishVolume(
 		log.Debugf("REQ ID: %s Loaded nodeID: %s, hostID: %s from node cache\n",
 			reqID, nodeID, tempHostID.(string))
 		nodeInCache = true
-		if !strings.Contains(tempHostID.(string), "-FC") {
-			isISCSI = true
-		}
+		transportProtocol = getTransportProtocolFromHostID(tempHostID.(string))
 	} else {
 		log.Debugf("REQ ID: %s nodeID: %s not present in node cache\n", reqID, nodeID)
-		isISCSI, err = s.IsNodeISCSI(symID, nodeID)
+		transportProtocol, err = s.GetNodeTransportProtocol(symID, nodeID)
 		if err != nil {
 			return nil, status.Error(codes.NotFound, err.Error())
 		}
 	}
-	hostID, tgtStorageGroupID, tgtMaskingViewID := s.GetHostSGAndMVIDFromNodeID(nodeID, isISCSI)
+	hostID, tgtStorageGroupID, tgtMaskingViewID := s.GetHostSGAndMVIDFromNodeID(nodeID, transportProtocol)
 	if !nodeInCache {
 		// Update the map
 		val, ok := nodeCache.LoadOrStore(cacheID, hostID)
@@ -1066,62 +1151,146 @@ func (s *service) ControllerPublishVolume(
 		}
 	} else {
 		// We need to create a Masking view
-		// First fetch the host details
-		host, err := s.adminClient.GetHostByID(symID, hostID)
-		retry := false
+		err := s.createMaskingViewForHost(symID, devID, hostID, tgtStorageGroupID, tgtMaskingViewID, volumeAlreadyInSG)
 		if err != nil {
-			// Retry once more after a gap of 2 seconds
-			retry = true
-			time.Sleep(2 * time.Second)
+			resp, fallbackErr := s.publishWithAlternateProtocol(reqID, symID, devID, nodeID, transportProtocol,
+				tgtStorageGroupID, volumeAlreadyInSG, publishContext)
+			if fallbackErr != nil {
+				log.Debugf("REQ ID: %s Not publishing with the alternate transport protocol: %s", reqID, fallbackErr.Error())
+				return nil, err
+			}
+			return resp, nil
 		}
-		if retry {
-			host, err = s.adminClient.GetHostByID(symID, hostID)
+	}
+
+	return s.updatePublishContext(publishContext, symID, tgtMaskingViewID, devID)
+}
+
+// createMaskingViewForHost creates a masking view for the host, adding the volume
+// to the host's storage group first if it is not already part of it
+func (s *service) createMaskingViewForHost(symID, devID, hostID, tgtStorageGroupID, tgtMaskingViewID string, volumeAlreadyInSG bool) error {
+	// First fetch the host details
+	host, err := s.adminClient.GetHostByID(symID, hostID)
+	retry := false
+	if err != nil {
+		// Retry once more after a gap of 2 seconds
+		retry = true
+		time.Sleep(2 * time.Second)
+	}
+	if retry {
+		host, err = s.adminClient.GetHostByID(symID, hostID)
+	}
+	if err != nil {
+		errormsg := fmt.Sprintf(
+			"ControllerPublishVolume: Failed to fetch host details for host %s on %s with error - %s", hostID, symID, err.Error())
+		log.Error(errormsg)
+		return status.Error(codes.NotFound, errormsg)
+	}
+	//Fetch or create a port Group
+	portGroupID, err := s.SelectOrCreatePortGroup(symID, host)
+	if err != nil {
+		errormsg := fmt.Sprintf(
+			"ControllerPublishVolume: Failed to select/create PG for host %s on %s with error - %s", hostID, symID, err.Error())
+		log.Error(errormsg)
+		return status.Error(codes.Internal, errormsg)
+	}
+	if !volumeAlreadyInSG {
+		// First check if our storage group exists
+		tgtStorageGroup, err := s.adminClient.GetStorageGroup(symID, tgtStorageGroupID)
+		if err == nil {
+			// Check if this SG is not managed by FAST
+			if tgtStorageGroup.SRP != "" {
+				log.Error(fmt.Sprintf("ControllerPublishVolume: Storage group - %s exists with same name but with conflicting params", tgtStorageGroupID))
+				return status.Error(codes.Internal, "Storage group exists with same name but with conflicting params")
+			}
+		} else {
+			// Attempt to create SG
+			tgtStorageGroup, err = s.adminClient.CreateStorageGroup(symID, tgtStorageGroupID, "None", "", false)
+			if err != nil {
+				log.Error(fmt.Sprintf("ControllerPublishVolume: Failed to create storage group - %s", tgtStorageGroupID))
+				return status.Error(codes.Internal, "Failed to create storage group")
+			}
 		}
+		// Add the volume to storage group
+		err = s.adminClient.AddVolumesToStorageGroup(symID, tgtStorageGroupID, devID)
 		if err != nil {
-			errormsg := fmt.Sprintf(
-				"ControllerPublishVolume: Failed to fetch host details for host %s on %s with error - %s", hostID, symID, err.Error())
-			log.Error(errormsg)
-			return nil, status.Error(codes.NotFound, errormsg)
+			log.Error(fmt.Sprintf("ControllerPublishVolume: Failed to add device - %s to storage group - %s", devID, tgtStorageGroupID))
+			return status.Error(codes.Internal, "Failed to add volume to storage group")
+		}
+	}
+	_, err = s.adminClient.CreateMaskingView(symID, tgtMaskingViewID, tgtStorageGroupID, hostID, true, portGroupID)
+	if err != nil {
+		log.Error(fmt.Sprintf("ControllerPublishVolume: Failed to create masking view - %s", tgtMaskingViewID))
+		return status.Error(codes.Internal, "Failed to create masking view")
+	}
+	return nil
+}
+
+// publishWithAlternateProtocol publishes a volume to a node using another transport
+// protocol, after the masking view for the selected protocol could not be created.
+// The first of the other protocols which may be used with the array, and for which
+// the node has a host on the array, is used.
+func (s *service) publishWithAlternateProtocol(reqID, symID, devID, nodeID, failedProtocol string,
+	failedStorageGroupID string, volumeAlreadyInSG bool, publishContext map[string]string) (*csi.ControllerPublishVolumeResponse, error) {
+	altProtocol := ""
+	var hostID, tgtStorageGroupID, tgtMaskingViewID string
+	for _, tp := range s.getTransportProtocolOrder(symID) {
+		if tp == failedProtocol {
+			continue
 		}
-		//Fetch or create a port Group
-		portGroupID, err := s.SelectOrCreatePortGroup(symID, host)
+		hostID, tgtStorageGroupID, tgtMaskingViewID = s.GetHostSGAndMVIDFromNodeID(nodeID, tp)
+		host, err := s.adminClient.GetHostByID(symID, hostID)
 		if err != nil {
-			errormsg := fmt.Sprintf(
-				"ControllerPublishVolume: Failed to select/create PG for host %s on %s with error - %s", hostID, symID, err.Error())
-			log.Error(errormsg)
-			return nil, status.Error(codes.Internal, errormsg)
+			log.Debugf("REQ ID: %s node %s has no %s host on %s", reqID, nodeID, tp, symID)
+			continue
 		}
-		if !volumeAlreadyInSG {
-			// First check if our storage group exists
-			tgtStorageGroup, err := s.adminClient.GetStorageGroup(symID, tgtStorageGroupID)
-			if err == nil {
-				// Check if this SG is not managed by FAST
-				if tgtStorageGroup.SRP != "" {
-					log.Error(fmt.Sprintf("ControllerPublishVolume: Storage group - %s exists with same name but with conflicting params", tgtStorageGroupID))
-					return nil, status.Error(codes.Internal, "Storage group exists with same name but with conflicting params")
-				}
-			} else {
-				// Attempt to create SG
-				tgtStorageGroup, err = s.adminClient.CreateStorageGroup(symID, tgtStorageGroupID, "None", "", false)
-				if err != nil {
-					log.Error(fmt.Sprintf("ControllerPublishVolume: Failed to create storage group - %s", tgtStorageGroupID))
-					return nil, status.Error(codes.Internal, "Failed to create storage group")
-				}
+		if (tp == FcTransportProtocol && host.HostType != "Fibre") ||
+			(tp == IscsiTransportProtocol && host.HostType != "iSCSI") {
+			log.Debugf("REQ ID: %s host %s on %s is not a %s host", reqID, hostID, symID, tp)
+			continue
+		}
+		altProtocol = tp
+		break
+	}
+	if altProtocol == "" {
+		return nil, fmt.Errorf("node %s has no host for another allowed transport protocol on %s", nodeID, symID)
+	}
+	log.Warningf("REQ ID: %s Falling back to %s to publish device %s to node %s on %s",
+		reqID, altProtocol, devID, nodeID, symID)
+	if !volumeAlreadyInSG {
+		// The volume may have been added to the storage group of the masking view that failed
+		if _, err := s.adminClient.RemoveVolumesFromStorageGroup(symID, failedStorageGroupID, devID); err != nil {
+			log.Warningf("REQ ID: %s Failed to remove device %s from storage group %s: %s",
+				reqID, devID, failedStorageGroupID, err.Error())
+		}
+	}
+	// Another lock is taken while holding the lock for the failed storage group.
+	// Requests for the same node and array select the same protocol first, via the
+	// node cache, which the fallback does not change, so they always take these locks
+	// in the same order. The publish context tells the node which protocol was used.
+	lockNum := RequestLock(tgtStorageGroupID, reqID)
+	defer ReleaseLock(tgtStorageGroupID, reqID, lockNum)
+	altVolumeInSG := false
+	if vol, err := s.adminClient.GetVolumeByID(symID, devID); err == nil {
+		for _, sgID := range vol.StorageGroupIDList {
+			if sgID == tgtStorageGroupID {
+				altVolumeInSG = true
 			}
-			// Add the volume to storage group
+		}
+	}
+	if _, err := s.adminClient.GetMaskingViewByID(symID, tgtMaskingViewID); err == nil {
+		if !altVolumeInSG {
 			err = s.adminClient.AddVolumesToStorageGroup(symID, tgtStorageGroupID, devID)
 			if err != nil {
-				log.Error(fmt.Sprintf("ControllerPublishVolume: Failed to add device - %s to storage group - %s", devID, tgtStorageGroupID))
-				return nil, status.Error(codes.Internal, "Failed to add volume to storage group")
+				return nil, err
 			}
 		}
-		_, err = s.adminClient.CreateMaskingView(symID, tgtMaskingViewID, tgtStorageGroupID, hostID, true, portGroupID)
+	} else {
+		err = s.createMaskingViewForHost(symID, devID, hostID, tgtStorageGroupID, tgtMaskingViewID, altVolumeInSG)
 		if err != nil {
-			log.Error(fmt.Sprintf("ControllerPublishVolume: Failed to create masking view - %s", tgtMaskingViewID))
-			return nil, status.Error(codes.Internal, "Failed to create masking view")
+			return nil, err
 		}
 	}
-
 	return s.updatePublishContext(publishContext, symID, tgtMaskingViewID, devID)
 }
 
@@ -1158,8 +1327,20 @@ func (s *service) updatePublishContext(publishContext map[string]string, symID,
 			dirPorts = appendIfMissing(dirPorts, conn.DirectorPort)
 		}
 	}
+	transportProtocol := getTransportProtocolFromHostID(tgtMaskingViewID)
 	portIdentifiers := ""
 	for _, dirPortKey := range dirPorts {
+		if transportProtocol == NvmeTCPTransportProtocol {
+			// NVMe/TCP targets need the address of the port as well as the subsystem NQN
+			targets, err := s.getNVMeTCPTargetIdentifiers(symID, dirPortKey)
+			if err != nil {
+				continue
+			}
+			for _, target := range targets {
+				portIdentifiers += target + ","
+			}
+			continue
+		}
 		portIdentifier, err := s.GetPortIdentifier(symID, dirPortKey)
 		if err != nil {
 			continue
@@ -1173,6 +1354,8 @@ func (s *service) updatePublishContext(publishContext map[string]string, symID,
 	}
 	log.Debugf("Port identifiers in publish context: %s", portIdentifiers)
 	publishContext[PortIdentifiers] = portIdentifiers
+	// the node connects, and later disconnects, the volume with this protocol
+	publishContext[PublishContextTransportProtocol] = transportProtocol
 
 	if lunid == "" {
 		return nil, status.Error(codes.Internal, "PublishContext: Could not determine HostLUNAddress")
@@ -1181,65 +1364,45 @@ func (s *service) updatePublishContext(publishContext map[string]string, symID,
 	return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
 }
 
-// IsNodeISCSI - Takes a sym id, node id as input and based on the transport protocol setting
-// and the existence of the host on array, it returns a bool to indicate if the Host
-// on array is ISCSI or not
-func (s *service) IsNodeISCSI(symID, nodeID string) (bool, error) {
-	fcHostID, _, fcMaskingViewID := s.GetFCHostSGAndMVIDFromNodeID(nodeID)
-	iSCSIHostID, _, iSCSIMaskingViewID := s.GetISCSIHostSGAndMVIDFromNodeID(nodeID)
-	if s.opts.TransportProtocol == FcTransportProtocol || s.opts.TransportProtocol == "" {
-		log.Debug("Preferred transport protocol is set to FC")
-		_, fcmverr := s.adminClient.GetMaskingViewByID(symID, fcMaskingViewID)
-		if fcmverr == nil {
-			return false, nil
-		}
-		// Check if ISCSI MV exists
-		_, iscsimverr := s.adminClient.GetMaskingViewByID(symID, iSCSIMaskingViewID)
-		if iscsimverr == nil {
-			return true, nil
-		}
-		// Check if FC Host exists
-		fcHost, fcHostErr := s.adminClient.GetHostByID(symID, fcHostID)
-		if fcHostErr == nil {
-			if fcHost.HostType == "Fibre" {
-				return false, nil
-			}
-		}
-		// Check if ISCSI Host exists
-		iscsiHost, iscsiHostErr := s.adminClient.GetHostByID(symID, iSCSIHostID)
-		if iscsiHostErr == nil {
-			if iscsiHost.HostType == "iSCSI" {
-				return true, nil
-			}
+// GetNodeTransportProtocol - Takes a sym id, node id as input and based on the transport protocol
+// preference for the array and the existence of the masking view or host on array, it returns
+// the transport protocol (FC, ISCSI, NVMETCP or NVMEFC) of the Host on array
+func (s *service) GetNodeTransportProtocol(symID, nodeID string) (string, error) {
+	// Masking views and hosts of any protocol are honored, but those of the
+	// preferred protocols are checked first
+	order := append([]string{}, s.getTransportProtocolOrder(symID)...)
+	for _, tp := range allTransportProtocols {
+		order = appendIfMissing(order, tp)
+	}
+	log.Debugf("Transport protocol order for %s is %v", symID, order)
+	for _, tp := range order {
+		_, _, maskingViewID := s.GetHostSGAndMVIDFromNodeID(nodeID, tp)
+		// Check if the masking view exists
+		if _, err := s.adminClient.GetMaskingViewByID(symID, maskingViewID); err == nil {
+			return tp, nil
+		}
+	}
+	for _, tp := range order {
+		hostID, _, _ := s.GetHostSGAndMVIDFromNodeID(nodeID, tp)
+		host, err := s.adminClient.GetHostByID(symID, hostID)
+		if err != nil {
+			continue
 		}
-	} else if s.opts.TransportProtocol == IscsiTransportProtocol {
-		log.Debug("Preferred transport protocol is set to ISCSI")
-		// Check if ISCSI MV exists
-		_, iscsimverr := s.adminClient.GetMaskingViewByID(symID, iSCSIMaskingViewID)
-		if iscsimverr == nil {
-			return true, nil
-		}
-		// Check if FC MV exists
-		_, fcmverr := s.adminClient.GetMaskingViewByID(symID, fcMaskingViewID)
-		if fcmverr == nil {
-			return false, nil
-		}
-		// Check if ISCSI Host exists
-		iscsiHost, iscsiHostErr := s.adminClient.GetHostByID(symID, iSCSIHostID)
-		if iscsiHostErr == nil {
-			if iscsiHost.HostType == "iSCSI" {
-				return true, nil
+		// NVMe hosts are identified by the suffix of their ID only
+		switch tp {
+		case FcTransportProtocol:
+			if host.HostType == "Fibre" {
+				return tp, nil
 			}
-		}
-		// Check if FC Host exists
-		fcHost, fcHostErr := s.adminClient.GetHostByID(symID, fcHostID)
-		if fcHostErr == nil {
-			if fcHost.HostType == "Fibre" {
-				return false, nil
+		case IscsiTransportProtocol:
+			if host.HostType == "iSCSI" {
+				return tp, nil
 			}
+		default:
+			return tp, nil
 		}
 	}
-	return false, fmt.Errorf("Failed to fetch host id from array for node: %s", nodeID)
+	return "", fmt.Errorf("Failed to fetch host id from array for node: %s", nodeID)
 }
 
 // GetVolumeByID - Takes a CSI volume ID and checks for its existence on array
@@ -1293,10 +1456,15 @@ func (s *service) GetMaskingViewAndSGDetails(symID string, sgIDs []string) ([]st
 }
 
 // GetHostSGAndMVIDFromNodeID - Gets the Host ID, SG ID, MV ID given a node ID and
-// a boolean which indicates if node is FC or ISCSI
-func (s *service) GetHostSGAndMVIDFromNodeID(nodeID string, isISCSI bool) (string, string, string) {
-	if isISCSI {
+// the transport protocol (FC, ISCSI, NVMETCP or NVMEFC) used by the node
+func (s *service) GetHostSGAndMVIDFromNodeID(nodeID, transportProtocol string) (string, string, string) {
+	switch transportProtocol {
+	case IscsiTransportProtocol:
 		return s.GetISCSIHostSGAndMVIDFromNodeID(nodeID)
+	case NvmeTCPTransportProtocol:
+		return s.GetNVMeTCPHostSGAndMVIDFromNodeID(nodeID)
+	case NvmeFCTransportProtocol:
+		return s.GetNVMeFCHostSGAndMVIDFromNodeID(nodeID)
 	}
 	return s.GetFCHostSGAndMVIDFromNodeID(nodeID)
 }
@@ -1317,6 +1485,39 @@ func (s *service) GetFCHostSGAndMVIDFromNodeID(nodeID string) (string, string, s
 	return hostID + FCSuffix, storageGroupID + FCSuffix, maskingViewID + FCSuffix
 }
 
+// GetNVMeTCPHostSGAndMVIDFromNodeID - Forms NVMe/TCP HostID, StorageGroupID, MaskingViewID
+// These are the same as iSCSI except for "-NVMETCP" is added as a suffix.
+func (s *service) GetNVMeTCPHostSGAndMVIDFromNodeID(nodeID string) (string, string, string) {
+	hostID, storageGroupID, maskingViewID := s.GetISCSIHostSGAndMVIDFromNodeID(nodeID)
+	return hostID + NVMeTCPSuffix, storageGroupID + NVMeTCPSuffix, maskingViewID + NVMeTCPSuffix
+}
+
+// GetNVMeFCHostSGAndMVIDFromNodeID - Forms NVMe/FC HostID, StorageGroupID, MaskingViewID
+// These are the same as iSCSI except for "-NVMEFC" is added as a suffix.
+func (s *service) GetNVMeFCHostSGAndMVIDFromNodeID(nodeID string) (string, string, string) {
+	hostID, storageGroupID, maskingViewID := s.GetISCSIHostSGAndMVIDFromNodeID(nodeID)
+	return hostID + NVMeFCSuffix, storageGroupID + NVMeFCSuffix, maskingViewID + NVMeFCSuffix
+}
+
+// getTransportProtocolFromHostID returns the transport protocol of a host, masking view
+// or storage group created by the driver, based on the suffix of its ID
+func getTransportProtocolFromHostID(hostID string) string {
+	switch {
+	case strings.HasSuffix(hostID, FCSuffix):
+		return FcTransportProtocol
+	case strings.HasSuffix(hostID, NVMeTCPSuffix):
+		return NvmeTCPTransportProtocol
+	case strings.HasSuffix(hostID, NVMeFCSuffix):
+		return NvmeFCTransportProtocol
+	}
+	return IscsiTransportProtocol
+}
+
+// isNVMeTransportProtocol returns true for NVMe/TCP and NVMe/FC
+func isNVMeTransportProtocol(transportProtocol string) bool {
+	return transportProtocol == NvmeTCPTransportProtocol || transportProtocol == NvmeFCTransportProtocol
+}
+
 func (s *service) ControllerUnpublishVolume(
 	ctx context.Context,
 	req *csi.ControllerUnpublishVolumeRequest) (
@@ -1374,20 +1575,22 @@ func (s *service) ControllerUnpublishVolume(
 	}
 	log.WithFields(fields).Info("Executing ControllerUnpublishVolume with following fields")
 
-	// Determine if the volume is in a FC or ISCSI MV
-	_, tgtFCStorageGroupID, tgtFCMaskingViewID := s.GetFCHostSGAndMVIDFromNodeID(nodeID)
-	_, tgtISCSIStorageGroupID, tgtISCSIMaskingViewID := s.GetISCSIHostSGAndMVIDFromNodeID(nodeID)
-	isISCSI := false
+	// Determine if the volume is in a FC, ISCSI or NVMe MV
+	var tgtStorageGroupID, tgtMaskingViewID string
 	// Check if volume is part of the Storage group
 	currentSGIDs := vol.StorageGroupIDList
 	volumeInStorageGroup := false
-	for _, storageGroupID := range currentSGIDs {
-		if storageGroupID == tgtFCStorageGroupID {
-			volumeInStorageGroup = true
-			break
-		} else if storageGroupID == tgtISCSIStorageGroupID {
-			volumeInStorageGroup = true
-			isISCSI = true
+	for _, tp := range allTransportProtocols {
+		_, storageGroupID, maskingViewID := s.GetHostSGAndMVIDFromNodeID(nodeID, tp)
+		for _, sgID := range currentSGIDs {
+			if sgID == storageGroupID {
+				volumeInStorageGroup = true
+				tgtStorageGroupID = storageGroupID
+				tgtMaskingViewID = maskingViewID
+				break
+			}
+		}
+		if volumeInStorageGroup {
 			break
 		}
 	}
@@ -1396,14 +1599,6 @@ func (s *service) ControllerUnpublishVolume(
 		log.Debug("volume already unpublished")
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
-	var tgtStorageGroupID, tgtMaskingViewID string
-	if !isISCSI {
-		tgtStorageGroupID = tgtFCStorageGroupID
-		tgtMaskingViewID = tgtFCMaskingViewID
-	} else {
-		tgtStorageGroupID = tgtISCSIStorageGroupID
-		tgtMaskingViewID = tgtISCSIMaskingViewID
-	}
 	lockNum := RequestLock(tgtStorageGroupID, reqID)
 	defer ReleaseLock(tgtStorageGroupID, reqID, lockNum)
 
@@ -1520,7 +1715,7 @@ func (s *service) ValidateVolumeCapabilities(
 	}
 
 	vcs := req.GetVolumeCapabilities()
-	supported, reason := valVolumeCaps(vcs, vol)
+	supported, reason := valVolumeCaps(vcs, vol, s.multiWriterMountFsTypes(attributes))
 
 	resp := &csi.ValidateVolumeCapabilitiesResponse{}
 	if supported {
@@ -1600,8 +1795,10 @@ func (s *service) valVolumeContext(attributes map[string]string, vol *types.Volu
 	return false, msg
 }
 
+// valVolumeCaps validates the volume capabilities. Mount capabilities may only
+// be multi-node writers if their fstype is one of the clusterFsTypes.
 func valVolumeCaps(
-	vcs []*csi.VolumeCapability, vol *types.Volume) (bool, string) {
+	vcs []*csi.VolumeCapability, vol *types.Volume, clusterFsTypes []string) (bool, string) {
 
 	var (
 		supported = true
@@ -1630,13 +1827,17 @@ func valVolumeCaps(
 		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
 			break
 		case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
-			fallthrough
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
 			if !isBlock {
 				supported = false
 				reason = errNoMultiNodeWriter
 			}
 			break
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+			if !isBlock && !isClusterFs(vc.GetMount().GetFsType(), clusterFsTypes) {
+				supported = false
+				reason = errNoMultiNodeWriter
+			}
+			break
 		default:
 			// This is to guard against new access modes not understood
 			supported = false
@@ -1685,7 +1886,7 @@ func (s *service) GetCapacity(
 	// Optionally validate the volume capability
 	vcs := req.GetVolumeCapabilities()
 	if vcs != nil {
-		supported, reason := valVolumeCaps(vcs, nil)
+		supported, reason := valVolumeCaps(vcs, nil, nil)
 		if !supported {
 			log.Error("GetVolumeCapabilities failed with error: " + reason)
 			return nil, status.Errorf(codes.InvalidArgument, reason)
@@ -1839,15 +2040,28 @@ func (s *service) requireProbe(ctx context.Context) error {
 	return nil
 }
 
-// SelectPortGroup - Selects a Port Group randomly from the list of supplied port groups
-func (s *service) SelectPortGroup() (string, error) {
-	if len(s.opts.PortGroups) == 0 {
+// SelectPortGroup - Selects a Port Group from the list of supplied port groups for the array
+// using the configured port group selection strategy
+func (s *service) SelectPortGroup(symID string) (string, error) {
+	portGroups := s.getPortGroupsForArray(symID)
+	if len(portGroups) == 0 {
 		return "", fmt.Errorf("No port groups have been supplied")
 	}
 
-	// select a random port group
-	n := rand.Int() % len(s.opts.PortGroups)
-	pg := s.opts.PortGroups[n]
+	var pg string
+	switch s.opts.PortGroupSelection {
+	case PortGroupSelectionRoundRobin:
+		pg = selectPortGroupRoundRobin(symID, portGroups)
+	case PortGroupSelectionLeastMaskingViews:
+		pg = s.selectPortGroupByScore(symID, portGroups, getPortGroupMaskingViewScores)
+	case PortGroupSelectionLeastDirectorMaskingViews:
+		pg = s.selectPortGroupByScore(symID, portGroups, getPortGroupDirectorScores)
+	default:
+		// select a random port group
+		n := rand.Int() % len(portGroups)
+		pg = portGroups[n]
+	}
+	log.Debugf("Selected port group %s on %s using %s selection", pg, symID, s.opts.PortGroupSelection)
 	return pg, nil
 }
 
@@ -1857,22 +2071,26 @@ func (s *service) SelectOrCreatePortGroup(symID string, host *types.Host) (strin
 	if host == nil {
 		return "", fmt.Errorf("SelectOrCreatePortGroup: host can't be nil")
 	}
-	if host.HostType == "Fibre" {
+	// NVMe port groups are built from the ports the host initiators are logged into, as for FC
+	if host.HostType == "Fibre" || isNVMeTransportProtocol(getTransportProtocolFromHostID(host.HostID)) {
 		return s.SelectOrCreateFCPGForHost(symID, host)
 	}
-	return s.SelectPortGroup()
+	return s.SelectPortGroup(symID)
 }
 
 // SelectOrCreateFCPGForHost - Selects or creates a Fibre Channel PG given a symid and host
+// NVMe/TCP and NVMe/FC hosts are handled in the same way
 func (s *service) SelectOrCreateFCPGForHost(symID string, host *types.Host) (string, error) {
 	if host == nil {
 		return "", fmt.Errorf("SelectOrCreateFCPGForHost: host can't be nil")
 	}
 	validPortGroupID := ""
 	hostID := host.HostID
+	transportProtocol := getTransportProtocolFromHostID(hostID)
+	isNVMe := isNVMeTransportProtocol(transportProtocol)
 	var portListFromHost []string
 	var isValidHost bool
-	if host.HostType == "Fibre" {
+	if host.HostType == "Fibre" || isNVMe {
 		for _, initiator := range host.Initiators {
 			initList, err := s.adminClient.GetInitiatorList(symID, initiator, false, false)
 			if err != nil {
@@ -1880,7 +2098,11 @@ func (s *service) SelectOrCreateFCPGForHost(symID string, host *types.Host) (str
 				continue
 			} else {
 				for _, initiatorID := range initList.InitiatorIDs {
-					_, dirPort, _, err := splitFibreChannelInitiatorID(initiatorID)
+					splitInitiatorID := splitFibreChannelInitiatorID
+					if isNVMe {
+						splitInitiatorID = splitNVMeInitiatorID
+					}
+					_, dirPort, _, err := splitInitiatorID(initiatorID)
 					if err != nil {
 						continue
 					}
@@ -1893,7 +2115,22 @@ func (s *service) SelectOrCreateFCPGForHost(symID string, host *types.Host) (str
 	if !isValidHost {
 		return "", fmt.Errorf("Failed to find a valid initiator for hostID %s from %s", hostID, symID)
 	}
-	fcPortGroupList, err := s.adminClient.GetPortGroupList(symID, "fibre")
+	if config := s.getArrayConfig(symID); config != nil && len(config.FCDirectors) > 0 {
+		preferredPorts := filterPortsByDirectors(portListFromHost, config.FCDirectors)
+		if len(preferredPorts) > 0 {
+			log.Debugf("Using ports %v on preferred directors %v", preferredPorts, config.FCDirectors)
+			portListFromHost = preferredPorts
+		} else {
+			log.Warningf("Host %s has no ports on the preferred directors %v of %s, using all ports",
+				hostID, config.FCDirectors, symID)
+		}
+	}
+	// NVMe/TCP port groups can't be filtered by type
+	portGroupType := "fibre"
+	if transportProtocol == NvmeTCPTransportProtocol {
+		portGroupType = ""
+	}
+	fcPortGroupList, err := s.adminClient.GetPortGroupList(symID, portGroupType)
 	if err != nil {
 		return "", fmt.Errorf("Failed to fetch Fibre channel port groups for array: %s", symID)
 	}
@@ -1911,7 +2148,7 @@ func (s *service) SelectOrCreateFCPGForHost(symID string, host *types.Host) (str
 			continue
 		} else {
 			var portList []string
-			if portGroup.PortGroupType == "Fibre" {
+			if portGroup.PortGroupType == "Fibre" || transportProtocol == NvmeTCPTransportProtocol {
 				for _, portKey := range portGroup.SymmetrixPortKey {
 					portList = append(portList, portKey.PortID)
 				}
@@ -1981,6 +2218,19 @@ func (s *service) CreateSnapshot(
 			"Snapshot name cannot be empty")
 	}
 
+	// Snapshot time to live and maximum number of snapshots per volume are optional
+	params := req.GetParameters()
+	ttl, err := parseSnapshotTTL(params[SnapshotTTLParam])
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	maxSnapshots, err := parseMaxSnapshotsPerVolume(params[MaxSnapshotsPerVolumeParam])
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
 	// Get the snapshot prefix from environment
 	maxLength := MaxSnapIdentifierLength - len(s.getClusterPrefix()) - len(CsiVolumePrefix) - 5
 	//First get the short snap name
@@ -2019,10 +2269,7 @@ func (s *service) CreateSnapshot(
 	snapInfo, err := s.adminClient.GetSnapshotInfo(symID, devID, snapID)
 	if err == nil && snapInfo.VolumeSnapshotSource != nil {
 		snapID = fmt.Sprintf("%s-%s-%s", snapID, symID, devID)
-		snapshot := &csi.Snapshot{
-			SnapshotId:     snapID,
-			SourceVolumeId: volID, ReadyToUse: true,
-			CreationTime: ptypes.TimestampNow()}
+		snapshot := getCSISnapshot(snapInfo, snapID, volID)
 		resp := &csi.CreateSnapshotResponse{Snapshot: snapshot}
 		return resp, nil
 	}
@@ -2033,27 +2280,33 @@ func (s *service) CreateSnapshot(
 		"SymmetrixID":  symID,
 		"SnapshotID":   snapID,
 		"DeviceID":     devID,
+		"TTLDays":      ttl,
+		"MaxSnapshots": maxSnapshots,
 	}
 	log.WithFields(fields).Info("Executing CreateSnapshot with following fields")
 
 	// Create snapshot
 	lockNumber := RequestLock(SnapLock, reqID)
-	snap, err := s.CreateSnapshotFromVolume(symID, vol, snapID, 0, reqID)
+	snap, err := s.CreateSnapshotFromVolume(symID, vol, snapID, ttl, reqID)
 	ReleaseLock(SnapLock, reqID, lockNumber)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to create snapshot: %s", err.Error())
 	}
 
+	// Delete the oldest snapshots of the volume beyond the maximum
+	if maxSnapshots > 0 {
+		if _, err := s.pruneSnapshots(symID, devID, snap.SnapshotName, maxSnapshots, reqID); err != nil {
+			log.Errorf("Failed to prune the snapshots of volume (%s): %s", devID, err.Error())
+		}
+	}
+
 	snapID = fmt.Sprintf("%s-%s-%s", snap.SnapshotName, symID, devID)
 	// populate response structure
-	snapshot := &csi.Snapshot{
-		SnapshotId:     snapID,
-		SourceVolumeId: volID, ReadyToUse: true,
-		CreationTime: ptypes.TimestampNow()}
+	snapshot := getCSISnapshot(snap, snapID, volID)
 	resp := &csi.CreateSnapshotResponse{Snapshot: snapshot}
 
-	log.Debugf("Created snapshot: SnapshotId %s SourceVolumeId %s CreationTime %s",
-		snapshot.SnapshotId, snapshot.SourceVolumeId, ptypes.TimestampString(snapshot.CreationTime))
+	log.Debugf("Created snapshot: SnapshotId %s SourceVolumeId %s CreationTime %s ReadyToUse %t",
+		snapshot.SnapshotId, snapshot.SourceVolumeId, ptypes.TimestampString(snapshot.CreationTime), snapshot.ReadyToUse)
 	return resp, nil
 }
 
@@ -2124,6 +2377,22 @@ func (s *service) DeleteSnapshot(
 	lockHandle := fmt.Sprintf("%s%s", devID, symID)
 	lockNum := RequestLock(lockHandle, reqID)
 	defer ReleaseLock(lockHandle, reqID, lockNum)
+	// a secure snapshot cannot be terminated before its retention expires, so it is only
+	// marked for deletion, and terminated by the snapshot cleanup once it has expired
+	lockedUntil, locked, err := s.getSnapshotRetention(symID, devID, snapID)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, status.Errorf(codes.Internal, "%s", err.Error())
+	}
+	if locked {
+		if _, err := s.MarkSnapshotForDeletion(symID, snapID, devID); err != nil {
+			log.Errorf("Failed to rename secure snapshot (%s) error (%s)", snapID, err.Error())
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"Snapshot (%s) is secure and cannot be deleted before %s", snapID, lockedUntil.Format(time.RFC3339))
+		}
+		log.Infof("Secure snapshot (%s) is marked for deletion, it will be terminated after %s", snapID, lockedUntil.Format(time.RFC3339))
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
 	// mark the snapshot for deletion by changing the snapshot name to mark for deletion
 	newSnapID, err := s.MarkSnapshotForDeletion(symID, snapID, devID)
 	if err != nil {
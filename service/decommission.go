@@ -0,0 +1,171 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DecommissionCommand is the command line argument which runs Decommission rather than the driver
+const DecommissionCommand = "decommission"
+
+// nodeObjects holds the names of the objects created on an array for a node with one transport protocol
+type nodeObjects struct {
+	hostID         string
+	storageGroupID string
+	maskingViewID  string
+}
+
+// Decommission runs the decommission command, which removes the hosts, masking views and storage
+// groups created for a node which was removed from the cluster, and writes the removed objects
+// to out. The node must have been removed from the cluster, or drained and cordoned, first. The Unisphere connection and the cluster prefix are read from the same environment
+// variables as the driver.
+func Decommission(ctx context.Context, args []string, out io.Writer) error {
+	var nodeID, symID string
+	var force bool
+	flags := flag.NewFlagSet(DecommissionCommand, flag.ContinueOnError)
+	flags.StringVar(&nodeID, "node", "", "ID of the node, as used in the names of its hosts (required)")
+	flags.StringVar(&symID, "symid", "", "symmetrix ID of the array to clean up, all the allowed arrays by default")
+	flags.BoolVar(&force, "force", false, "unmap the volumes still mapped to the node")
+	flags.SetOutput(out)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if nodeID == "" {
+		return fmt.Errorf("-node is required")
+	}
+
+	s := New().(*service)
+	if err := s.loadCommandOpts(ctx); err != nil {
+		return err
+	}
+	if err := s.controllerProbe(ctx); err != nil {
+		return err
+	}
+	symIDs := []string{symID}
+	if symID == "" {
+		symIDList, err := s.adminClient.GetSymmetrixIDList()
+		if err != nil {
+			return err
+		}
+		symIDs = symIDs[:0]
+		for _, id := range symIDList.SymmetrixIDs {
+			if allowed, _ := s.adminClient.IsAllowedArray(id); allowed {
+				symIDs = append(symIDs, id)
+			}
+		}
+	}
+	for _, id := range symIDs {
+		removed, err := s.decommissionNode(id, nodeID, force)
+		for _, object := range removed {
+			fmt.Fprintf(out, "%s %s\n", id, object)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getNodeObjects returns the names of the objects created for a node, for each transport protocol
+func (s *service) getNodeObjects(nodeID string) []nodeObjects {
+	protocols := []string{FcTransportProtocol, IscsiTransportProtocol, NvmeTCPTransportProtocol, NvmeFCTransportProtocol}
+	objects := make([]nodeObjects, 0, len(protocols))
+	for _, protocol := range protocols {
+		hostID, storageGroupID, maskingViewID := s.GetHostSGAndMVIDFromNodeID(nodeID, protocol)
+		objects = append(objects, nodeObjects{hostID: hostID, storageGroupID: storageGroupID, maskingViewID: maskingViewID})
+	}
+	return objects
+}
+
+// decommissionNode removes the masking views, storage groups and hosts created on an array for
+// a node, and returns the removed objects. It refuses to remove anything while volumes are still
+// mapped to the node, unless force is set, in which case the volumes are unmapped first.
+// The command runs in its own process, so it cannot take the storage group locks of the
+// controller, and must only be run once no volume can be published to the node any more.
+func (s *service) decommissionNode(symID, nodeID string, force bool) ([]string, error) {
+	objects := s.getNodeObjects(nodeID)
+	if !force {
+		for _, obj := range objects {
+			sg, err := s.adminClient.GetStorageGroup(symID, obj.storageGroupID)
+			if err == nil && sg.NumOfVolumes > 0 {
+				return nil, status.Errorf(codes.FailedPrecondition,
+					"%d volumes are still mapped to node %s in storage group %s on %s, unpublish them or use -force",
+					sg.NumOfVolumes, nodeID, obj.storageGroupID, symID)
+			}
+		}
+	}
+
+	removed := make([]string, 0)
+	for _, obj := range objects {
+		if err := s.removeNodeObjects(symID, obj, &removed); err != nil {
+			return removed, err
+		}
+	}
+	if len(removed) == 0 {
+		log.Infof("No objects of node %s found on %s", nodeID, symID)
+	}
+	return removed, nil
+}
+
+// removeNodeObjects removes the masking view, the storage group and the host of a node, if they
+// exist, and appends them to removed. The volumes in the storage group are unmapped first.
+func (s *service) removeNodeObjects(symID string, obj nodeObjects, removed *[]string) error {
+	if _, err := s.adminClient.GetMaskingViewByID(symID, obj.maskingViewID); err == nil {
+		log.Infof("Removing masking view %s", obj.maskingViewID)
+		if err := s.adminClient.DeleteMaskingView(symID, obj.maskingViewID); err != nil {
+			return status.Errorf(codes.Internal, "Could not remove masking view %s: %s", obj.maskingViewID, err.Error())
+		}
+		*removed = append(*removed, obj.maskingViewID)
+	}
+
+	if sg, err := s.adminClient.GetStorageGroup(symID, obj.storageGroupID); err == nil {
+		if sg.NumOfVolumes > 0 {
+			volumeIDs, err := s.adminClient.GetVolumeIDListInStorageGroup(symID, obj.storageGroupID)
+			if err != nil {
+				return status.Errorf(codes.Internal, "Could not list the volumes of storage group %s: %s", obj.storageGroupID, err.Error())
+			}
+			log.Infof("Unmapping volumes %v from storage group %s", volumeIDs, obj.storageGroupID)
+			if _, err := s.adminClient.RemoveVolumesFromStorageGroup(symID, obj.storageGroupID, volumeIDs...); err != nil {
+				return status.Errorf(codes.Internal, "Could not remove the volumes of storage group %s: %s", obj.storageGroupID, err.Error())
+			}
+		}
+		log.Infof("Removing storage group %s", obj.storageGroupID)
+		if err := s.adminClient.DeleteStorageGroup(symID, obj.storageGroupID); err != nil {
+			return status.Errorf(codes.Internal, "Could not remove storage group %s: %s", obj.storageGroupID, err.Error())
+		}
+		*removed = append(*removed, obj.storageGroupID)
+	}
+
+	if host, err := s.adminClient.GetHostByID(symID, obj.hostID); err == nil {
+		if host.NumberMaskingViews > 0 {
+			return status.Errorf(codes.FailedPrecondition,
+				"Host %s is still in masking views %v which were not created by the driver", obj.hostID, host.MaskingviewIDs)
+		}
+		log.Infof("Removing host %s", obj.hostID)
+		if err := s.adminClient.DeleteHost(symID, obj.hostID); err != nil {
+			return status.Errorf(codes.Internal, "Could not remove host %s: %s", obj.hostID, err.Error())
+		}
+		*removed = append(*removed, obj.hostID)
+	}
+	return nil
+}
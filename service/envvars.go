@@ -61,6 +61,22 @@ const (
 	// These Port Groups must exist and be populated
 	EnvPortGroups = "X_CSI_POWERMAX_PORTGROUPS"
 
+	// EnvArrayPortGroups is the name of the environment variable that is used
+	// to specify Port Groups for individual arrays, in the form
+	// "SYMID1:pg1,pg2;SYMID2:pg3". Arrays not listed use X_CSI_POWERMAX_PORTGROUPS
+	EnvArrayPortGroups = "X_CSI_POWERMAX_ARRAY_PORTGROUPS"
+
+	// EnvArrayConfig is the name of the environment variable that is used
+	// to specify the path of a YAML file (typically mounted from a ConfigMap)
+	// which holds the port groups, preferred FC directors and transport protocol
+	// for individual arrays. Settings in the file override the global ones.
+	EnvArrayConfig = "X_CSI_POWERMAX_ARRAY_CONFIG"
+
+	// EnvPortGroupSelection is the name of the environment variable that is used
+	// to specify how a Port Group is chosen when creating an iSCSI masking view.
+	// Valid values are "random", "round-robin", "least-masking-views" and "least-director-masking-views"
+	EnvPortGroupSelection = "X_CSI_POWERMAX_PORTGROUP_SELECTION"
+
 	// EnvClusterPrefix is the name of the environment variable that is used
 	// to specifiy a a prefix to apply to objects creaated via this CSI cluster
 	EnvClusterPrefix = "X_CSI_K8S_CLUSTER_PREFIX"
@@ -85,4 +101,64 @@ const (
 	// Valid values are "FC" or "ISCSI" or "". If "", will choose FC if both are available.
 	// This is mainly for testing.
 	EnvPreferredTransportProtocol = "X_CSI_TRANSPORT_PROTOCOL"
+
+	// EnvTransportProtocolPreference is the name of the environment variable used to
+	// specify the order in which transport protocols are tried for each array when
+	// X_CSI_TRANSPORT_PROTOCOL is not set, e.g. "ISCSI,FC". The default is "FC,ISCSI".
+	EnvTransportProtocolPreference = "X_CSI_POWERMAX_TRANSPORT_PREFERENCE"
+
+	// EnvISCSICHAPUsername is the name of the environment variable used to
+	// specify the CHAP username used when logging into iSCSI targets
+	EnvISCSICHAPUsername = "X_CSI_POWERMAX_ISCSI_CHAP_USERNAME"
+
+	// EnvISCSICHAPPassword is the name of the environment variable used to
+	// specify the CHAP secret used when logging into iSCSI targets
+	EnvISCSICHAPPassword = "X_CSI_POWERMAX_ISCSI_CHAP_PASSWORD"
+
+	// EnvISCSIDiscoveryCHAPUsername is the name of the environment variable used to
+	// specify the CHAP username used for iSCSI SendTargets discovery
+	EnvISCSIDiscoveryCHAPUsername = "X_CSI_POWERMAX_ISCSI_DISCOVERY_CHAP_USERNAME"
+
+	// EnvISCSIDiscoveryCHAPPassword is the name of the environment variable used to
+	// specify the CHAP secret used for iSCSI SendTargets discovery
+	EnvISCSIDiscoveryCHAPPassword = "X_CSI_POWERMAX_ISCSI_DISCOVERY_CHAP_PASSWORD"
+
+	// EnvISCSISessionCheckInterval is the name of the environment variable used to
+	// specify how often the node checks its iSCSI sessions and logs back into any
+	// lost portals, e.g. "2m". A value of "0" disables the check.
+	EnvISCSISessionCheckInterval = "X_CSI_POWERMAX_ISCSI_SESSION_CHECK_INTERVAL"
+
+	// EnvMetricsAddress is the name of the environment variable used to specify
+	// the address, e.g. ":9090", on which the driver metrics are served at /debug/vars
+	EnvMetricsAddress = "X_CSI_POWERMAX_METRICS_ADDRESS"
+
+	// EnvStaleDeviceCheckInterval is the name of the environment variable used to
+	// specify how often the node removes the PowerMax devices of the driver which
+	// the array no longer maps to the node, e.g. "10m". A value of "0" disables the removal.
+	EnvStaleDeviceCheckInterval = "X_CSI_POWERMAX_STALE_DEVICE_CHECK_INTERVAL"
+
+	// EnvClusterFsTypes is the name of the environment variable used to specify
+	// the comma separated cluster filesystems, e.g. "gfs2,ocfs2", which volumes of
+	// StorageClasses with AllowMultiWriterMount may be mounted MULTI_NODE_MULTI_WRITER with
+	EnvClusterFsTypes = "X_CSI_POWERMAX_CLUSTER_FS_TYPES"
+
+	// EnvOrphanAuditInterval is the name of the environment variable used to
+	// specify how often the controller reports the array objects carrying the
+	// cluster prefix which are no longer used, e.g. "1h". A value of "0" disables the audit.
+	EnvOrphanAuditInterval = "X_CSI_POWERMAX_ORPHAN_AUDIT_INTERVAL"
+
+	// EnvKnownVolumesFile is the name of the environment variable used to specify
+	// the path of a file listing the volume handles known to the cluster, one per line,
+	// against which the volumes on the arrays are audited
+	EnvKnownVolumesFile = "X_CSI_POWERMAX_KNOWN_VOLUMES_FILE"
+
+	// EnvOrphanCleanup is the name of the environment variable used to specify
+	// if the orphan audit removes empty storage groups and the masking views of
+	// hosts with no initiators
+	EnvOrphanCleanup = "X_CSI_POWERMAX_ORPHAN_CLEANUP"
+
+	// EnvInitiatorConflictPolicy is the name of the environment variable used to
+	// specify what the node does when one of its initiators belongs to another host.
+	// Valid values are "fail", "move" and "adopt"
+	EnvInitiatorConflictPolicy = "X_CSI_POWERMAX_INITIATOR_CONFLICT_POLICY"
 )
@@ -0,0 +1,58 @@
+Feature: PowerMax CSI interface
+    As an administrator of the driver
+    I want to adopt existing devices as static volumes
+    So that they can be managed by the driver
+
+@v1.3.0
+    Scenario: Adopt a legacy device and rename it
+        Given a PowerMax service
+        And I call Probe
+        And a legacy device "0A001" named "legacy_db" in storage group "legacy-SG"
+        When I adopt the device "0A001" as "pv-legacy-db" with rename "true" and service level "Diamond"
+        Then the error contains "none"
+        And the device "0A001" is named "csi-TST-pv-legacy-db" in storage group "csi-TST-Diamond-SRP_1-SG"
+        And the persistent volume "pv-legacy-db" has a valid volume handle
+@v1.3.0
+    Scenario: Adopt a device which already follows the naming scheme of the driver
+        Given a PowerMax service
+        And I call Probe
+        And a legacy device "0A002" named "csi-TST-restored" in storage group "legacy-SG"
+        When I adopt the device "0A002" as "pv-restored" with rename "false" and service level "Bronze"
+        Then the error contains "none"
+        And the device "0A002" is named "csi-TST-restored" in storage group "csi-TST-Bronze-SRP_1-SG"
+        And the persistent volume "pv-restored" has a valid volume handle
+@v1.3.0
+    Scenario Outline: Rename a device with the identifier CreateVolume gives a volume of the same name
+        Given a PowerMax service
+        And I call Probe
+        And a legacy device "0A005" named "legacy_db" in storage group "legacy-SG"
+        When I adopt the device "0A005" as "<name>" with rename "true" and service level "Diamond"
+        Then the error contains "none"
+        And the device "0A005" is named "<identifier>" in storage group "csi-TST-Diamond-SRP_1-SG"
+
+        Examples:
+        | name                                                   | identifier                                                    |
+        | pv-aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa  | csi-TST-pv-aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa |
+        | pv-aaaaaaaaaaaaaaaaaaaaaaaxbbbbbbbbbbbbbbbbbbbbbbbbbbb | csi-TST-pv-aaaaaaaaaaaaaaaaaaaaaaabbbbbbbbbbbbbbbbbbbbbbbbbbb |
+@v1.3.0
+    Scenario Outline: Refuse to adopt a device
+        Given a PowerMax service
+        And I call Probe
+        And a legacy device "0A003" named "<identifier>" in storage group "legacy-SG"
+        When I adopt the device "<device>" as "pv-legacy" with rename "<rename>" and service level "<level>"
+        Then the error contains "<errormsg>"
+        And the device "0A003" is named "<identifier>" in storage group "legacy-SG"
+
+        Examples:
+        | identifier | device | rename | level    | errormsg                                   |
+        | legacy_db  | 0A003  | false  | Bronze   | rename it with -rename                     |
+        | legacy_db  | 0A003  | true   | Copper   | An invalid Service Level                   |
+        | legacy_db  | 0AFFF  | true   | Bronze   | Could not find device 0AFFF                |
+@v1.3.0
+    Scenario: Refuse to adopt a device which is in a masking view
+        Given a PowerMax service
+        And I call Probe
+        And I have a Node "node1" with MaskingView
+        And a legacy device "0A004" named "legacy_db" in the masking view of the node
+        When I adopt the device "0A004" as "pv-legacy" with rename "true" and service level "Bronze"
+        Then the error contains "it must be unmapped before it is adopted"
@@ -478,3 +478,112 @@ Feature: PowerMax CSI interface
       | "FA-1D:4"        | "FA-1D:5"             | "none"                | "0x5000000000000002" | "none"                                                |
       | ""               | "FA-1D:5"             | "none"                | "0x5000000000000002" | "none"                                                |
 
+
+@v1.3.0
+     Scenario: Select port groups in round robin order
+      Given a PowerMax service
+      And I set port group selection to "round-robin"
+      When I request a PortGroup 3 times
+      Then the selected PortGroups are "portgroup1,portgroup2,portgroup1"
+
+@v1.3.0
+     Scenario: Select the port group with the least masking views
+      Given a PowerMax service
+      And I set port group selection to "least-masking-views"
+      And PortGroup "portgroup1" has 3 masking views
+      And PortGroup "portgroup2" has 1 masking views
+      When I request a PortGroup 2 times
+      Then the selected PortGroups are "portgroup2,portgroup2"
+
+@v1.3.0
+     Scenario: Select port groups with the cached masking view counts
+      Given a PowerMax service
+      And I set port group selection to "least-masking-views"
+      And PortGroup "portgroup1" has 4 masking views
+      And PortGroup "portgroup2" has 1 masking views
+      When I request a PortGroup
+      And PortGroup "portgroup2" has 9 masking views
+      And I request a PortGroup
+      Then the selected PortGroups are "portgroup2,portgroup2"
+      When the port group cache of the array expires
+      And I request a PortGroup
+      Then the selected PortGroups are "portgroup2,portgroup2,portgroup1"
+
+@v1.3.0
+     Scenario: Select the port group whose directors are used by the fewest masking views
+      Given a PowerMax service
+      And I have an iSCSI PortGroup "portgroup3" with ports "SE3-E:1,SE4-E:1"
+      And I set port groups for array "000197900046" to "portgroup1,portgroup2,portgroup3"
+      And I set port group selection to "least-director-masking-views"
+      And PortGroup "portgroup1" has 2 masking views
+      And PortGroup "portgroup3" has 1 masking views
+      When I request a PortGroup
+      Then the selected PortGroups are "portgroup3"
+
+@v1.3.0
+     Scenario: Select port groups configured for an array
+      Given a PowerMax service
+      And I set port groups for array "000197900046" to "portgroup2"
+      When I request a PortGroup 2 times
+      Then the selected PortGroups are "portgroup2,portgroup2"
+
+@v1.3.0
+     Scenario: Select port groups with an invalid strategy
+      Given a PowerMax service
+      And I set port group selection to "bogus"
+      When I request a PortGroup
+      Then a valid PortGroup is returned
+
+@v1.3.0
+     Scenario: Select port groups and transport protocol from the array configuration file
+      Given a PowerMax service
+      And I set transport protocol to "FC"
+      And I have an array configuration file "array_config.yaml"
+      When I request a PortGroup 2 times
+      Then the selected PortGroups are "portgroup2,portgroup2"
+      And the transport protocol for array "000197900046" is "ISCSI"
+      And the transport protocol for array "000000000001" is "FC"
+      And the transport protocol for array "000000000002" is "FC"
+
+@v1.3.0
+     Scenario: Publish volume falls back to the alternate transport protocol
+      Given a PowerMax service
+      And I call CreateVolume "volume1"
+      And a valid CreateVolumeResponse is returned
+      And I set transport protocol to "ISCSI"
+      And I have a Node "node1" with Host
+      And I set transport protocol to "FC"
+      And I have a Node "node1" with Host
+      And I set transport protocol to ""
+      And I induce error "CreatePortGroupError"
+      When I call PublishVolume with "single-writer" to "node1"
+      Then a valid PublishVolumeResponse is returned
+      And the volume is published to "node1" using "ISCSI"
+      And the node cache selects "FC" for "node1"
+
+@v1.3.0
+     Scenario: Publish volume does not fall back when the transport protocol is set
+      Given a PowerMax service
+      And I call CreateVolume "volume1"
+      And a valid CreateVolumeResponse is returned
+      And I set transport protocol to "ISCSI"
+      And I have a Node "node1" with Host
+      And I set transport protocol to "FC"
+      And I have a Node "node1" with Host
+      And I induce error "CreatePortGroupError"
+      When I call PublishVolume with "single-writer" to "node1"
+      Then the error contains "Failed to select/create PG"
+
+@v1.3.0
+     Scenario: Publish volume over NVMe/TCP
+      Given a PowerMax service
+      And I call CreateVolume "volume1"
+      And a valid CreateVolumeResponse is returned
+      And I set transport protocol to "NVMETCP"
+      And I have a Node "node1" with Host
+      And I have an NVMe/TCP port "SE-1E:000" with address "192.168.1.10"
+      When I call PublishVolume with "single-writer" to "node1"
+      Then a valid PublishVolumeResponse is returned
+      And the volume is published to "node1" using "NVMETCP"
+      And the PublishContext "TRANSPORT_PROTOCOL" contains "NVMETCP"
+      And the PublishContext "PORT_IDENTIFIERS" contains "nqn.1988-11.com.dell:powermax:00:000197900046@192.168.1.10"
@@ -0,0 +1,52 @@
+Feature: PowerMax CSI interface
+    As an administrator of the driver
+    I want to remove the array objects of the nodes removed from the cluster
+    So that they do not accumulate on the arrays
+
+@v1.3.0
+    Scenario: Decommission a node with no mapped volumes
+        Given a PowerMax service
+        And I call Probe
+        And I have a Node "node1" with MaskingView
+        When I decommission the node "node1" with force "false"
+        Then the error contains "none"
+        And the decommissioned objects are "csi-mv-TST-node1,csi-no-srp-sg-TST-node1,csi-node-TST-node1"
+        And the storage group and host of the node exist "false"
+@v1.3.0
+    Scenario: Decommission a FC node
+        Given a PowerMax service
+        And I call Probe
+        And I set transport protocol to "FC"
+        And I have a Node "node1" with MaskingView
+        When I decommission the node "node1" with force "false"
+        Then the error contains "none"
+        And the decommissioned objects are "csi-mv-TST-node1-FC,csi-no-srp-sg-TST-node1-FC,csi-node-TST-node1-FC"
+        And the storage group and host of the node exist "false"
+@v1.3.0
+    Scenario: Refuse to decommission a node with mapped volumes
+        Given a PowerMax service
+        And I call Probe
+        And I have a Node "node1" with MaskingView
+        And a legacy device "0A020" named "csi-TST-data" in the masking view of the node
+        When I decommission the node "node1" with force "false"
+        Then the error contains "1 volumes are still mapped to node node1"
+        And the decommissioned objects are ""
+        And the storage group and host of the node exist "true"
+@v1.3.0
+    Scenario: Force the decommission of a node with mapped volumes
+        Given a PowerMax service
+        And I call Probe
+        And I have a Node "node1" with MaskingView
+        And a legacy device "0A020" named "csi-TST-data" in the masking view of the node
+        When I decommission the node "node1" with force "true"
+        Then the error contains "none"
+        And the decommissioned objects are "csi-mv-TST-node1,csi-no-srp-sg-TST-node1,csi-node-TST-node1"
+        And the storage group and host of the node exist "false"
+        And the device "0A020" is in no storage group
+@v1.3.0
+    Scenario: Decommission a node with no objects on the array
+        Given a PowerMax service
+        And I call Probe
+        When I decommission the node "node9" with force "false"
+        Then the error contains "none"
+        And the decommissioned objects are ""
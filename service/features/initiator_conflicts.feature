@@ -0,0 +1,52 @@
+Feature: PowerMax CSI interface
+    As an administrator of the driver
+    I want the nodes to resolve the conflicts of their initiators with other hosts
+    So that renamed nodes and moved HBAs do not prevent them from being set up
+
+@v1.3.0
+    Scenario Outline: Resolve an initiator conflict with a stale host of the driver
+        Given a PowerMax service
+        And I set the initiator conflict policy to <policy>
+        And I have a Node "old1" with Host
+        When I call verifyInitiatorsNotInADifferentHost for node "node1"
+        Then <nvalid> valid initiators are returned
+        And the error contains <errormsg>
+        And the host "csi-node-TST-old1" exists <exists>
+
+        Examples:
+        | policy  | nvalid | errormsg                                | exists  |
+        | "fail"  | 0      | "is already a part of a different host" | "true"  |
+        | "move"  | 1      | "none"                                  | "false" |
+        | "adopt" | 0      | "is already a part of a different host" | "true"  |
+@v1.3.0
+    Scenario: Do not move an initiator from a host with masking views
+        Given a PowerMax service
+        And I set the initiator conflict policy to "move"
+        And I have a Node "old1" with MaskingView
+        When I call verifyInitiatorsNotInADifferentHost for node "node1"
+        Then 0 valid initiators are returned
+        And the error contains "is already a part of a different host"
+        And the host "csi-node-TST-old1" exists "true"
+@v1.3.0
+    Scenario: Do not move an initiator from a host not created by the driver
+        Given a PowerMax service
+        And I set the initiator conflict policy to "move"
+        And the initiators of the node belong to host "legacy-host"
+        When I call verifyInitiatorsNotInADifferentHost for node "node1"
+        Then 0 valid initiators are returned
+        And the error contains "is already a part of a different host"
+        And the host "legacy-host" exists "true"
+@v1.3.0
+    Scenario Outline: Adopt the host of the initiators
+        Given a PowerMax service
+        And the initiators of the node belong to host <host>
+        When I adopt the hosts of the initiators of node "node1"
+        Then the hosts of the node are named after <nodename>
+        And the node ID is "node1"
+
+        Examples:
+        | host                    | nodename |
+        | "csi-node-TST-old1"     | "old1"   |
+        | "csi-node-TST-node1"    | "node1"  |
+        | "legacy-host"           | "node1"  |
+        | "csi-node-ABC-old1"     | "node1"  |
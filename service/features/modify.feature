@@ -0,0 +1,55 @@
+Feature: PowerMax CSI interface
+    As an administrator of the driver
+    I want to change the service level of volumes
+    So that they can be moved between service levels without data movement
+
+@v1.3.0
+    Scenario: Change the service level of a volume
+        Given a PowerMax service
+        And I call Probe
+        And a legacy device "0A011" named "csi-TST-pvc-1" in storage group "csi-TST-Bronze-SRP_1-SG"
+        When I change the service level of the device "0A011" to "Diamond"
+        Then the error contains "none"
+        And the device "0A011" is named "csi-TST-pvc-1" in storage group "csi-TST-Diamond-SRP_1-SG"
+        And the device "0A011" is in storage group "csi-TST-Diamond-SRP_1-SG" with service level "Diamond"
+@v1.3.0
+    Scenario: Change the service level of a volume with an application prefix
+        Given a PowerMax service
+        And I call Probe
+        And a legacy device "0A012" named "csi-TST-pvc-2" in storage group "csi-TST-APP-Bronze-SRP_1-SG"
+        When I change the service level of the device "0A012" to "Gold"
+        Then the error contains "none"
+        And the device "0A012" is in storage group "csi-TST-APP-Gold-SRP_1-SG" with service level "Gold"
+@v1.3.0
+    Scenario: Change the service level of a published volume
+        Given a PowerMax service
+        And I call Probe
+        And I have a Node "node1" with MaskingView
+        And a legacy device "0A013" named "csi-TST-pvc-3" in storage group "csi-TST-Bronze-SRP_1-SG"
+        And the device "0A013" is published to the node
+        When I change the service level of the device "0A013" to "Silver"
+        Then the error contains "none"
+        And the device "0A013" is in storage group "csi-TST-Silver-SRP_1-SG" with service level "Silver"
+        And the device "0A013" is still published to the node
+@v1.3.0
+    Scenario: Keep a volume which already has the service level
+        Given a PowerMax service
+        And I call Probe
+        And a legacy device "0A014" named "csi-TST-pvc-4" in storage group "csi-TST-Bronze-SRP_1-SG"
+        When I change the service level of the device "0A014" to "Bronze"
+        Then the error contains "none"
+        And the device "0A014" is in storage group "csi-TST-Bronze-SRP_1-SG" with service level "Bronze"
+@v1.3.0
+    Scenario Outline: Refuse to change the service level of a volume
+        Given a PowerMax service
+        And I call Probe
+        And a legacy device "0A015" named "csi-TST-pvc-5" in storage group "<sg>"
+        When I change the service level of the device "<device>" to "<level>"
+        Then the error contains "<errormsg>"
+        And the device "0A015" is named "csi-TST-pvc-5" in storage group "<sg>"
+
+        Examples:
+        | sg                      | device | level   | errormsg                             |
+        | csi-TST-Bronze-SRP_1-SG | 0A015  | Copper  | An invalid Service Level             |
+        | legacy-SG               | 0A015  | Diamond | which was not created by the driver  |
+        | csi-TST-Bronze-SRP_1-SG | 0AFFF  | Diamond | Volume not found                     |
@@ -191,7 +191,7 @@ Feature: PowerMax CSI interface
     | "mount"      | "multiple-reader"              | "ext4"     | "Invalid access mode"                        |
     | "mount"      | "single-writer"                | "ext4"     | "access mode conflicts with existing mounts" |
     | "mount"      | "multiple-writer"              | "ext4"     | "Mount volumes do not support AccessMode"    |
-    | "block"      | "multiple-reader"              | "none"     | "read only not supported for Block Volume"   |
+    | "block"      | "multiple-reader"              | "none"     | "none"                                       |
 
 
 @nodePublish
@@ -215,6 +215,37 @@ Feature: PowerMax CSI interface
     | "block"      | "multiple-writer"              | "none"     | "none"                                       |
     | "mount"      | "single-writer"                | "xfs"      | "none"                                       |
 
+@nodePublish
+@v1.3.0
+  Scenario: Node Unstage with the transport protocol the volume was staged with
+    Given a PowerMax service
+    And I set transport protocol to "FC"
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "block" access "single-writer" fstype "none"
+    And get Node Publish Volume Request
+    And I call NodeStageVolume
+    And I set transport protocol to "ISCSI"
+    When I call NodeUnstageVolume
+    Then the error contains "none"
+    And the volume is disconnected using "FC"
+
+@nodePublish
+@v1.3.0
+  Scenario: Node Unstage with the transport protocol of the array if the volume was staged by an earlier driver
+    Given a PowerMax service
+    And I set transport protocol to "FC"
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "block" access "single-writer" fstype "none"
+    And get Node Publish Volume Request
+    And I call NodeStageVolume
+    And I set transport protocol to "ISCSI"
+    And the transport protocol of the staged volume is not recorded
+    When I call NodeUnstageVolume
+    Then the error contains "none"
+    And the volume is disconnected using "ISCSI"
+
 @nodePublish
 @v1.1.0
   Scenario Outline: Node Unstage with various induced errors
@@ -392,3 +423,392 @@ Feature: PowerMax CSI interface
     |"host1"        | "host2"                  | 0               | "none"                                   | "is already a part of a different host"             |
     |"host1"        | "host1"                  | 1               | "none"                                   | "none"                                              |
     |"host1"        | "host1"                  | 0               | "GetInitiatorByIDError"                  | "none"                                              |
+
+@nodePublish
+@v1.3.0
+  Scenario Outline: Node stage, publish and unstage over NVMe
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype <voltype> access "single-writer" fstype <fstype>
+    And get Node Publish Volume Request
+    And the Node Publish Volume Request uses <transport>
+    And I call NodeStageVolume
+    And the NVMe volume is connected "true"
+    And I call NodePublishVolume
+    And I call NodeUnpublishVolume
+    And I call NodeUnstageVolume
+    Then the error contains "none"
+    And the NVMe volume is connected "false"
+
+    Examples:
+    | transport  | voltype | fstype |
+    | "NVMETCP"  | "block" | "none" |
+    | "NVMEFC"   | "block" | "none" |
+    | "NVMETCP"  | "mount" | "xfs"  |
+
+@nodePublish
+@v1.3.0
+  Scenario: Node stage over iSCSI with CHAP
+    Given a PowerMax service
+    And I set transport protocol to "ISCSI"
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "block" access "single-writer" fstype "none"
+    And get Node Publish Volume Request
+    And I set iSCSI CHAP credentials "chapuser" "chapsecret"
+    When I call NodeStageVolume
+    Then the error contains "none"
+    And CHAP is set on 1 iSCSI targets
+
+@nodePublish
+@v1.3.0
+  Scenario: Remove a device which is no longer mapped to the node
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And the volume device is mapped to the node
+    And the volume device is left on the node
+    When I check for stale devices
+    Then 0 stale devices are removed
+    And the volume device is unmapped from the node
+    When I check for stale devices
+    Then 0 stale devices are removed
+    And the volume device link exists "true"
+    When I check for stale devices
+    Then 1 stale devices are removed
+    And the volume device link exists "false"
+    And the volume device is recorded as a device of the driver "false"
+
+@nodePublish
+@v1.3.0
+  Scenario: Remove a device of the driver left on the node before the node plugin restarted
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And the volume device is mapped to the node
+    And the volume device is left on the node
+    When I check for stale devices
+    Then the volume device is recorded as a device of the driver "true"
+    And the node plugin restarts
+    And the volume device is unmapped from the node
+    When I check for stale devices
+    And I check for stale devices
+    Then 1 stale devices are removed
+    And the volume device link exists "false"
+
+@nodePublish
+@v1.3.0
+  Scenario: Keep a device which is still mapped to the node
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And the volume device is mapped to the node
+    And the volume device is left on the node
+    When I check for stale devices
+    And I check for stale devices
+    Then 0 stale devices are removed
+    And the volume device link exists "true"
+
+@nodePublish
+@v1.3.0
+  Scenario: Keep a device which was not used by the driver
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And the volume device is left on the node
+    When I check for stale devices
+    And I check for stale devices
+    Then 0 stale devices are removed
+    And the volume device link exists "true"
+
+@nodePublish
+@v1.3.0
+  Scenario: Keep a device which has a holder
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And the volume device is mapped to the node
+    And the volume device is left on the node
+    And the volume device has a holder
+    When I check for stale devices
+    And the volume device is unmapped from the node
+    And I check for stale devices
+    And I check for stale devices
+    Then 0 stale devices are removed
+    And the volume device link exists "true"
+
+@nodePublish
+@v1.3.0
+  Scenario: Keep a device which is staged
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "mount" access "single-writer" fstype "xfs"
+    And get Node Publish Volume Request
+    And I call NodeStageVolume
+    When I check for stale devices
+    And I check for stale devices
+    Then 0 stale devices are removed
+    And the volume device link exists "true"
+
+@nodePublish
+@v1.3.0
+  Scenario: Keep a device which is mounted
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And the volume device is left on the node
+    And the volume device is mounted
+    When I check for stale devices
+    And I check for stale devices
+    Then 0 stale devices are removed
+    And the volume device link exists "true"
+
+@nodePublish
+@v1.3.0
+  Scenario Outline: Reconnect staged volumes after a node reboot
+    Given a PowerMax service
+    And I set transport protocol to <transport>
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "mount" access "single-writer" fstype "xfs"
+    And get Node Publish Volume Request
+    And I call NodeStageVolume
+    And the node is rebooted
+    When I reconcile the staged volumes
+    Then the volume device is connected "true"
+    And the WWN file of the volume exists "true"
+    And I call NodePublishVolume
+    And the error contains "none"
+
+    Examples:
+    | transport |
+    | "FC"      |
+    | "ISCSI"   |
+
+@nodePublish
+@v1.3.0
+  Scenario: Remove the staged volume record of a deleted volume after a node reboot
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "mount" access "single-writer" fstype "xfs"
+    And get Node Publish Volume Request
+    And I call NodeStageVolume
+    And the node is rebooted
+    And the volume is deleted from the array
+    When I reconcile the staged volumes
+    Then the volume device is connected "false"
+    And the WWN file of the volume exists "false"
+
+@nodePublish
+@v1.3.0
+  Scenario: Keep the staged volume record of a volume which is no longer published
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "mount" access "single-writer" fstype "xfs"
+    And get Node Publish Volume Request
+    And I call NodeStageVolume
+    And the node is rebooted
+    And I induce error "GetMaskingViewConnectionsError"
+    When I reconcile the staged volumes
+    Then the volume device is connected "false"
+    And the WWN file of the volume exists "true"
+
+@nodePublish
+@v1.3.0
+  Scenario Outline: Node publish with mkfs options
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "mount" access "single-writer" fstype <fstype>
+    And get Node Publish Volume Request
+    And the Node Publish Volume Request has MkfsOptions <options>
+    And I call NodeStageVolume
+    When I call NodePublishVolume
+    Then the error contains <errormsg>
+    And mkfs is run <count> times
+    And mkfs is run with <command>
+
+    Examples:
+    | fstype  | options        | errormsg | count | command                        |
+    | "xfs"   | "-m reflink=1" | "none"   | 1     | "mkfs.xfs -K -m reflink=1"     |
+    | "ext4"  | "-i 65536"     | "none"   | 1     | "mkfs.ext4 -F -E nodiscard -i" |
+    | "btrfs" | "-L data"      | "none"   | 1     | "mkfs.btrfs -K -L data"        |
+
+@nodePublish
+@v1.3.0
+  Scenario Outline: Node publish multi-writer mount volume of a cluster filesystem to two targets
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "mount" access "multiple-writer" fstype <fstype>
+    And get Node Publish Volume Request
+    And the Node Publish Volume Request allows multi-writer mounts <allow>
+    And the volume device is formatted with <format>
+    And I call NodePublishVolume
+    And I change the target path
+    And I call NodePublishVolume
+    Then the error contains <errormsg>
+
+    Examples:
+    | fstype  | allow   | format  | errormsg                                         |
+    | "gfs2"  | "true"  | "gfs2"  | "none"                                           |
+    | "ocfs2" | "true"  | "ocfs2" | "none"                                           |
+    | "gfs2"  | "false" | "gfs2"  | "Mount volumes do not support AccessMode"        |
+    | "ext4"  | "true"  | "ext4"  | "Mount volumes do not support AccessMode"        |
+    | "gfs2"  | "true"  | "none"  | "must be created before the volume is published" |
+
+@nodePublish
+@v1.3.0
+  Scenario: Node publish read only target of a multi-writer mount volume of a cluster filesystem
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "mount" access "multiple-writer" fstype "gfs2"
+    And get Node Publish Volume Request
+    And the Node Publish Volume Request allows multi-writer mounts "true"
+    And the volume device is formatted with "gfs2"
+    And I call NodePublishVolume
+    And I mark request read only
+    And I change the target path
+    And I call NodePublishVolume
+    Then the error contains "none"
+
+@nodePublish
+@v1.3.0
+  Scenario Outline: Node publish mount volume already mounted outside of the driver
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "mount" access <access> fstype <fstype>
+    And get Node Publish Volume Request
+    And the Node Publish Volume Request allows multi-writer mounts "true"
+    And the volume device is formatted with <fstype>
+    And device "test/dev/disk/by-id/wwn-0x60000970000197900046533030300501" is mounted outside of the driver
+    When I call NodePublishVolume
+    Then the error contains <errormsg>
+
+    Examples:
+    | access            | fstype | errormsg                                      |
+    | "multiple-writer" | "gfs2" | "none"                                        |
+    | "single-writer"   | "ext4" | "device already in use and mounted elsewhere" |
+
+@nodePublish
+@v1.3.0
+  Scenario Outline: Node unpublish a cluster filesystem volume also mounted outside of the driver
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "mount" access <access> fstype "gfs2"
+    And get Node Publish Volume Request
+    And the Node Publish Volume Request allows multi-writer mounts <allow>
+    And the volume device is formatted with "gfs2"
+    And I call NodePublishVolume
+    And device "test/dev/sdc" is mounted outside of the driver
+    When I call NodeUnpublishVolume
+    Then the error contains "none"
+    And the private mount of the volume remains <remains>
+
+    Examples:
+    | access            | allow   | remains |
+    | "multiple-writer" | "true"  | "false" |
+    | "single-writer"   | "false" | "true"  |
+
+@nodePublish
+@v1.3.0
+  Scenario Outline: UnmountPrivMount of a device also mounted outside of the driver
+    Given a PowerMax service
+    And a private mount "test/mnt1"
+    And device "test/dev/sda" is mounted outside of the driver
+    And the volume device is formatted with <fstype>
+    When I call unmountPrivMount
+    Then the error contains "none"
+    And lastUnmounted should be <lastUnmounted>
+
+    Examples:
+    | fstype  | lastUnmounted |
+    | "gfs2"  | "true"        |
+    | "ocfs2" | "true"        |
+    | "ext4"  | "false"       |
+
+@nodePublish
+@v1.3.0
+  Scenario Outline: Node publish read only block volume
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "block" access <access> fstype "none"
+    And get Node Publish Volume Request
+    And I set the request read only <readonly>
+    When I call NodePublishVolume
+    Then the error contains "none"
+    And the target is mounted read only <ro>
+    And the volume device is read only <ro>
+
+    Examples:
+    | access            | readonly | ro      |
+    | "single-writer"   | "true"   | "true"  |
+    | "single-reader"   | "false"  | "true"  |
+    | "multiple-reader" | "false"  | "true"  |
+    | "multiple-writer" | "true"   | "true"  |
+    | "single-writer"   | "false"  | "false" |
+    | "multiple-writer" | "false"  | "false" |
+
+@nodePublish
+@v1.3.0
+  Scenario Outline: Node publish block volume to a second target with a different read only setting
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "block" access "multiple-writer" fstype "none"
+    And get Node Publish Volume Request
+    And I set the request read only <first>
+    And I call NodePublishVolume
+    And I change the target path
+    And I set the request read only <second>
+    When I call NodePublishVolume
+    Then the error contains <errormsg>
+    And the volume device is read only <first>
+
+    Examples:
+    | first   | second  | errormsg                                                |
+    | "true"  | "true"  | "none"                                                  |
+    | "true"  | "false" | "Access mode conflicts with existing read only mounts"  |
+    | "false" | "true"  | "Access mode conflicts with existing read write mounts" |
+    | "false" | "false" | "none"                                                  |
+
+@nodePublish
+@v1.3.0
+  Scenario Outline: Node publish block volume again to the same target with a different read only setting
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "block" access "multiple-writer" fstype "none"
+    And get Node Publish Volume Request
+    And I set the request read only <first>
+    And I call NodePublishVolume
+    And I set the request read only <second>
+    When I call NodePublishVolume
+    Then the error contains <errormsg>
+
+    Examples:
+    | first   | second  | errormsg                                                   |
+    | "true"  | "true"  | "none"                                                     |
+    | "true"  | "false" | "volume previously published with different mount options" |
+    | "false" | "true"  | "volume previously published with different mount options" |
+
+@nodePublish
+@v1.3.0
+  Scenario: Node publish read write block volume left read only
+    Given a PowerMax service
+    And I have a Node "node1" with MaskingView
+    And a controller published volume
+    And a capability with voltype "block" access "single-writer" fstype "none"
+    And get Node Publish Volume Request
+    And the volume device is set read only
+    When I call NodePublishVolume
+    Then the error contains "none"
+    And the volume device is read only "false"
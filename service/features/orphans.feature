@@ -0,0 +1,82 @@
+Feature: PowerMax CSI interface
+    As an administrator of the driver
+    I want to find the array objects created by the driver which are no longer used
+    So that they can be removed
+
+@v1.3.0
+    Scenario: Report orphan objects without removing them
+        Given a PowerMax service
+        And I call Probe
+        And I have a Node "node1" with MaskingView
+        And a legacy device "0A010" named "csi-TST-lost" in storage group "csi-TST-Bronze-SRP_1-SG"
+        And a legacy device "0A011" named "csi-TST-kept" in storage group "csi-TST-Bronze-SRP_1-SG"
+        And an empty storage group "csi-no-srp-sg-TST-node2"
+        And I have an iSCSI PortGroup "csi-TST-SE3-E-1PG" with ports "SE3-E:1"
+        When I audit the orphans with known devices "0A011" and cleanup "false"
+        Then the error contains "none"
+        And the orphan volumes are "0A010"
+        And the orphan storage groups are "csi-no-srp-sg-TST-node2"
+        And the orphan masking views are ""
+        And the orphan port groups are "csi-TST-SE3-E-1PG"
+        And the orphan removed objects are ""
+@v1.3.0
+    Scenario: Volumes are not audited without known volume handles
+        Given a PowerMax service
+        And I call Probe
+        And a legacy device "0A010" named "csi-TST-lost" in storage group "csi-TST-Bronze-SRP_1-SG"
+        When I audit the orphans with known devices "none" and cleanup "false"
+        Then the error contains "none"
+        And the orphan volumes are ""
+@v1.3.0
+    Scenario: Remove the masking view of a decommissioned node
+        Given a PowerMax service
+        And I call Probe
+        And I have a Node "node1" with MaskingView
+        And the host of the node has no initiators
+        And an empty storage group "csi-no-srp-sg-TST-node2"
+        When I audit the orphans with known devices "none" and cleanup "true"
+        Then the error contains "none"
+        And the orphan masking views are "csi-mv-TST-node1"
+        And the orphan storage groups are "csi-no-srp-sg-TST-node1,csi-no-srp-sg-TST-node2"
+        And the orphan hosts are "csi-node-TST-node1"
+        And the orphan removed objects are "csi-mv-TST-node1"
+@v1.3.0
+    Scenario: Remove a storage group which was empty at two consecutive audits
+        Given a PowerMax service
+        And I call Probe
+        And an empty storage group "csi-no-srp-sg-TST-node2"
+        When I audit the orphans with known devices "none" and cleanup "true"
+        Then the error contains "none"
+        And the orphan storage groups are "csi-no-srp-sg-TST-node2"
+        And the orphan removed objects are ""
+        When I audit the orphans with known devices "none" and cleanup "true"
+        Then the error contains "none"
+        And the orphan storage groups are "csi-no-srp-sg-TST-node2"
+        And the orphan removed objects are "csi-no-srp-sg-TST-node2"
+@v1.3.0
+    Scenario: Keep a storage group which was empty at one audit only
+        Given a PowerMax service
+        And I call Probe
+        And an empty storage group "csi-TST-Bronze-SRP_1-SG"
+        When I audit the orphans with known devices "none" and cleanup "true"
+        Then the error contains "none"
+        And the orphan storage groups are "csi-TST-Bronze-SRP_1-SG"
+        And the orphan removed objects are ""
+        When a legacy device "0A010" named "csi-TST-new" in storage group "csi-TST-Bronze-SRP_1-SG"
+        And I audit the orphans with known devices "none" and cleanup "true"
+        Then the error contains "none"
+        And the orphan storage groups are ""
+        And the orphan removed objects are ""
+        And the device "0A010" is named "csi-TST-new" in storage group "csi-TST-Bronze-SRP_1-SG"
+@v1.3.0
+    Scenario: Keep the masking view of a decommissioned node without cleanup
+        Given a PowerMax service
+        And I call Probe
+        And I have a Node "node1" with MaskingView
+        And the host of the node has no initiators
+        When I audit the orphans with known devices "none" and cleanup "false"
+        Then the error contains "none"
+        And the orphan masking views are "csi-mv-TST-node1"
+        And the orphan storage groups are ""
+        And the orphan hosts are ""
+        And the orphan removed objects are ""
@@ -199,6 +199,70 @@ Feature: PowerMax CSI interface
       And I call CreateVolume "volume1" 
       Then a valid CreateVolumeResponse is returned
 
+@v1.3.0
+     Scenario Outline: Create volume with a filesystem check
+      Given a PowerMax service
+      And I specify FsCheck <fscheck>
+      And I call CreateVolume "volume1"
+      Then the error contains <errormsg>
+      And the VolumeContext "FsCheck" is <context>
+
+      Examples:
+      | fscheck  | errormsg | context  |
+      | "check"  | "none"   | "check"  |
+      | "repair" | "none"   | "repair" |
+
+@v1.3.0
+     Scenario: Create volume with an invalid filesystem check
+      Given a PowerMax service
+      And I specify FsCheck "fix"
+      And I call CreateVolume "volume1"
+      Then the error contains "An invalid FsCheck parameter was specified"
+
+@v1.3.0
+     Scenario Outline: Create volume with mkfs options
+      Given a PowerMax service
+      And I specify MkfsOptions <options> for fstype <fstype>
+      And I call CreateVolume "volume1"
+      Then the error contains <errormsg>
+
+      Examples:
+      | options          | fstype  | errormsg                                      |
+      | "-m reflink=1"   | "xfs"   | "none"                                        |
+      | "-i 65536"       | ""      | "none"                                        |
+      | "-L data"        | "btrfs" | "none"                                        |
+      | "-m reflink=1"   | "vfat"  | "MkfsOptions are not supported for filesystem" |
+      | "reflink=1"      | "xfs"   | "it must start with an option"                |
+      | "-L $(reboot)"   | "xfs"   | "contains invalid characters"                 |
+      | "-p /etc/shadow" | "xfs"   | "contains invalid characters"                 |
+
+@v1.3.0
+     Scenario Outline: Create multi-writer mount volume of a cluster filesystem
+      Given a PowerMax service
+      And I specify AllowMultiWriterMount <allow> for fstype <fstype>
+      And I call CreateVolume "volume1"
+      Then a valid CreateVolumeResponse is returned
+      And the VolumeContext "AllowMultiWriterMount" is <allow>
+
+      Examples:
+      | allow   | fstype  |
+      | "true"  | "gfs2"  |
+      | "true"  | "ocfs2" |
+      | "false" | "gfs2"  |
+
+@v1.3.0
+     Scenario Outline: Create multi-writer mount volume with an invalid cluster filesystem
+      Given a PowerMax service
+      And I specify AllowMultiWriterMount <allow> for fstype <fstype>
+      And I call CreateVolume "volume1"
+      Then the error contains <errormsg>
+
+      Examples:
+      | allow   | fstype  | errormsg                                     |
+      | "true"  | "ext4"  | "require a cluster filesystem"               |
+      | "true"  | ""      | "require a cluster filesystem"               |
+      | "yes"   | "gfs2"  | "An invalid AllowMultiWriterMount parameter" |
+
 
 @v1.0.0
      Scenario: Create volume with storage group
@@ -394,7 +458,18 @@ Feature: PowerMax CSI interface
       Given a PowerMax service
       When I call BeforeServe
       # On windows there are no initiators, but on Linux there are iscsi in /etc/iscsi/initiatorname.iscsi
-      Then the error contains "No FC or iSCSI initiators were found@@none"
+      Then the error contains "No FC, iSCSI or NVMe initiators were found@@none"
+
+@v1.3.0
+     Scenario Outline: Test BeforeServe with invalid CHAP credentials
+      Given a PowerMax service
+      When I call BeforeServe with CHAP username <username> and password <password>
+      Then the error contains "both a CHAP username and password must be specified"
+
+      Examples:
+      | username   | password     |
+      | "chapuser" | ""           |
+      | ""         | "chapsecret" |
 
 @v1.0.0
      Scenario: Test BeforeServe
@@ -497,6 +572,64 @@ Feature: PowerMax CSI interface
       | "FC"          | "GetInitiatorError"  | "Error retrieving Initiator(s)"  | "node"            |
       | "FC"          | "none"               | "none"                           | "node"            |
 
+@v1.3.0
+    Scenario Outline: Validate nodeHostSetup with a transport protocol preference
+      Given a PowerMax service
+      And I set transport protocol to "ISCSI"
+      And I have a Node "Node1" with Host
+      And I set transport protocol to "FC"
+      And I have a Node "Node1" with Host
+      And I set transport protocol to ""
+      And I set transport protocol preference to <preference>
+      When I invoke nodeHostSetup with a "node" service
+      Then the error contains "none"
+      And the node uses <transport> for array "000197900046"
+
+      Examples:
+      | preference    | transport |
+      | ""            | "FC"      |
+      | "ISCSI,FC"    | "ISCSI"   |
+      | "fibre"       | "FC"      |
+
+@v1.3.0
+    Scenario: Validate nodeHostSetup with NVMe/TCP preferred
+      Given a PowerMax service
+      And I set transport protocol to "ISCSI"
+      And I have a Node "Node1" with Host
+      And I set transport protocol to "NVMETCP"
+      And I have a Node "Node1" with Host
+      And I set transport protocol to ""
+      And I set transport protocol preference to "NVMETCP,ISCSI"
+      When I invoke nodeHostSetup with a "node" service
+      Then the error contains "none"
+      And the node uses "NVMETCP" for array "000197900046"
+
+@v1.3.0
+    Scenario: Validate nodeHostSetup sets up the host of the fallback transport protocol
+      Given a PowerMax service
+      And I set transport protocol to "FC"
+      And I have a Node "Node1" with Host
+      And I set transport protocol to ""
+      And I set transport protocol preference to "FC,ISCSI"
+      And the iSCSI initiator of the node is on the array
+      And the host "csi-node-TST-Node1" exists "false"
+      When I invoke nodeHostSetup with a "node" service
+      Then the error contains "none"
+      And the node uses "FC" for array "000197900046"
+      And the host "csi-node-TST-Node1" exists "true"
+
+@v1.3.0
+    Scenario: Validate nodeHostSetup does not set up other hosts without a transport protocol preference
+      Given a PowerMax service
+      And I set transport protocol to "FC"
+      And I have a Node "Node1" with Host
+      And I set transport protocol to ""
+      And the iSCSI initiator of the node is on the array
+      When I invoke nodeHostSetup with a "node" service
+      Then the error contains "none"
+      And the node uses "FC" for array "000197900046"
+      And the host "csi-node-TST-Node1" exists "false"
+
 @v1.0.0
     Scenario: Validate nodeHostSetup with temporary failure
       Given a PowerMax service
@@ -521,6 +654,60 @@ Feature: PowerMax CSI interface
       | "GOISCSIDiscoveryError"| "Unable to perform iSCSI discovery and login"    | 0     |
       | "none"                 | "none"                                           | 3     |
 
+@v1.3.0
+    Scenario: Validate ensureLoggedIntoEveryArray with CHAP
+      Given a PowerMax service
+      And there are no arrays logged in
+      And I set iSCSI CHAP credentials "chapuser" "chapsecret"
+      When I invoke ensureLoggedIntoEveryArray
+      Then the error contains "none"
+      And 3 arrays are logged in
+      And CHAP is set on 1 iSCSI targets
+
+@v1.3.0
+    Scenario Outline: Check iSCSI sessions and log back into lost portals
+      Given a PowerMax service
+      And I set transport protocol to "ISCSI"
+      And I have a Node "Node1" with <host>
+      And the node has iSCSI sessions to portals <portals>
+      When I check the iSCSI sessions
+      Then <logins> iSCSI logins are performed
+      And the node reports 1 iSCSI sessions to array "000197900046"
+
+      Examples:
+      | host          | portals                  | logins |
+      | MaskingView   | "10.247.73.130"          | 0      |
+      | MaskingView   | "10.0.0.1"               | 1      |
+      | Host          | "10.247.73.130,10.0.0.1" | 0      |
+      | Host          | ""                       | 1      |
+
+@v1.3.0
+    Scenario Outline: Start the iSCSI session monitor when an array is set up for iSCSI
+      Given a PowerMax service
+      And I set transport protocol to <transport>
+      And I have a Node "Node1" with MaskingView
+      And I set the iSCSI session check interval to "1h"
+      When I invoke nodeHostSetup with a "node" service
+      Then the error contains "none"
+      And the iSCSI session monitor is started <started>
+
+      Examples:
+      | transport | started |
+      | "ISCSI"   | "true"  |
+      | "FC"      | "false" |
+
+@v1.3.0
+    Scenario: Serve the iSCSI session counts as metrics
+      Given a PowerMax service
+      And I set transport protocol to "ISCSI"
+      And I have a Node "Node1" with MaskingView
+      And the node has iSCSI sessions to portals "10.247.73.130"
+      When I check the iSCSI sessions
+      Then the iSCSI session metrics report 1 sessions to array "000197900046"
+      When the node no longer uses iSCSI with array "000197900046"
+      And I check the iSCSI sessions
+      Then the iSCSI session metrics report no sessions to array "000197900046"
+
 @v1.0.0
     Scenario Outline: Validate Array Whitelists
       Given a PowerMax service
@@ -38,6 +38,90 @@ Feature: PowerMax CSI Interface
         When I call CreateSnapshot "snapshot1" on "volume1"
         And I call CreateSnapshot "snapshot1" on "volume1"
         Then a valid CreateSnapshotResponse is returned
+@v1.3.0
+    Scenario: Idempotent CreateSnapshot reports the creation time of the array and converges to ready
+        Given a PowerMax service
+        And I call Probe
+        And I call CreateVolume "volume1"
+        And a valid CreateVolumeResponse is returned
+        And I call CreateSnapshot "snapshot1" on "volume1"
+        And a valid CreateSnapshotResponse is returned
+        And the snapshot "snapshot1" has state "EstablishInProg" and timestamp "Sun Jun  7 10:08:58 2020"
+        When I call CreateSnapshot "snapshot1" on "volume1"
+        Then a valid CreateSnapshotResponse is returned
+        And the snapshot is ready to use "false" with creation time "2020-06-07T10:08:58Z"
+        When the snapshot "snapshot1" has state "Established" and timestamp "Sun Jun  7 10:08:58 2020"
+        And I call CreateSnapshot "snapshot1" on "volume1"
+        Then a valid CreateSnapshotResponse is returned
+        And the snapshot is ready to use "true" with creation time "2020-06-07T10:08:58Z"
+@v1.3.0
+    Scenario Outline: Create a snapshot with a time to live
+        Given a PowerMax service
+        And I call Probe
+        And I call CreateVolume "volume1"
+        And a valid CreateVolumeResponse is returned
+        When I call CreateSnapshot "snapshot1" on "volume1" with parameter "TTL" "<ttl>"
+        Then the error contains "<errormsg>"
+
+        Examples:
+        | ttl  | errormsg                                   |
+        | 12h  | none                                       |
+        | 7d   | none                                       |
+        | 3w   | An invalid TTL parameter was specified: 3w |
+        | 0d   | it must be greater than zero               |
+        | 401d | it must not exceed 400 days                |
+@v1.3.0
+    Scenario: Create a snapshot with an invalid maximum number of snapshots per volume
+        Given a PowerMax service
+        And I call Probe
+        And I call CreateVolume "volume1"
+        And a valid CreateVolumeResponse is returned
+        When I call CreateSnapshot "snapshot1" on "volume1" with parameter "MaxSnapshotsPerVolume" "zero"
+        Then the error contains "An invalid MaxSnapshotsPerVolume parameter was specified"
+@v1.3.0
+    Scenario: Prune the oldest snapshots of a volume beyond the maximum
+        Given a PowerMax service
+        And I call Probe
+        And I call CreateVolume "volume1"
+        And a valid CreateVolumeResponse is returned
+        And I call CreateSnapshot "snapshot1" on "volume1"
+        And the snapshot "snapshot1" has state "Established" and timestamp "Sun Jun  7 10:08:58 2020"
+        And I call CreateSnapshot "snapshot2" on "volume1"
+        And the snapshot "snapshot2" has state "Established" and timestamp "Mon Jun  8 10:08:58 2020"
+        When I call CreateSnapshot "snapshot3" on "volume1" with parameter "MaxSnapshotsPerVolume" "2"
+        Then a valid CreateSnapshotResponse is returned
+        And the snapshot "snapshot1" exists on the array "false"
+@v1.3.0
+    Scenario Outline: Choose the oldest snapshots of a volume to prune
+        Given a PowerMax service
+        And I call Probe
+        And I call CreateVolume "volume1"
+        And a valid CreateVolumeResponse is returned
+        And I call CreateSnapshot "snapshot1" on "volume1"
+        And the snapshot "snapshot1" has state "Established" and timestamp "<timestamp1>"
+        And I call CreateSnapshot "snapshot2" on "volume1"
+        And the snapshot "snapshot2" has state "Established" and timestamp "<timestamp2>"
+        And I call CreateSnapshot "snapshot3" on "volume1"
+        When I prune the snapshots of "volume1" keeping <max> except "snapshot3"
+        Then the error contains "none"
+        And the pruned snapshots are "<pruned>"
+
+        Examples:
+        | timestamp1               | timestamp2               | max | pruned    |
+        | Sun Jun  7 10:08:58 2020 | Mon Jun  8 10:08:58 2020 | 2   | snapshot1 |
+        | Tue Jun  9 10:08:58 2020 | Mon Jun  8 10:08:58 2020 | 2   | snapshot2 |
+        | Sun Jun  7 10:08:58 2020 | Mon Jun  8 10:08:58 2020 | 3   |           |
+@v1.3.0
+    Scenario: Expired snapshots are found by the snapshot cleanup
+        Given a PowerMax service
+        And I call Probe
+        And I call CreateVolume "volume1"
+        And a valid CreateVolumeResponse is returned
+        And I call CreateSnapshot "snapshot1" on "volume1"
+        And a valid CreateSnapshotResponse is returned
+        And the snapshot cleanup scan finds "snapshot1" "false"
+        When I induce error "SnapshotExpired"
+        Then the snapshot cleanup scan finds "snapshot1" "true"
 @v1.2.0
     Scenario: Create a snapshot on a volume which is already in a snap session
         Given a PowerMax service
@@ -315,6 +399,18 @@ Feature: PowerMax CSI Interface
         And I induce error "LinkSnapshotError"
         When I call Create Volume from Snapshot
         Then the error contains "Failed to create volume from snapshot"
+@v1.3.0
+    Scenario: Create a volume from a snapshot whose target is not yet defined
+        Given a PowerMax service
+        And I call Probe
+        And I call CreateVolume "volume1"
+        And a valid CreateVolumeResponse is returned
+        And I call CreateSnapshot "snapshot1" on "volume1"
+        And a valid CreateSnapshotResponse is returned
+        And I induce error "TargetNotDefinedError"
+        When I call Create Volume from Snapshot
+        Then a valid CreateVolumeResponse is returned
+        And the clone copy state is "Copying" with progress "0"
 @v1.2.0
     Scenario: Create a volume from another volume
         Given a PowerMax service
@@ -353,6 +449,26 @@ Feature: PowerMax CSI Interface
         And I induce error "LinkSnapshotError"
         When I call Create Volume from Volume
         Then the error contains "Failed to create volume from volume"
+@v1.3.0
+    Scenario: Clone a volume to a different service level
+        Given a PowerMax service
+        And I call Probe
+        And I call CreateVolume "volume1"
+        And a valid CreateVolumeResponse is returned
+        And I clone with service level "Silver"
+        When I call Create Volume from Volume
+        Then a valid CreateVolumeResponse is returned
+        And the clone is in the storage group for service level "Silver"
+        And the temporary snapshot of the clone is queued for cleanup
+@v1.3.0
+    Scenario: Temporary snapshots found by the snapshot cleanup are queued for cleanup at once
+        Given a PowerMax service
+        And I call Probe
+        And I call CreateVolume "volume1"
+        And a valid CreateVolumeResponse is returned
+        When I call Create Volume from Volume
+        Then a valid CreateVolumeResponse is returned
+        And the snapshot cleanup scan queues the temporary snapshot of the clone for cleanup at once
 @v1.2.0
     Scenario: Terminating a snaphot
         Given a PowerMax service
@@ -365,6 +481,18 @@ Feature: PowerMax CSI Interface
         Then no error was received
         And I call TerminateSnapshot
         Then no error was received
+@v1.3.0
+    Scenario: Retry the cleanup of a snapshot whose retention cannot be checked
+        Given a PowerMax service
+        And I call Probe
+        And I call CreateVolume "volume1"
+        And a valid CreateVolumeResponse is returned
+        And I call CreateSnapshot "snapshot1" on "volume1"
+        And a valid CreateSnapshotResponse is returned
+        And I induce error "GetVolSnapsError"
+        When I call the snapshot cleanup of the snapshot
+        Then the snapshot cleanup of the snapshot is retried
+        And checking the retention of the snapshot fails
 @v1.2.0
     Scenario: Unlink and terminate snapshot
         Given a PowerMax service
@@ -0,0 +1,163 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/dell/gofsutil"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Values of the FsCheck StorageClass parameter
+const (
+	// FsCheckNone does not check the filesystem before it is mounted
+	FsCheckNone = "none"
+	// FsCheckCheck runs a read-only check, and fails the mount if errors are found
+	FsCheckCheck = "check"
+	// FsCheckRepair runs a read-only check, and repairs the errors found if it is safe to do so
+	FsCheckRepair = "repair"
+)
+
+// Exit codes of the filesystem checkers. The exit code of e2fsck is a bitmask of its results.
+const (
+	e2fsckErrorsCorrected   = 1
+	e2fsckErrorsUncorrected = 4
+	xfsRepairErrorsFound    = 1
+	xfsRepairDirtyLog       = 2
+	btrfsCheckErrorsFound   = 1
+)
+
+// e2fsckJournalNotRecovered is printed by e2fsck -n when the journal of the filesystem needs to be
+// recovered, which a read-only check does not do, so the check reports errors the recovery fixes
+const e2fsckJournalNotRecovered = "skipping journal recovery"
+
+// validateFsCheck returns an error if the value of the FsCheck parameter is not valid
+func validateFsCheck(fsCheck string) error {
+	switch fsCheck {
+	case "", FsCheckNone, FsCheckCheck, FsCheckRepair:
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "An invalid %s parameter was specified: %s, it must be one of %s, %s or %s",
+		FsCheckParam, fsCheck, FsCheckNone, FsCheckCheck, FsCheckRepair)
+}
+
+// checkFilesystem checks the filesystem on an unmounted device before it is mounted,
+// as a crash of the node may have left it inconsistent. Only ext3, ext4, xfs and btrfs
+// filesystems are checked; unformatted devices are left to be formatted by the mount.
+// If errors are found they are repaired when fsCheck is FsCheckRepair and the device
+// is not read only, otherwise an error including the output of the checker is returned.
+// btrfs filesystems are never repaired automatically, as btrfs check --repair is not safe.
+// As with a dirty xfs log, an ext3 or ext4 filesystem whose journal needs to be recovered is
+// left to the mount to recover when it is not repaired, as the check cannot tell its errors apart.
+func checkFilesystem(ctx context.Context, device, fsCheck string, readOnly bool) error {
+	if fsCheck == "" || fsCheck == FsCheckNone {
+		return nil
+	}
+	fsType, err := gofsutil.GetDiskFormat(ctx, device)
+	if err != nil {
+		log.Warningf("Unable to determine the filesystem on %s, not checking it: %s", device, err.Error())
+		return nil
+	}
+	f := log.Fields{
+		"device":  device,
+		"fsType":  fsType,
+		"fsCheck": fsCheck,
+	}
+	var checkArgs, repairArgs []string
+	var checker string
+	switch fsType {
+	case "ext3", "ext4":
+		checker = "e2fsck"
+		checkArgs = []string{"-n", device}
+		repairArgs = []string{"-p", device}
+	case "xfs":
+		checker = "xfs_repair"
+		checkArgs = []string{"-n", device}
+		repairArgs = []string{device}
+	case "btrfs":
+		checker = "btrfs"
+		checkArgs = []string{"check", "--readonly", device}
+	case "":
+		log.WithFields(f).Debug("Device is not formatted, not checking it")
+		return nil
+	default:
+		log.WithFields(f).Infof("Checking %s filesystems is not supported", fsType)
+		return nil
+	}
+
+	log.WithFields(f).Info("Checking filesystem")
+	out, code, err := runFilesystemChecker(checker, checkArgs...)
+	switch {
+	case err != nil:
+		return status.Errorf(codes.Internal, "Unable to run %s on %s: %s: %s", checker, device, err.Error(), out)
+	case code == 0 || (checker == "e2fsck" && e2fsckClean(code)):
+		log.WithFields(f).Info("Filesystem is clean")
+		return nil
+	case checker == "xfs_repair" && code == xfsRepairDirtyLog:
+		// the log is replayed when the filesystem is mounted, after which it can be checked
+		log.WithFields(f).Info("Filesystem log needs to be replayed, it will be replayed by the mount")
+		return nil
+	case checker == "e2fsck" && code&e2fsckErrorsUncorrected == 0:
+		return status.Errorf(codes.Internal, "%s failed on %s with exit code %d: %s", checker, device, code, out)
+	case checker == "xfs_repair" && code != xfsRepairErrorsFound:
+		return status.Errorf(codes.Internal, "%s failed on %s with exit code %d: %s", checker, device, code, out)
+	case checker == "btrfs" && code != btrfsCheckErrorsFound:
+		return status.Errorf(codes.Internal, "%s failed on %s with exit code %d: %s", checker, device, code, out)
+	}
+
+	if fsCheck != FsCheckRepair || readOnly || repairArgs == nil {
+		if checker == "e2fsck" && strings.Contains(out, e2fsckJournalNotRecovered) {
+			log.WithFields(f).Info("Filesystem journal needs to be recovered, it will be recovered by the mount")
+			return nil
+		}
+		return status.Errorf(codes.FailedPrecondition,
+			"The %s filesystem on %s has errors and must be repaired: %s", fsType, device, out)
+	}
+	log.WithFields(f).Warningf("Filesystem has errors, repairing it: %s", out)
+	repairOut, code, err := runFilesystemChecker(checker, repairArgs...)
+	if err == nil && (code == 0 || (checker == "e2fsck" && e2fsckClean(code))) {
+		log.WithFields(f).Warningf("Filesystem repaired: %s", repairOut)
+		return nil
+	}
+	if err != nil {
+		repairOut = err.Error() + ": " + repairOut
+	}
+	return status.Errorf(codes.FailedPrecondition,
+		"The %s filesystem on %s has errors which could not be repaired automatically: %s", fsType, device, repairOut)
+}
+
+// e2fsckClean returns true if the exit code of e2fsck reports no errors, or only corrected ones
+func e2fsckClean(code int) bool {
+	return code&^e2fsckErrorsCorrected == 0
+}
+
+// runFilesystemChecker runs a filesystem checker and returns its output and exit code.
+// An error is only returned if the checker could not be run.
+func runFilesystemChecker(name string, args ...string) (string, int, error) {
+	out, err := execCommand(name, args...).CombinedOutput()
+	output := strings.TrimSpace(string(out))
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return output, exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return output, -1, err
+	}
+	return output, 0, nil
+}
@@ -26,9 +26,15 @@ var mockGobrickInducedErrors struct {
 	DisconnectVolumeError bool
 }
 
+// mockGobrickDisconnectedWith is the transport protocol of the last connector which disconnected a volume
+var mockGobrickDisconnectedWith string
+
 func mockGobrickReset() {
 	mockGobrickInducedErrors.ConnectVolumeError = false
 	mockGobrickInducedErrors.DisconnectVolumeError = false
+	mockGobrickDisconnectedWith = ""
+	mockNVMeNamespaces = make(map[string]string)
+	mockNVMeNQNs = nil
 }
 
 type mockFCGobrick struct {
@@ -54,6 +60,7 @@ func (g *mockFCGobrick) ConnectVolume(ctx context.Context, info gobrick.FCVolume
 }
 
 func (g *mockFCGobrick) DisconnectVolumeByDeviceName(ctx context.Context, name string) error {
+	mockGobrickDisconnectedWith = FcTransportProtocol
 	if mockGobrickInducedErrors.DisconnectVolumeError {
 		return fmt.Errorf("induced DisconnectVolumeError")
 	}
@@ -93,6 +100,7 @@ func (g *mockISCSIGobrick) ConnectVolume(ctx context.Context, info gobrick.ISCSI
 }
 
 func (g *mockISCSIGobrick) DisconnectVolumeByDeviceName(ctx context.Context, name string) error {
+	mockGobrickDisconnectedWith = IscsiTransportProtocol
 	if mockGobrickInducedErrors.DisconnectVolumeError {
 		return fmt.Errorf("induced DisconnectVolumeError")
 	}
@@ -107,3 +115,55 @@ func (g *mockISCSIGobrick) GetInitiatorName(ctx context.Context) ([]string, erro
 	result := make([]string, 0)
 	return result, nil
 }
+
+// mockNVMeNamespaces maps the NGUID of each connected NVMe namespace to its device name
+var mockNVMeNamespaces = make(map[string]string)
+
+// mockNVMeNQNs are the host NQNs returned by mockNVMeGobrick
+var mockNVMeNQNs []string
+
+type mockNVMeGobrick struct {
+}
+
+func (g *mockNVMeGobrick) ConnectVolume(ctx context.Context, info NVMeVolumeInfo, useFC bool) (gobrick.Device, error) {
+	dev := gobrick.Device{
+		WWN:  info.WWN,
+		Name: "sdc",
+	}
+	if len(info.Targets) < 1 {
+		return dev, fmt.Errorf("No targets specified")
+	}
+	for _, target := range info.Targets {
+		if target.Portal == "" || (!useFC && target.Target == "") {
+			return dev, fmt.Errorf("Invalid target %v", target)
+		}
+	}
+	if mockGobrickInducedErrors.ConnectVolumeError {
+		return dev, fmt.Errorf("induced ConnectVolumeError")
+	}
+	mockNVMeNamespaces[normalizeNGUID(info.WWN)] = dev.Name
+	return dev, nil
+}
+
+func (g *mockNVMeGobrick) DisconnectVolumeByDeviceName(ctx context.Context, name string) error {
+	if mockGobrickInducedErrors.DisconnectVolumeError {
+		return fmt.Errorf("induced DisconnectVolumeError")
+	}
+	for nguid, device := range mockNVMeNamespaces {
+		if device == name {
+			delete(mockNVMeNamespaces, nguid)
+		}
+	}
+	return nil
+}
+
+func (g *mockNVMeGobrick) GetInitiatorName(ctx context.Context) ([]string, error) {
+	return mockNVMeNQNs, nil
+}
+
+func (g *mockNVMeGobrick) GetDeviceByNGUID(ctx context.Context, nguid string) (gobrick.Device, error) {
+	if name, ok := mockNVMeNamespaces[normalizeNGUID(nguid)]; ok {
+		return gobrick.Device{WWN: nguid, Name: name}, nil
+	}
+	return gobrick.Device{}, fmt.Errorf("No NVMe namespace found with NGUID %s", nguid)
+}
@@ -79,7 +79,7 @@ func (s *service) Probe(
 			log.Printf("error in nodeProbe: %s", err.Error())
 			return nil, err
 		}
-		if !s.nodeIsInitialized {
+		if !s.isNodeInitialized() {
 			// For test environments running both node/controller, no startup delay
 			if s.mode == "" {
 				maximumStartupDelay = 1
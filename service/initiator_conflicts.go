@@ -0,0 +1,188 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Policies applied when an initiator of the node belongs to another host
+const (
+	// InitiatorConflictFail fails the setup of the node for the array
+	InitiatorConflictFail = "fail"
+	// InitiatorConflictMove moves the initiator into the host of the node, if the
+	// other host is a host of the driver with no masking views
+	InitiatorConflictMove = "move"
+	// InitiatorConflictAdopt makes the node use the name of the node of the other
+	// host, if it is a host of the driver
+	InitiatorConflictAdopt = "adopt"
+)
+
+// getInitiatorConflictPolicy validates the initiator conflict policy
+// An empty or invalid value selects the fail policy
+func getInitiatorConflictPolicy(value string) string {
+	policy := strings.ToLower(strings.TrimSpace(value))
+	switch policy {
+	case InitiatorConflictFail, InitiatorConflictMove, InitiatorConflictAdopt:
+		return policy
+	case "":
+		return InitiatorConflictFail
+	default:
+		log.Errorf("Invalid initiator conflict policy: %s, valid values are %s, %s or %s. Using %s",
+			value, InitiatorConflictFail, InitiatorConflictMove, InitiatorConflictAdopt, InitiatorConflictFail)
+		return InitiatorConflictFail
+	}
+}
+
+// matchesNodeInitiator returns true if an initiator ID of the array is an initiator of the node.
+// Initiator IDs may be prefixed by the director and port, and FC WWNs of the node by 0x.
+func matchesNodeInitiator(initiatorID, nodeInitiator string) bool {
+	nodeInitiator = strings.TrimPrefix(nodeInitiator, "0x")
+	return initiatorID == nodeInitiator || strings.HasSuffix(initiatorID, nodeInitiator)
+}
+
+// getNodeNameFromHostID returns the name of the node a host was created for by the driver,
+// or "" if the host was not created by the driver for this cluster
+func (s *service) getNodeNameFromHostID(hostID string) string {
+	hostPrefix := CsiHostPrefix + s.getClusterPrefix() + "-"
+	if !strings.HasPrefix(hostID, hostPrefix) {
+		return ""
+	}
+	nodeName := strings.TrimPrefix(hostID, hostPrefix)
+	for _, suffix := range []string{NVMeTCPSuffix, NVMeFCSuffix, FCSuffix} {
+		if strings.HasSuffix(nodeName, suffix) {
+			return strings.TrimSuffix(nodeName, suffix)
+		}
+	}
+	return nodeName
+}
+
+// resolveInitiatorConflict is called when an initiator of the node belongs to otherHostID rather
+// than to hostID, the host of the node. With the move policy, the initiator is removed from the
+// other host if it is a stale host of the driver with no masking views, and the other host is
+// removed if it has no other initiators. An error is returned if the conflict is not resolved.
+func (s *service) resolveInitiatorConflict(symID, initiatorID, nodeInitiator, otherHostID, hostID string) error {
+	errormsg := fmt.Sprintf("initiator: %s is already a part of a different host: %s on: %s",
+		initiatorID, otherHostID, symID)
+	policy := s.opts.InitiatorConflictPolicy
+	if policy != InitiatorConflictMove {
+		log.Errorf("%s, not resolved by initiator conflict policy %s", errormsg, policy)
+		return fmt.Errorf(errormsg)
+	}
+	otherHost, err := s.adminClient.GetHostByID(symID, otherHostID)
+	if err != nil {
+		log.Errorf("%s, which could not be retrieved, the initiator is not moved: %s", errormsg, err.Error())
+		return fmt.Errorf(errormsg)
+	}
+	if s.getNodeNameFromHostID(otherHostID) == "" || otherHost.NumberMaskingViews > 0 {
+		log.Errorf("%s, which is not a host of the driver without masking views, the initiator is not moved", errormsg)
+		return fmt.Errorf(errormsg)
+	}
+	remaining := make([]string, 0)
+	for _, init := range otherHost.Initiators {
+		if !strings.EqualFold(init, strings.TrimPrefix(nodeInitiator, "0x")) {
+			remaining = append(remaining, init)
+		}
+	}
+	if len(remaining) == 0 {
+		log.Warningf("Moving initiator %s from stale host %s to host %s on %s by removing %s, which has no other initiators",
+			initiatorID, otherHostID, hostID, symID, otherHostID)
+		if err := s.adminClient.DeleteHost(symID, otherHostID); err != nil {
+			log.Errorf("%s, which could not be removed: %s", errormsg, err.Error())
+			return fmt.Errorf(errormsg)
+		}
+		return nil
+	}
+	log.Warningf("Moving initiator %s from stale host %s to host %s on %s, %s keeps initiators %v",
+		initiatorID, otherHostID, hostID, symID, otherHostID, remaining)
+	if _, err := s.adminClient.UpdateHostInitiators(symID, otherHost, remaining); err != nil {
+		log.Errorf("%s, from which it could not be removed: %s", errormsg, err.Error())
+		return fmt.Errorf(errormsg)
+	}
+	return nil
+}
+
+// getHostNodeName returns the node name after which the hosts and masking views of the node are
+// named on the arrays, which is the name of the node unless the adopt policy adopted another one.
+// The ID of the node, returned by NodeGetInfo, is always the name of the node.
+func (s *service) getHostNodeName() string {
+	s.hostNodeNameMutex.Lock()
+	defer s.hostNodeNameMutex.Unlock()
+	if s.hostNodeName != "" {
+		return s.hostNodeName
+	}
+	return s.opts.NodeName
+}
+
+// adoptHostsOfInitiators is used by the adopt policy, before the hosts of the node are set up.
+// If the initiators of the node belong to hosts the driver created for another node name, e.g.
+// after the node was renamed, the hosts and masking views of the node are named after that name,
+// so that the node keeps using them. The ID of the node is not changed.
+// Nothing is adopted if the initiators belong to hosts of several node names.
+func (s *service) adoptHostsOfInitiators(symmetrixIDs []string, nodeInitiators []string) {
+	// names of the nodes of the hosts holding the initiators, and the hosts holding them
+	nodeNames := make(map[string][]string)
+	for _, symID := range symmetrixIDs {
+		initList, err := s.adminClient.GetInitiatorList(symID, "", false, false)
+		if err != nil {
+			log.Warningf("Failed to fetch initiator list for %s, no host adopted from it: %s", symID, err.Error())
+			continue
+		}
+		for _, nodeInitiator := range nodeInitiators {
+			for _, initiatorID := range initList.InitiatorIDs {
+				if !matchesNodeInitiator(initiatorID, nodeInitiator) {
+					continue
+				}
+				initiator, err := s.adminClient.GetInitiatorByID(symID, initiatorID)
+				if err != nil || initiator.HostID == "" {
+					continue
+				}
+				nodeName := s.getNodeNameFromHostID(initiator.HostID)
+				if nodeName == "" {
+					log.Errorf("Initiator %s belongs to host %s on %s, which was not created by the driver, it cannot be adopted",
+						initiatorID, initiator.HostID, symID)
+					continue
+				}
+				if nodeName != s.opts.NodeName {
+					nodeNames[nodeName] = appendIfMissing(nodeNames[nodeName], symID+":"+initiator.HostID)
+				}
+			}
+		}
+	}
+	switch len(nodeNames) {
+	case 0:
+		log.Infof("The initiators of node %s belong to no host of another node", s.opts.NodeName)
+	case 1:
+		for nodeName, hosts := range nodeNames {
+			log.Warningf("Adopting hosts %v for node %s, its hosts and masking views are named after %s",
+				hosts, s.opts.NodeName, nodeName)
+			s.hostNodeNameMutex.Lock()
+			s.hostNodeName = nodeName
+			s.hostNodeNameMutex.Unlock()
+		}
+	default:
+		names := make([]string, 0, len(nodeNames))
+		for nodeName := range nodeNames {
+			names = append(names, nodeName)
+		}
+		sort.Strings(names)
+		log.Errorf("The initiators of node %s belong to hosts of several nodes %v, no host is adopted",
+			s.opts.NodeName, names)
+	}
+}
@@ -46,6 +46,13 @@ type fcConnector interface {
 	GetInitiatorPorts(ctx context.Context) ([]string, error)
 }
 
+type nvmeConnector interface {
+	ConnectVolume(ctx context.Context, info NVMeVolumeInfo, useFC bool) (gobrick.Device, error)
+	DisconnectVolumeByDeviceName(ctx context.Context, name string) error
+	GetInitiatorName(ctx context.Context) ([]string, error)
+	GetDeviceByNGUID(ctx context.Context, nguid string) (gobrick.Device, error)
+}
+
 func (s *service) initISCSIConnector(chroot string) {
 	if s.iscsiConnector == nil {
 		setupGobrick(s)
@@ -62,6 +69,12 @@ func (s *service) initFCConnector(chroot string) {
 	}
 }
 
+func (s *service) initNVMeConnector(chroot string) {
+	if s.nvmeConnector == nil {
+		s.nvmeConnector = newNVMeCLIConnector(chroot)
+	}
+}
+
 func setupGobrick(srv *service) {
 	gobrick.SetLogger(&customLogger{})
 	//if srv.opts.EnableTracing {
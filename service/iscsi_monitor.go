@@ -0,0 +1,233 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"expvar"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dell/goiscsi"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultISCSISessionCheckInterval is how often the iSCSI sessions are checked
+// if X_CSI_POWERMAX_ISCSI_SESSION_CHECK_INTERVAL is not set
+const defaultISCSISessionCheckInterval = 2 * time.Minute
+
+// iscsiSessionMetrics publishes the number of iSCSI sessions to each array
+var iscsiSessionMetrics = expvar.NewMap("powermax_iscsi_sessions")
+
+// iscsiSessionState holds the number of active iSCSI sessions to each array,
+// as found by the last session check
+type iscsiSessionState struct {
+	sync.Mutex
+	monitorStarted bool
+	counts         map[string]int
+}
+
+// startISCSISessionMonitor starts a goroutine which periodically checks the iSCSI
+// sessions of the node and logs back into any portals which have been lost,
+// e.g. after a switch reboot. It is started when the first array is set up for iSCSI,
+// and only once.
+func (s *service) startISCSISessionMonitor() {
+	interval := s.opts.ISCSISessionCheckInterval
+	if interval <= 0 {
+		log.Info("iSCSI session monitor is disabled")
+		return
+	}
+	s.iscsiSessions.Lock()
+	defer s.iscsiSessions.Unlock()
+	if s.iscsiSessions.monitorStarted {
+		return
+	}
+	s.iscsiSessions.monitorStarted = true
+	log.Infof("Starting iSCSI session monitor, checking every %s", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if s.isNodeInitialized() {
+				s.checkISCSISessions()
+			}
+		}
+	}()
+}
+
+// getISCSIArrays returns the arrays which this node uses with iSCSI
+func (s *service) getISCSIArrays() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	arrays := make([]string, 0)
+	for array, tp := range s.arrayTransportProtocolMap {
+		if tp == IscsiTransportProtocol {
+			arrays = append(arrays, array)
+		}
+	}
+	return arrays
+}
+
+// getExpectedISCSITargets returns the targets the node should be logged into for an array.
+// These are the targets of the port group in the node's masking view. If there is no
+// masking view yet, the array's portals are returned without a target.
+func (s *service) getExpectedISCSITargets(array string) ([]goiscsi.ISCSITarget, error) {
+	_, _, mvName := s.GetISCSIHostSGAndMVIDFromNodeID(s.getHostNodeName())
+	if view, err := s.adminClient.GetMaskingViewByID(array, mvName); err == nil {
+		targets, err := s.getIscsiTargetsForMaskingView(array, view)
+		if err == nil && len(targets) > 0 {
+			return uniqueISCSITargets(targets), nil
+		}
+	}
+	portalIPs, err := s.getPortalIPs(array)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]goiscsi.ISCSITarget, 0)
+	for _, ip := range portalIPs {
+		targets = append(targets, goiscsi.ISCSITarget{Portal: ip})
+	}
+	return uniqueISCSITargets(targets), nil
+}
+
+// uniqueISCSITargets removes duplicate portal and target pairs
+func uniqueISCSITargets(targets []goiscsi.ISCSITarget) []goiscsi.ISCSITarget {
+	seen := make(map[string]bool)
+	unique := make([]goiscsi.ISCSITarget, 0)
+	for _, target := range targets {
+		key := iscsiPortalIP(target.Portal) + "," + target.Target
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, target)
+		}
+	}
+	return unique
+}
+
+// iscsiPortalIP returns the IP address of an iSCSI portal of the form ip:port or [ip]:port
+func iscsiPortalIP(portal string) string {
+	if host, _, err := net.SplitHostPort(portal); err == nil {
+		return host
+	}
+	return strings.Trim(portal, "[]")
+}
+
+// sessionMatchesTarget returns true if the session is to the target's portal, and
+// to the target itself if one is specified
+func sessionMatchesTarget(session goiscsi.ISCSISession, target goiscsi.ISCSITarget) bool {
+	if iscsiPortalIP(session.Portal) != iscsiPortalIP(target.Portal) {
+		return false
+	}
+	return target.Target == "" || session.Target == target.Target
+}
+
+// checkISCSISessions logs back into any expected iSCSI targets which have no
+// active session, and records the number of active sessions to each array
+func (s *service) checkISCSISessions() {
+	arrays := s.getISCSIArrays()
+	if len(arrays) == 0 {
+		s.setISCSISessionCounts(map[string]int{})
+		return
+	}
+	sessions, err := s.iscsiClient.GetSessions()
+	if err != nil {
+		log.Errorf("iSCSI session monitor: unable to get the iSCSI sessions: %s", err.Error())
+		return
+	}
+	active := make([]goiscsi.ISCSISession, 0)
+	for _, session := range sessions {
+		if session.ISCSISessionState == goiscsi.ISCSISessionState_LOGGED_IN {
+			active = append(active, session)
+		}
+	}
+	counts := make(map[string]int)
+	for _, array := range arrays {
+		targets, err := s.getExpectedISCSITargets(array)
+		if err != nil {
+			log.Errorf("iSCSI session monitor: unable to get the iSCSI targets of %s: %s", array, err.Error())
+			continue
+		}
+		count := 0
+		for _, session := range active {
+			for _, target := range targets {
+				if sessionMatchesTarget(session, target) {
+					count++
+					break
+				}
+			}
+		}
+		for _, target := range targets {
+			found := false
+			for _, session := range active {
+				if sessionMatchesTarget(session, target) {
+					found = true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+			log.Warningf("iSCSI session monitor: no session to %s %s on array %s, logging in",
+				target.Portal, target.Target, array)
+			if target.Target == "" {
+				_, err = s.discoverTargets(target.Portal, true)
+			} else if err = s.setSessionCHAPForTargets([]goiscsi.ISCSITarget{target}); err == nil {
+				err = s.iscsiClient.PerformLogin(target)
+			}
+			if err != nil {
+				log.Errorf("iSCSI session monitor: failed to login to %s %s: %s", target.Portal, target.Target, err.Error())
+				continue
+			}
+			count++
+		}
+		counts[array] = count
+	}
+	s.setISCSISessionCounts(counts)
+}
+
+// setISCSISessionCounts records the number of iSCSI sessions to each array, and publishes them
+// as the powermax_iscsi_sessions metric, from which the arrays no longer checked are removed
+func (s *service) setISCSISessionCounts(counts map[string]int) {
+	s.iscsiSessions.Lock()
+	defer s.iscsiSessions.Unlock()
+	for array := range s.iscsiSessions.counts {
+		if _, ok := counts[array]; !ok {
+			iscsiSessionMetrics.Delete(array)
+		}
+	}
+	for array, count := range counts {
+		iscsiSessionMetrics.Set(array, intVar(count))
+	}
+	s.iscsiSessions.counts = counts
+}
+
+// getISCSISessionCounts returns the number of iSCSI sessions to each array found by the last check
+func (s *service) getISCSISessionCounts() map[string]int {
+	s.iscsiSessions.Lock()
+	defer s.iscsiSessions.Unlock()
+	counts := make(map[string]int)
+	for array, count := range s.iscsiSessions.counts {
+		counts[array] = count
+	}
+	return counts
+}
+
+// intVar returns an expvar integer holding value
+func intVar(value int) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(int64(value))
+	return v
+}
@@ -0,0 +1,115 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/dell/gofsutil"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultFsType is the filesystem used if a mount volume does not specify one
+const defaultFsType = "ext4"
+
+// mkfsOptionPattern matches a single mkfs argument. Arguments are passed
+// directly to mkfs, not through a shell, but are restricted to the characters
+// needed for options such as "-m reflink=1" or "-i 65536". Paths are not allowed,
+// so that the options cannot name another device or a file of the node for mkfs.
+var mkfsOptionPattern = regexp.MustCompile(`^[A-Za-z0-9=,._:+-]+$`)
+
+// defaultMkfsArgs are the arguments always passed to mkfs for each filesystem,
+// which make it skip discarding the blocks of the device to reduce the format time
+var defaultMkfsArgs = map[string][]string{
+	"ext3":  {"-F", "-E", "nodiscard"},
+	"ext4":  {"-F", "-E", "nodiscard"},
+	"xfs":   {"-K"},
+	"btrfs": {"-K"},
+}
+
+// parseMkfsOptions validates the mkfs options for a filesystem and returns them as
+// separate arguments. Only the filesystems which the driver can format are allowed.
+func parseMkfsOptions(fsType, options string) ([]string, error) {
+	args := strings.Fields(options)
+	if len(args) == 0 {
+		return nil, nil
+	}
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+	if _, ok := defaultMkfsArgs[fsType]; !ok {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"%s are not supported for filesystem %s", MkfsOptionsParam, fsType)
+	}
+	if !strings.HasPrefix(args[0], "-") {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"An invalid %s parameter was specified: %s, it must start with an option", MkfsOptionsParam, options)
+	}
+	for _, arg := range args {
+		if !mkfsOptionPattern.MatchString(arg) {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"An invalid %s parameter was specified: %s contains invalid characters", MkfsOptionsParam, arg)
+		}
+	}
+	return args, nil
+}
+
+// validateMkfsOptions validates the mkfs options against the filesystems of the mount volume capabilities
+func validateMkfsOptions(options string, vcs []*csi.VolumeCapability) error {
+	if strings.TrimSpace(options) == "" {
+		return nil
+	}
+	for _, vc := range vcs {
+		if mount := vc.GetMount(); mount != nil {
+			if _, err := parseMkfsOptions(mount.GetFsType(), options); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// formatWithOptions formats an unformatted device with the given mkfs options. A device
+// which already has a filesystem is left untouched, so the options only apply on first format.
+func formatWithOptions(ctx context.Context, device, fsType string, options []string) error {
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+	existingFormat, err := gofsutil.GetDiskFormat(ctx, device)
+	if err != nil {
+		return status.Errorf(codes.Internal, "error determining the format of %s: %s", device, err.Error())
+	}
+	if existingFormat != "" {
+		log.Debugf("%s is already formatted as %s, not applying mkfs options %v", device, existingFormat, options)
+		return nil
+	}
+	args := append([]string{}, defaultMkfsArgs[fsType]...)
+	args = append(args, options...)
+	args = append(args, device)
+	mkfsCmd := fmt.Sprintf("mkfs.%s", fsType)
+	log.Infof("formatting with command: %s %v", mkfsCmd, args)
+	out, err := execCommand(mkfsCmd, args...).CombinedOutput()
+	if err != nil {
+		return status.Errorf(codes.Internal, "error formatting %s as %s: %s: %s",
+			device, fsType, err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	types "github.com/dell/gopowermax/types/v90"
+	csictx "github.com/rexray/gocsi/context"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ModifyCommand is the command line argument which runs Modify rather than the driver
+const ModifyCommand = "modify"
+
+// Modify runs the modify command, which changes the service level of a volume by moving its
+// device to the storage group of the driver for the new service level, without data movement,
+// and writes the volume attributes the volume now has to out. The Unisphere connection and the
+// cluster prefix are read from the same environment variables as the driver.
+// The command runs in its own process, so it cannot take the locks which the controller holds on
+// the storage group of a service level and SRP while it creates or deletes a volume in it. It must
+// not run while volumes with the old or new service level are created or deleted.
+func Modify(ctx context.Context, args []string, out io.Writer) error {
+	var volumeHandle, serviceLevel string
+	flags := flag.NewFlagSet(ModifyCommand, flag.ContinueOnError)
+	flags.StringVar(&volumeHandle, "volume", "", "volume handle of the PersistentVolume (required)")
+	flags.StringVar(&serviceLevel, "service-level", "", "new service level of the volume (required)")
+	flags.SetOutput(out)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if volumeHandle == "" || serviceLevel == "" {
+		return fmt.Errorf("-volume and -service-level are required")
+	}
+
+	s := New().(*service)
+	if err := s.loadCommandOpts(ctx); err != nil {
+		return err
+	}
+	if err := s.controllerProbe(ctx); err != nil {
+		return err
+	}
+	sg, err := s.modifyServiceLevel(volumeHandle, serviceLevel)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s: %q\n%s: %q\n", ServiceLevelParam, sg.SLO, StoragePoolParam, sg.SRP)
+	return nil
+}
+
+// loadCommandOpts reads the options the commands of the driver binary need to connect to
+// Unisphere from the environment
+func (s *service) loadCommandOpts(ctx context.Context) error {
+	opts := Opts{User: "admin", Version: defaultU4pVersion, AllowedArrays: []string{}}
+	if ep, ok := csictx.LookupEnv(ctx, EnvEndpoint); ok {
+		opts.Endpoint = ep
+	}
+	if user, ok := csictx.LookupEnv(ctx, EnvUser); ok && user != "" {
+		opts.User = user
+	}
+	opts.Password, _ = csictx.LookupEnv(ctx, EnvPassword)
+	if vs, ok := csictx.LookupEnv(ctx, EnvVersion); ok && vs != "" {
+		opts.Version = vs
+	}
+	if insecure, ok := csictx.LookupEnv(ctx, EnvSkipCertificateValidation); ok {
+		opts.Insecure, _ = strconv.ParseBool(insecure)
+	}
+	if arrays, ok := csictx.LookupEnv(ctx, EnvArrayWhitelist); ok {
+		opts.AllowedArrays, _ = s.parseCommaSeperatedList(arrays)
+	}
+	prefix, ok := csictx.LookupEnv(ctx, EnvClusterPrefix)
+	if !ok || prefix == "" {
+		return fmt.Errorf("No Cluster Prefix was specified in %s", EnvClusterPrefix)
+	}
+	if len(prefix) > MaxClusterPrefixLength {
+		return fmt.Errorf("Invalid Cluster Prefix specified, exceeds maximum length of %d characters", MaxClusterPrefixLength)
+	}
+	opts.ClusterPrefix = prefix
+	s.opts = opts
+	s.mode = "controller"
+	s.pmaxTimeoutSeconds = defaultPmaxTimeout
+	s.storagePoolCacheDuration = StoragePoolCacheDuration
+	return nil
+}
+
+// modifyServiceLevel moves the device of a volume from the storage group of the driver for its
+// service level to the one for serviceLevel, with the same SRP and application prefix, and
+// returns the storage group the device is now in. The masking views of the device are those of
+// the storage groups of the nodes, which are not changed. A storage group with a service level
+// which is itself in a masking view, i.e. not created by the driver, is not changed.
+func (s *service) modifyServiceLevel(volumeHandle, serviceLevel string) (*types.StorageGroup, error) {
+	if !isValidServiceLevel(serviceLevel) {
+		return nil, status.Errorf(codes.InvalidArgument, "An invalid Service Level parameter was specified")
+	}
+	symID, devID, vol, err := s.GetVolumeByID(volumeHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	var current *types.StorageGroup
+	for _, sgID := range vol.StorageGroupIDList {
+		sg, err := s.adminClient.GetStorageGroup(symID, sgID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not read storage group %s: %s", sgID, err.Error())
+		}
+		if sg.SRP != "" && sg.SLO != "" && sg.SLO != "None" {
+			current = sg
+			break
+		}
+	}
+	if current == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Device %s is not in a storage group with a service level", devID)
+	}
+	if current.SLO == serviceLevel {
+		log.Infof("Device %s is already in storage group %s with service level %s", devID, current.StorageGroupID, serviceLevel)
+		return current, nil
+	}
+	sgPrefix := fmt.Sprintf("%s-%s-", CSIPrefix, s.getClusterPrefix())
+	sgSuffix := fmt.Sprintf("-%s-%s-SG", current.SLO, current.SRP)
+	if !strings.HasPrefix(current.StorageGroupID, sgPrefix) || !strings.HasSuffix(current.StorageGroupID, sgSuffix) {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"Device %s is in storage group %s, which was not created by the driver", devID, current.StorageGroupID)
+	}
+	if current.NumOfMaskingViews > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"Storage group %s of device %s is in masking views %v", current.StorageGroupID, devID, current.MaskingView)
+	}
+
+	// the application prefix of the storage group is kept
+	storageGroupName := strings.TrimSuffix(current.StorageGroupID, sgSuffix) + fmt.Sprintf("-%s-%s-SG", serviceLevel, current.SRP)
+	sg, err := s.adminClient.GetStorageGroup(symID, storageGroupName)
+	if err != nil || sg == nil {
+		log.Infof("Creating storage group %s", storageGroupName)
+		if _, err := s.adminClient.CreateStorageGroup(symID, storageGroupName, current.SRP, serviceLevel, false); err != nil {
+			return nil, status.Errorf(codes.Internal, "Error creating storage group: %s", err.Error())
+		}
+	}
+
+	// A device can only be in one storage group with a service level, so
+	// it is removed from its storage group before it is added to the new one
+	log.Infof("Moving device %s from storage group %s to %s", devID, current.StorageGroupID, storageGroupName)
+	if _, err := s.adminClient.RemoveVolumesFromStorageGroup(symID, current.StorageGroupID, devID); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not remove device %s from storage group %s: %s", devID, current.StorageGroupID, err.Error())
+	}
+	if err := s.adminClient.AddVolumesToStorageGroup(symID, storageGroupName, devID); err != nil {
+		log.Errorf("Could not add device %s to storage group %s, adding it back to %s", devID, storageGroupName, current.StorageGroupID)
+		if err := s.adminClient.AddVolumesToStorageGroup(symID, current.StorageGroupID, devID); err != nil {
+			log.Errorf("Could not add device %s back to storage group %s: %s", devID, current.StorageGroupID, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "Could not add device %s to storage group %s: %s", devID, storageGroupName, err.Error())
+	}
+	sg, err = s.adminClient.GetStorageGroup(symID, storageGroupName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not read storage group %s: %s", storageGroupName, err.Error())
+	}
+	return sg, nil
+}
+
+// isValidServiceLevel returns true if serviceLevel is one of validSLO
+func isValidServiceLevel(serviceLevel string) bool {
+	for _, val := range validSLO {
+		if serviceLevel == val {
+			return true
+		}
+	}
+	return false
+}
@@ -17,6 +17,7 @@ package service
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -83,11 +84,12 @@ func GetDevice(path string) (*Device, error) {
 // device to the requested target path. A private mount is performed first
 // within the given privDir directory.
 // The req.TargetPath should be a path starting with "/" (except for unit testing).
+// Mount volumes with one of the clusterFsTypes may be published MULTI_NODE_MULTI_WRITER.
 //
 // publishVolume handles both Mount and Block access types
 func publishVolume(
 	req *csi.NodePublishVolumeRequest,
-	privDir, device string, reqID string) error {
+	privDir, device string, reqID string, clusterFsTypes []string) error {
 
 	id := req.GetVolumeId()
 
@@ -113,7 +115,8 @@ func publishVolume(
 			id, err.Error())
 	}
 
-	isBlock, mntVol, accMode, multiAccessFlag, err := validateVolumeCapability(volCap, ro)
+	clusterFs := isClusterFs(volCap.GetMount().GetFsType(), clusterFsTypes)
+	isBlock, mntVol, accMode, multiAccessFlag, err := validateVolumeCapability(volCap, clusterFs)
 	if err != nil {
 		return err
 	}
@@ -138,7 +141,11 @@ func publishVolume(
 	if isBlock {
 		// BLOCK only ===================================================================================================
 		mntFlags := mntVol.GetMountFlags()
-		err = mountBlock(sysDevice, target, mntFlags, singleAccessMode(accMode))
+		readOnly := ro || readOnlyAccessMode(accMode)
+		if readOnly {
+			mntFlags = append(mntFlags, "ro")
+		}
+		err = mountBlock(sysDevice, target, mntFlags, singleAccessMode(accMode), readOnly)
 		return err
 	}
 
@@ -163,7 +170,16 @@ func publishVolume(
 			err.Error())
 	}
 
-	if len(devMnts) == 0 {
+	privMounted := false
+	for _, m := range devMnts {
+		if m.Path == privTgt {
+			privMounted = true
+		}
+	}
+
+	// A cluster filesystem may also be mounted elsewhere on the node, so it only
+	// needs the private mount to be in place
+	if len(devMnts) == 0 || (clusterFs && !privMounted) {
 		// Device isn't mounted anywhere, do the private mount
 		log.WithFields(f).Debug("attempting mount to private area")
 
@@ -213,9 +229,23 @@ func publishVolume(
 		if !alreadyMounted {
 			fs := mntVol.GetFsType()
 			mntFlags := mntVol.GetMountFlags()
+			// A volume published read only is never repaired
+			readOnly := ro || readOnlyAccessMode(accMode)
+			mkfsOptions, err := parseMkfsOptions(fs, req.GetVolumeContext()[MkfsOptionsParam])
+			if err != nil {
+				cleanupPrivateTarget(reqID, privTgt)
+				return err
+			}
+			// A cluster filesystem may be mounted by other nodes, so it is never checked
+			if !clusterFs {
+				if err := checkFilesystem(ctx, sysDevice.FullPath, req.GetVolumeContext()[FsCheckParam], readOnly); err != nil {
+					cleanupPrivateTarget(reqID, privTgt)
+					return err
+				}
+			}
 
 			if err := handlePrivFSMount(
-				ctx, accMode, sysDevice, mntFlags, fs, privTgt); err != nil {
+				ctx, accMode, sysDevice, mntFlags, mkfsOptions, fs, privTgt); err != nil {
 				// K8S may have removed the desired mount point. Clean up the private target.
 				cleanupPrivateTarget(reqID, privTgt)
 				return err
@@ -242,6 +272,11 @@ func publishVolume(
 					log.WithFields(f).Debug(
 						"private mount already in place")
 					break
+				} else if clusterFs {
+					// The read only target is a read only bind mount of the shared private mount
+					log.WithFields(f).Debug(
+						"private mount of cluster filesystem already in place")
+					break
 				} else {
 					log.WithFields(f).Printf("mount %#v rwo %s", m, rwo)
 					return status.Error(codes.InvalidArgument,
@@ -327,8 +362,10 @@ func cleanupPrivateTarget(reqID, privTgt string) {
 	}
 }
 
-// mountBlock bind mounts the device to the required target
-func mountBlock(device *Device, target string, mntFlags []string, singleAccess bool) error {
+// mountBlock bind mounts the device to the required target.
+// If readOnly is set, the device itself is also made read only, so that it cannot be
+// written through any other path, and read only targets cannot share it with writers.
+func mountBlock(device *Device, target string, mntFlags []string, singleAccess, readOnly bool) error {
 	log.Printf("mountBlock called device %#v target %s mntFlags %#v", device, target, mntFlags)
 	// Check to see if already mounted
 	mnts, err := getDevMounts(device)
@@ -337,10 +374,24 @@ func mountBlock(device *Device, target string, mntFlags []string, singleAccess b
 	}
 	for _, mnt := range mnts {
 		if mnt.Path == target {
+			if contains(mnt.Opts, "ro") != readOnly {
+				return status.Error(codes.Internal, "volume previously published with different mount options")
+			}
 			log.Info("Block volume target is already mounted")
 			return nil
 		} else if singleAccess {
 			return status.Error(codes.InvalidArgument, "Access mode conflicts with existing mounts")
+		} else if readOnly && !contains(mnt.Opts, "ro") {
+			return status.Error(codes.InvalidArgument, "Access mode conflicts with existing read write mounts")
+		}
+	}
+	if isDeviceReadOnly(device) != readOnly {
+		if !readOnly && len(mnts) > 0 {
+			return status.Error(codes.InvalidArgument, "Access mode conflicts with existing read only mounts")
+		}
+		// The device is not in use, or only by read only targets
+		if err := setDeviceReadOnly(device, readOnly); err != nil {
+			return err
 		}
 	}
 	err = createTarget(target, true)
@@ -354,11 +405,37 @@ func mountBlock(device *Device, target string, mntFlags []string, singleAccess b
 	return nil
 }
 
+// isDeviceReadOnly returns true if the kernel has the block device set read only.
+// A device whose state cannot be read is assumed to be read write.
+func isDeviceReadOnly(device *Device) bool {
+	data, err := ioutil.ReadFile(filepath.Join(sysBlock, filepath.Base(device.RealDev), "ro"))
+	if err != nil {
+		log.Debugf("Unable to read the read only state of %s: %s", device.RealDev, err.Error())
+		return false
+	}
+	return strings.TrimSpace(string(data)) == "1"
+}
+
+// setDeviceReadOnly sets the block device read only or read write
+func setDeviceReadOnly(device *Device, readOnly bool) error {
+	flag := "--setrw"
+	if readOnly {
+		flag = "--setro"
+	}
+	log.Infof("Setting block device %s %s", device.RealDev, strings.TrimPrefix(flag, "--set"))
+	out, err := execCommand("blockdev", flag, device.RealDev).CombinedOutput()
+	if err != nil {
+		return status.Errorf(codes.Internal, "error running blockdev %s %s: %s: %s",
+			flag, device.RealDev, err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
 func handlePrivFSMount(
 	ctx context.Context,
 	accMode *csi.VolumeCapability_AccessMode,
 	sysDevice *Device,
-	mntFlags []string,
+	mntFlags, mkfsOptions []string,
 	fs, privTgt string) error {
 
 	// Invoke the formats with a No Discard option to reduce formatting time
@@ -372,10 +449,31 @@ func handlePrivFSMount(
 		}
 		return nil
 	} else if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+		// gofsutil formats with default options, so format first if there are mkfs options
+		if len(mkfsOptions) > 0 {
+			if err := formatWithOptions(formatCtx, sysDevice.FullPath, fs, mkfsOptions); err != nil {
+				return err
+			}
+		}
 		if err := gofsutil.FormatAndMount(formatCtx, sysDevice.FullPath, privTgt, fs, mntFlags...); err != nil {
 			return status.Errorf(codes.Internal, "error performing private mount: %s", err.Error())
 		}
 		return nil
+	} else if accMode.GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+		// Only cluster filesystems are allowed here. They are shared by several nodes,
+		// so the filesystem must have been created before the volume is published.
+		existingFormat, err := gofsutil.GetDiskFormat(ctx, sysDevice.FullPath)
+		if err != nil {
+			return status.Errorf(codes.Internal, "error determining the format of %s: %s", sysDevice.FullPath, err.Error())
+		}
+		if existingFormat == "" {
+			return status.Errorf(codes.FailedPrecondition,
+				"%s is not formatted, the %s cluster filesystem must be created before the volume is published", sysDevice.FullPath, fs)
+		}
+		if err := gofsutil.Mount(ctx, sysDevice.FullPath, privTgt, fs, mntFlags...); err != nil {
+			return status.Errorf(codes.Internal, "error performing private mount: %s", err.Error())
+		}
+		return nil
 	}
 	return status.Error(codes.Internal, "Invalid access mode")
 }
@@ -436,11 +534,12 @@ func mkdir(path string) (bool, error) {
 // unpublishVolume removes the bind mount to the target path, and also removes
 // the mount to the private mount directory if the volume is no longer in use.
 // It determines this by checking to see if the volume is mounted anywhere else
-// other than the private mount.
+// other than the private mount. Mounts of a device with one of the clusterFsTypes
+// made outside of the driver are ignored.
 // The req.TargetPath should be a path starting with "/" (except for unit testing).
 func unpublishVolume(
 	req *csi.NodeUnpublishVolumeRequest,
-	privDir, device string, reqID string) (bool, error) {
+	privDir, device string, reqID string, clusterFsTypes []string) (bool, error) {
 	lastUnmounted := false
 
 	ctx := context.Background()
@@ -499,7 +598,7 @@ func unpublishVolume(
 
 	if privMnt {
 		log.WithFields(f).Debug(fmt.Sprintf("Unmounting %s", privTgt))
-		if lastUnmounted, err = unmountPrivMount(ctx, sysDevice, privTgt); err != nil {
+		if lastUnmounted, err = unmountPrivMount(ctx, sysDevice, privTgt, clusterFsTypes); err != nil {
 			return lastUnmounted, status.Errorf(codes.Internal,
 				"Error unmounting private mount: %s", err.Error())
 		}
@@ -517,7 +616,7 @@ func unpublishVolume(
 func unmountPrivMount(
 	ctx context.Context,
 	dev *Device,
-	target string) (bool, error) {
+	target string, clusterFsTypes []string) (bool, error) {
 	lastUnmounted := false
 
 	mnts, err := getDevMounts(dev)
@@ -525,6 +624,13 @@ func unmountPrivMount(
 		return lastUnmounted, err
 	}
 
+	// Mounts of a cluster filesystem made outside of the driver do not keep the private mount in use
+	if len(mnts) > 1 && len(clusterFsTypes) > 0 {
+		if fsType, err := gofsutil.GetDiskFormat(ctx, dev.FullPath); err == nil && isClusterFs(fsType, clusterFsTypes) {
+			mnts = privMountUsers(mnts, target)
+		}
+	}
+
 	// Handle no private mount (which is odd because we had one to call here)
 	// It implies deleting the target mount also cleaned up the private mount
 	if len(mnts) == 0 {
@@ -644,7 +750,8 @@ func createTarget(target string, isBlock bool) error {
 // csi.VolumeCapability_AccessMode accMode gives the access mode
 // string multiAccessFlag - "rw" or "ro" or "" as appropriate
 // error
-func validateVolumeCapability(volCap *csi.VolumeCapability, readOnly bool) (bool, *csi.VolumeCapability_MountVolume, *csi.VolumeCapability_AccessMode, string, error) {
+// Mount volumes are only allowed MULTI_NODE_MULTI_WRITER if clusterFs is set.
+func validateVolumeCapability(volCap *csi.VolumeCapability, clusterFs bool) (bool, *csi.VolumeCapability_MountVolume, *csi.VolumeCapability_AccessMode, string, error) {
 	var mntVol *csi.VolumeCapability_MountVolume
 	isBlock := false
 	isMount := false
@@ -666,9 +773,6 @@ func validateVolumeCapability(volCap *csi.VolumeCapability, readOnly bool) (bool
 		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
 			multiAccessFlag = "rw"
 		}
-		if readOnly {
-			return true, mntVol, accMode, "", status.Error(codes.InvalidArgument, "read only not supported for Block Volume")
-		}
 	}
 	mntVol = volCap.GetMount()
 	if mntVol != nil {
@@ -682,7 +786,9 @@ func validateVolumeCapability(volCap *csi.VolumeCapability, readOnly bool) (bool
 			multiAccessFlag = "ro"
 		case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
 		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
-			return false, mntVol, accMode, "", status.Error(codes.AlreadyExists, "Mount volumes do not support AccessMode MULTI_NODE_MULTI_WRITER")
+			if !clusterFs {
+				return false, mntVol, accMode, "", status.Error(codes.AlreadyExists, "Mount volumes do not support AccessMode MULTI_NODE_MULTI_WRITER")
+			}
 		}
 	}
 
@@ -692,6 +798,17 @@ func validateVolumeCapability(volCap *csi.VolumeCapability, readOnly bool) (bool
 	return isBlock, mntVol, accMode, multiAccessFlag, nil
 }
 
+// readOnlyAccessMode returns true if the access mode only allows reading SINGLE_NODE_READER_ONLY or MULTI_NODE_READER_ONLY
+func readOnlyAccessMode(accMode *csi.VolumeCapability_AccessMode) bool {
+	switch accMode.GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
+		return true
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
 // singleAccessMode returns true if only a single access is allowed SINGLE_NODE_WRITER or SINGLE_NODE_READER_ONLY
 func singleAccessMode(accMode *csi.VolumeCapability_AccessMode) bool {
 	switch accMode.GetMode() {
@@ -56,6 +56,7 @@ var (
 	disconnectVolumeRetryTime   = 1 * time.Second
 	nodePendingState            pendingState
 	sysBlock                    = "/sys/block" // changed for unit testing
+	nvmeDevDir                  = "/dev"       // changed for unit testing
 )
 
 func (s *service) NodeStageVolume(
@@ -104,11 +105,16 @@ func (s *service) NodeStageVolume(
 	if err != nil {
 		log.Error("Could not write WWN file: " + volumeWWN)
 	}
+	// Record the device as a device of the driver for the stale device collector
+	if err := s.recordDriverDevice(volumeWWN); err != nil {
+		log.Errorf("Could not record device %s as a device of the driver: %s", volumeWWN, err.Error())
+	}
 
 	// Get publishContext
 	publishContext := req.GetPublishContext()
 	volumeLUNAddress := publishContext[PublishContextLUNAddress]
 	targetIdentifiers := publishContext[PortIdentifiers]
+	transportProtocol := publishContext[PublishContextTransportProtocol]
 
 	f := log.Fields{
 		"CSIRequestID":      reqID,
@@ -118,31 +124,55 @@ func (s *service) NodeStageVolume(
 		"PrivTgt":           privTgt,
 		"SymmetrixID":       symID,
 		"TargetIdentifiers": targetIdentifiers,
+		"TransportProtocol": transportProtocol,
 		"WWN":               volumeWWN,
 	}
 	log.WithFields(f).Info("NodeStageVolume")
 	ctx = setLogFields(ctx, f)
 
+	devicePath, err := s.connectVolume(ctx, id, symID, volumeWWN, publishContext)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(f).WithField("devPath", devicePath).Info("NodeStageVolume completed")
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// connectVolume connects a volume to the node using the LUN address, target identifiers
+// and transport protocol in the publish context, and returns the path of its device.
+// The transport protocol is saved on the node, so that the volume is disconnected with it.
+func (s *service) connectVolume(ctx context.Context, id, symID, volumeWWN string, publishContext map[string]string) (string, error) {
+	targetIdentifiers := publishContext[PortIdentifiers]
+	transportProtocol := publishContext[PublishContextTransportProtocol]
+	iscsiChroot, _ := csictx.LookupEnv(context.Background(), EnvISCSIChroot)
+	if isNVMeTransportProtocol(transportProtocol) {
+		s.initNVMeConnector(iscsiChroot)
+		if err := s.writeTransportProtocolFile(id, transportProtocol); err != nil {
+			log.Error(err.Error())
+		}
+		return s.connectNVMeDevice(ctx, volumeWWN, parseNVMeTargets(targetIdentifiers),
+			transportProtocol == NvmeFCTransportProtocol)
+	}
+
 	publishContextData := publishContextData{
 		deviceWWN:        "0x" + volumeWWN,
-		volumeLUNAddress: volumeLUNAddress,
+		volumeLUNAddress: publishContext[PublishContextLUNAddress],
 	}
 	iscsiTargets, fcTargets, useFC := s.getArrayTargets(targetIdentifiers, symID)
-	iscsiChroot, _ := csictx.LookupEnv(context.Background(), EnvISCSIChroot)
 	if useFC {
 		s.initFCConnector(iscsiChroot)
 		publishContextData.fcTargets = fcTargets
+		transportProtocol = FcTransportProtocol
 	} else {
 		s.initISCSIConnector(iscsiChroot)
 		publishContextData.iscsiTargets = iscsiTargets
+		transportProtocol = IscsiTransportProtocol
 	}
-	devicePath, err := s.connectDevice(ctx, publishContextData, useFC)
-	if err != nil {
-		return nil, err
+	if err := s.writeTransportProtocolFile(id, transportProtocol); err != nil {
+		log.Error(err.Error())
 	}
-
-	log.WithFields(f).WithField("devPath", devicePath).Info("NodeStageVolume completed")
-	return &csi.NodeStageVolumeResponse{}, nil
+	return s.connectDevice(ctx, publishContextData, useFC)
 }
 
 type publishContextData struct {
@@ -188,12 +218,51 @@ func (s *service) connectDevice(ctx context.Context, data publishContextData, us
 	return devicePath, nil
 }
 
+// connectNVMeDevice connects the NVMe namespace of a volume and returns its device path
+func (s *service) connectNVMeDevice(ctx context.Context, volumeWWN string, targets []NVMeTargetInfo, useFC bool) (string, error) {
+	logFields := getLogFields(ctx)
+	// separate context to prevent 15 seconds cancel from kubernetes
+	connectorCtx, cFunc := context.WithTimeout(context.Background(), time.Second*120)
+	defer cFunc()
+	connectorCtx = setLogFields(connectorCtx, logFields)
+	device, err := s.nvmeConnector.ConnectVolume(connectorCtx, NVMeVolumeInfo{
+		Targets: targets,
+		WWN:     volumeWWN,
+	}, useFC)
+	if err != nil {
+		log.Errorf("Unable to find NVMe namespace after connecting to the targets: %s", err.Error())
+		return "", status.Errorf(codes.Internal,
+			"Unable to find NVMe namespace after connecting to the targets: %s", err.Error())
+	}
+	return path.Join(nvmeDevDir, device.Name), nil
+}
+
+// nvmeWWNToDevicePath returns the device path of the NVMe namespace of a volume.
+// There are no WWN symlinks for NVMe namespaces, so the device path is returned
+// in place of the symlink path.
+func (s *service) nvmeWWNToDevicePath(ctx context.Context, volumeWWN string) (string, string, error) {
+	iscsiChroot, _ := csictx.LookupEnv(context.Background(), EnvISCSIChroot)
+	s.initNVMeConnector(iscsiChroot)
+	device, err := s.nvmeConnector.GetDeviceByNGUID(ctx, volumeWWN)
+	if err != nil {
+		return "", "", err
+	}
+	devicePath := path.Join(nvmeDevDir, device.Name)
+	return devicePath, devicePath, nil
+}
+
 func (s *service) connectISCSIDevice(ctx context.Context,
 	lun int, data publishContextData) (gobrick.Device, error) {
 	logFields := getLogFields(ctx)
 	var targets []gobrick.ISCSITargetInfo
+	var chapTargets []goiscsi.ISCSITarget
 	for _, t := range data.iscsiTargets {
 		targets = append(targets, gobrick.ISCSITargetInfo{Target: t.Target, Portal: t.Portal})
+		chapTargets = append(chapTargets, goiscsi.ISCSITarget{Target: t.Target, Portal: t.Portal})
+	}
+	// gobrick logs in using the credentials stored in the node records
+	if err := s.setSessionCHAPForTargets(chapTargets); err != nil {
+		return gobrick.Device{}, err
 	}
 	// separate context to prevent 15 seconds cancel from kubernetes
 	connectorCtx, cFunc := context.WithTimeout(context.Background(), time.Second*120)
@@ -291,7 +360,7 @@ func (s *service) NodeUnstageVolume(
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	if err := s.disconnectVolume(reqID, symID, devID, volumeWWN); err != nil {
+	if err := s.disconnectVolume(reqID, symID, devID, volumeWWN, s.readTransportProtocolFile(id)); err != nil {
 		return nil, err
 	}
 
@@ -302,13 +371,26 @@ func (s *service) NodeUnstageVolume(
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	s.removeWWNFile(id)
+	s.removeTransportProtocolFile(id)
+	s.removeMultiWriterMountFile(id)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 // disconnectVolume disconnects a volume from a node and will verify it is disonnected
-// by no more /dev/disk/by-id entry, retrying if necessary.
-func (s *service) disconnectVolume(reqID, symID, devID, volumeWWN string) error {
+// by no more /dev/disk/by-id entry, retrying if necessary. The volume is disconnected
+// with the transport protocol it was connected with, or with the one selected for the
+// array if it is not known.
+func (s *service) disconnectVolume(reqID, symID, devID, volumeWWN, transportProtocol string) error {
+	if transportProtocol == "" {
+		transportProtocol = s.arrayTransportProtocolMap[symID]
+	}
+	// NVMe namespaces are looked up by NGUID rather than by WWN
+	if s.nvmeConnector != nil {
+		if device, err := s.nvmeConnector.GetDeviceByNGUID(context.Background(), volumeWWN); err == nil {
+			return s.disconnectNVMeVolume(reqID, symID, devID, volumeWWN, device.Name)
+		}
+	}
 	for i := 0; i < 3; i++ {
 		var deviceName string
 		symlinkPath, devicePath, _ := gofsutil.WWNToDevicePathX(context.Background(), volumeWWN)
@@ -334,10 +416,13 @@ func (s *service) disconnectVolume(reqID, symID, devID, volumeWWN string) error
 		// Disconnect the volume using device name
 		nodeUnstageCtx, cancel := context.WithTimeout(context.Background(), time.Second*120)
 		nodeUnstageCtx = setLogFields(nodeUnstageCtx, f)
-		switch s.arrayTransportProtocolMap[symID] {
+		iscsiChroot, _ := csictx.LookupEnv(context.Background(), EnvISCSIChroot)
+		switch transportProtocol {
 		case FcTransportProtocol:
+			s.initFCConnector(iscsiChroot)
 			s.fcConnector.DisconnectVolumeByDeviceName(nodeUnstageCtx, deviceName)
 		case IscsiTransportProtocol:
+			s.initISCSIConnector(iscsiChroot)
 			s.iscsiConnector.DisconnectVolumeByDeviceName(nodeUnstageCtx, deviceName)
 		}
 		cancel()
@@ -358,6 +443,27 @@ func (s *service) disconnectVolume(reqID, symID, devID, volumeWWN string) error
 	return status.Errorf(codes.Internal, "disconnectVolume exceeded retry limit WWN %s devPath %s", volumeWWN, devPath)
 }
 
+// disconnectNVMeVolume flushes the NVMe namespace of a volume and disconnects from
+// the subsystem if no other namespaces are in use. The namespace itself is removed
+// by the array when the volume is unmapped, so it is not expected to disappear here.
+func (s *service) disconnectNVMeVolume(reqID, symID, devID, volumeWWN, deviceName string) error {
+	f := log.Fields{
+		"CSIRequestID": reqID,
+		"DeviceID":     devID,
+		"DeviceName":   deviceName,
+		"SymmetrixID":  symID,
+		"WWN":          volumeWWN,
+	}
+	log.WithFields(f).Info("NodeUnstageVolume disconnectNVMeVolume")
+	nodeUnstageCtx, cancel := context.WithTimeout(context.Background(), time.Second*120)
+	defer cancel()
+	nodeUnstageCtx = setLogFields(nodeUnstageCtx, f)
+	if err := s.nvmeConnector.DisconnectVolumeByDeviceName(nodeUnstageCtx, deviceName); err != nil {
+		return status.Errorf(codes.Internal, "disconnectVolume failed for WWN %s device %s: %s", volumeWWN, deviceName, err.Error())
+	}
+	return nil
+}
+
 // NodePublish volume handles the CSI request to publish a volume to a target directory.
 func (s *service) NodePublishVolume(
 	ctx context.Context,
@@ -411,7 +517,11 @@ func (s *service) NodePublishVolume(
 
 	var symlinkPath string
 	var devicePath string
-	symlinkPath, devicePath, err = gofsutil.WWNToDevicePathX(context.Background(), deviceWWN)
+	if isNVMeTransportProtocol(publishContext[PublishContextTransportProtocol]) {
+		symlinkPath, devicePath, err = s.nvmeWWNToDevicePath(ctx, deviceWWN)
+	} else {
+		symlinkPath, devicePath, err = gofsutil.WWNToDevicePathX(context.Background(), deviceWWN)
+	}
 	if err != nil || symlinkPath == "" {
 		errmsg := fmt.Sprintf("Device path not found for WWN %s: %s", deviceWWN, err)
 		log.Error(errmsg)
@@ -432,8 +542,14 @@ func (s *service) NodePublishVolume(
 		"TargetIdentifiers": targetIdentifiers,
 	}
 
+	clusterFsTypes := s.multiWriterMountFsTypes(volumeContext)
+	if clusterFsTypes != nil {
+		if err := s.writeMultiWriterMountFile(req.GetVolumeId()); err != nil {
+			return nil, err
+		}
+	}
 	log.WithFields(f).Info("Calling publishVolume")
-	if err := publishVolume(req, s.privDir, symlinkPath, reqID); err != nil {
+	if err := publishVolume(req, s.privDir, symlinkPath, reqID, clusterFsTypes); err != nil {
 		return nil, err
 	}
 	return &csi.NodePublishVolumeResponse{}, nil
@@ -505,7 +621,7 @@ func (s *service) NodeUnpublishVolume(
 
 	log.WithFields(f).Info("Calling unpublishVolume")
 	var lastUnmounted bool
-	if lastUnmounted, err = unpublishVolume(req, s.privDir, devicePath, reqID); err != nil {
+	if lastUnmounted, err = unpublishVolume(req, s.privDir, devicePath, reqID, s.unpublishMultiWriterMountFsTypes(id)); err != nil {
 		return nil, err
 	}
 
@@ -572,12 +688,25 @@ func (s *service) nodeProbe(ctx context.Context) error {
 	}
 
 	// make sure we are logged into all arrays
-	if s.nodeIsInitialized {
-		// nothing to do for FC
-		if s.opts.TransportProtocol != FcTransportProtocol {
+	if s.isNodeInitialized() {
+		// nothing to do for FC, unless some arrays are configured individually
+		if s.opts.TransportProtocol != FcTransportProtocol || s.arrayConfig != nil {
 			_ = s.ensureLoggedIntoEveryArray(false)
 		}
 	}
+	if counts := s.getISCSISessionCounts(); len(counts) > 0 {
+		fields := log.Fields{}
+		for array, count := range counts {
+			fields[array] = count
+			if count == 0 {
+				log.Warningf("There are no iSCSI sessions to array %s", array)
+			}
+		}
+		log.WithFields(fields).Info("iSCSI sessions per array, published as powermax_iscsi_sessions")
+	}
+	if removed := staleDeviceMetrics.Value(); removed > 0 {
+		log.Infof("Stale devices removed from the node: %d", removed)
+	}
 	return nil
 }
 
@@ -619,6 +748,20 @@ func (s *service) NodeGetVolumeStats(
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
+// isNodeInitialized returns true once nodeHostSetup has set up the node on the arrays
+func (s *service) isNodeInitialized() bool {
+	s.nodeIsInitializedMutex.Lock()
+	defer s.nodeIsInitializedMutex.Unlock()
+	return s.nodeIsInitialized
+}
+
+// setNodeInitialized records that nodeHostSetup has set up the node on the arrays
+func (s *service) setNodeInitialized() {
+	s.nodeIsInitializedMutex.Lock()
+	defer s.nodeIsInitializedMutex.Unlock()
+	s.nodeIsInitialized = true
+}
+
 // nodeStartup performs a few necessary functions for the nodes to function properly
 // - validates that at least one iSCSI initiator is defined
 // - validates that a connection to Unisphere exists
@@ -627,7 +770,7 @@ func (s *service) NodeGetVolumeStats(
 // returns an error if unable to perform node startup tasks without error
 func (s *service) nodeStartup() error {
 
-	if s.nodeIsInitialized {
+	if s.isNodeInitialized() {
 		return nil
 	}
 	// Maximum number of pending requests before overload returned
@@ -644,6 +787,7 @@ func (s *service) nodeStartup() error {
 
 	portWWNs := make([]string, 0)
 	IQNs := make([]string, 0)
+	NQNs := make([]string, 0)
 	var err error
 
 	// Get fibrechannel initiators
@@ -658,10 +802,18 @@ func (s *service) nodeStartup() error {
 		log.Error("nodeStartup could not GetInitiatorIQNs")
 	}
 
-	log.Infof("TransportProtocol %s FC portWWNs: %s ... IQNs: %s\n", s.opts.TransportProtocol, portWWNs, IQNs)
-	// The driver needs at least one FC or iSCSI initiator to be defined
-	if len(portWWNs) == 0 && len(IQNs) == 0 {
-		return fmt.Errorf("No FC or iSCSI initiators were found and at least 1 is required")
+	// Get the NVMe host NQN, which is optional
+	iscsiChroot, _ := csictx.LookupEnv(context.Background(), EnvISCSIChroot)
+	s.initNVMeConnector(iscsiChroot)
+	NQNs, err = s.nvmeConnector.GetInitiatorName(context.Background())
+	if err != nil {
+		log.Infof("nodeStartup could not get the NVMe host NQN: %s", err.Error())
+	}
+
+	log.Infof("TransportProtocol %s FC portWWNs: %s ... IQNs: %s ... NQNs: %s\n", s.opts.TransportProtocol, portWWNs, IQNs, NQNs)
+	// The driver needs at least one FC, iSCSI or NVMe initiator to be defined
+	if len(portWWNs) == 0 && len(IQNs) == 0 && len(NQNs) == 0 {
+		return fmt.Errorf("No FC, iSCSI or NVMe initiators were found and at least 1 is required")
 	}
 
 	arrays, err := s.retryableGetSymmetrixIDList()
@@ -672,11 +824,131 @@ func (s *service) nodeStartup() error {
 	symmetrixIDs := arrays.SymmetrixIDs
 	log.Debug(fmt.Sprintf("GetSymmetrixIDList returned: %v", symmetrixIDs))
 
-	go s.nodeHostSetup(portWWNs, IQNs, symmetrixIDs)
+	// The hosts are adopted before they are set up
+	if s.opts.InitiatorConflictPolicy == InitiatorConflictAdopt {
+		nodeInitiators := append(append(append([]string{}, portWWNs...), IQNs...), NQNs...)
+		s.adoptHostsOfInitiators(symmetrixIDs, nodeInitiators)
+	}
+
+	go func() {
+		s.nodeHostSetup(portWWNs, IQNs, NQNs, symmetrixIDs)
+		if s.isNodeInitialized() {
+			s.reconcileStagedVolumes()
+		}
+	}()
+	s.startStaleDeviceCollector()
 
 	return err
 }
 
+// reconcileStagedVolumes reconnects the devices of the volumes staged on the node, using
+// the WWN files in privDir. After a reboot the WWN files remain but the devices are gone,
+// and kubelet may call NodePublishVolume without staging the volume again.
+// The WWN files of volumes which no longer exist on the array are removed.
+func (s *service) reconcileStagedVolumes() {
+	files, err := ioutil.ReadDir(s.privDir)
+	if err != nil {
+		log.Errorf("Unable to read the staged volumes in %s: %s", s.privDir, err.Error())
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".wwn") {
+			continue
+		}
+		id := strings.TrimSuffix(file.Name(), ".wwn")
+		if err := s.reconcileStagedVolume(id); err != nil {
+			log.Errorf("Unable to reconnect staged volume %s: %s", id, err.Error())
+		}
+	}
+}
+
+// reconcileStagedVolume reconnects the device of a staged volume if it is not present
+func (s *service) reconcileStagedVolume(id string) error {
+	var volID volumeIDType = volumeIDType(id)
+	if err := volID.checkAndUpdatePendingState(&nodePendingState); err != nil {
+		return err
+	}
+	defer volID.clearPending(&nodePendingState)
+
+	volumeWWN, err := s.readWWNFile(id)
+	if err != nil {
+		return err
+	}
+	symID, devID, vol, err := s.GetVolumeByID(id)
+	if err != nil {
+		if strings.Contains(err.Error(), notFound) || strings.Contains(err.Error(), failedToValidateVolumeNameAndID) {
+			log.Infof("Staged volume %s no longer exists on the array, removing its WWN file", id)
+			s.removeWWNFile(id)
+			s.removeTransportProtocolFile(id)
+			s.removeMultiWriterMountFile(id)
+			return nil
+		}
+		return err
+	}
+	if !strings.EqualFold(vol.WWN, volumeWWN) {
+		log.Infof("Staged volume %s has WWN %s on the array but %s on the node, removing its WWN file", id, vol.WWN, volumeWWN)
+		s.removeWWNFile(id)
+		s.removeTransportProtocolFile(id)
+		s.removeMultiWriterMountFile(id)
+		return nil
+	}
+
+	f := log.Fields{
+		"DeviceID":    devID,
+		"ID":          id,
+		"SymmetrixID": symID,
+		"WWN":         volumeWWN,
+	}
+	ctx := setLogFields(context.Background(), f)
+	if _, devicePath, _ := gofsutil.WWNToDevicePathX(ctx, volumeWWN); devicePath != "" {
+		log.WithFields(f).Debug("Staged volume is connected")
+		return nil
+	}
+	if s.nvmeConnector != nil {
+		if _, err := s.nvmeConnector.GetDeviceByNGUID(ctx, volumeWWN); err == nil {
+			log.WithFields(f).Debug("Staged volume is connected")
+			return nil
+		}
+	}
+
+	// The volume may have been published with a protocol other than the one
+	// selected for the array, so the masking views of all protocols are checked
+	s.mutex.Lock()
+	order := []string{s.arrayTransportProtocolMap[symID]}
+	s.mutex.Unlock()
+	for _, tp := range allTransportProtocols {
+		order = appendIfMissing(order, tp)
+	}
+	var publishContext map[string]string
+	for _, tp := range order {
+		if tp == "" {
+			continue
+		}
+		_, _, maskingViewID := s.GetHostSGAndMVIDFromNodeID(s.getHostNodeName(), tp)
+		if _, err := s.adminClient.GetMaskingViewByID(symID, maskingViewID); err != nil {
+			continue
+		}
+		resp, err := s.updatePublishContext(make(map[string]string), symID, maskingViewID, devID)
+		if err == nil {
+			publishContext = resp.PublishContext
+			break
+		}
+	}
+	if publishContext == nil {
+		// NodeUnstageVolume will remove the WWN file
+		log.WithFields(f).Warning("Staged volume is not published to the node, not reconnecting it")
+		return nil
+	}
+
+	log.WithFields(f).Info("Reconnecting staged volume")
+	devicePath, err := s.connectVolume(ctx, id, symID, volumeWWN, publishContext)
+	if err != nil {
+		return err
+	}
+	log.WithFields(f).WithField("devPath", devicePath).Info("Reconnected staged volume")
+	return nil
+}
+
 // verifyInitiatorsNotInADiffernetHost verifies that a set of node initiators are not in a different host than expected.
 // These can be either FC initiators (hex numbers) or iSCSI initiators (starting with iqn.)
 // It returns the number of initiators for the host that were found.
@@ -689,11 +961,8 @@ func (s *service) verifyInitiatorsNotInADifferentHost(symID string, nodeInitiato
 	}
 	var nValidInitiators int
 	for _, nodeInitiator := range nodeInitiators {
-		if strings.HasPrefix(nodeInitiator, "0x") {
-			nodeInitiator = strings.Replace(nodeInitiator, "0x", "", 1)
-		}
 		for _, initiatorID := range initList.InitiatorIDs {
-			if initiatorID == nodeInitiator || strings.HasSuffix(initiatorID, nodeInitiator) {
+			if matchesNodeInitiator(initiatorID, nodeInitiator) {
 				log.Infof("Checking initiator %s against host %s\n", initiatorID, hostID)
 				initiator, err := s.adminClient.GetInitiatorByID(symID, initiatorID)
 				if err != nil {
@@ -701,10 +970,9 @@ func (s *service) verifyInitiatorsNotInADifferentHost(symID string, nodeInitiato
 					continue
 				}
 				if (initiator.HostID != "") && (initiator.HostID != hostID) {
-					errormsg := fmt.Sprintf("initiator: %s is already a part of a different host: %s on: %s",
-						initiatorID, initiator.HostID, symID)
-					log.Error(errormsg)
-					return 0, fmt.Errorf(errormsg)
+					if err := s.resolveInitiatorConflict(symID, initiatorID, nodeInitiator, initiator.HostID, hostID); err != nil {
+						return 0, err
+					}
 				}
 				log.Infof("valid initiator: %s\n", initiatorID)
 				nValidInitiators++
@@ -721,7 +989,9 @@ func (s *service) verifyInitiatorsNotInADifferentHost(symID string, nodeInitiato
 // - a Host exists within PowerMax, to identify this node
 // - The Host contains the discovered iSCSI initiators
 // - performs an iSCSI login
-func (s *service) nodeHostSetup(portWWNs []string, IQNs []string, symmetrixIDs []string) error {
+// For NVMe/TCP and NVMe/FC:
+// - a Host exists within PowerMax, containing the NQN of this node
+func (s *service) nodeHostSetup(portWWNs []string, IQNs []string, NQNs []string, symmetrixIDs []string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	log.Info("**************************\nnodeHostSetup executing...\n*******************************")
@@ -737,57 +1007,134 @@ func (s *service) nodeHostSetup(portWWNs []string, IQNs []string, symmetrixIDs [
 	time.Sleep(time.Duration(period) * time.Second)
 
 	// See if it's viable to use FC and/or ISCSI
-	hostIDIscsi, _, _ := s.GetISCSIHostSGAndMVIDFromNodeID(s.opts.NodeName)
-	hostIDFC, _, _ := s.GetFCHostSGAndMVIDFromNodeID(s.opts.NodeName)
-	var useFC bool
-	var useIscsi bool
+	hostIDIscsi, _, _ := s.GetISCSIHostSGAndMVIDFromNodeID(s.getHostNodeName())
+	hostIDFC, _, _ := s.GetFCHostSGAndMVIDFromNodeID(s.getHostNodeName())
+	hostIDNVMeTCP, _, _ := s.GetNVMeTCPHostSGAndMVIDFromNodeID(s.getHostNodeName())
+	hostIDNVMeFC, _, _ := s.GetNVMeFCHostSGAndMVIDFromNodeID(s.getHostNodeName())
+	if s.arrayTransportProtocolMap == nil {
+		s.arrayTransportProtocolMap = make(map[string]string)
+	}
+	iscsiChroot, _ := csictx.LookupEnv(context.Background(), EnvISCSIChroot)
+	var err error
+	nArraysSetup := 0
 
-	// Loop through the symmetrix, looking for existing initiators
+	// Loop through the symmetrix, looking for existing initiators.
+	// The transport protocol is chosen separately for each array, based on
+	// the initiators of this node which can be used with that array.
 	for _, symID := range symmetrixIDs {
-		validFC, err := s.verifyInitiatorsNotInADifferentHost(symID, portWWNs, hostIDFC)
+		var useFC bool
+		var useIscsi bool
+		var validFC, validIscsi int
+		validFC, err = s.verifyInitiatorsNotInADifferentHost(symID, portWWNs, hostIDFC)
 		if err != nil {
 			log.Error("Could not validate FC initiators" + err.Error())
 		}
 		log.Infof("valid FC initiators: %d\n", validFC)
-		if validFC > 0 && (s.opts.TransportProtocol == "" || s.opts.TransportProtocol == FcTransportProtocol) {
+		if validFC > 0 {
 			// We do have to have pre-existing initiators that were zoned for FC
 			useFC = true
 		}
-		validIscsi, err := s.verifyInitiatorsNotInADifferentHost(symID, IQNs, hostIDIscsi)
+		validIscsi, err = s.verifyInitiatorsNotInADifferentHost(symID, IQNs, hostIDIscsi)
 		if err != nil {
 			log.Error("Could not validate iSCSI initiators" + err.Error())
-		} else if s.opts.TransportProtocol == "" || s.opts.TransportProtocol == IscsiTransportProtocol {
+		} else if len(IQNs) > 0 {
 			// We do not have to have pre-existing initiators to use Iscsi (we can create them)
 			useIscsi = true
 		}
 		log.Infof("valid (existing) iSCSI initiators (must be manually created): %d\n", validIscsi)
 
-		if !useFC && !useIscsi {
-			log.Error("No valid initiators- could not initialize FC or iSCSI")
-			return err
+		// NVMe initiators are only checked if NVMe may be used with the array
+		usable := make([]string, 0)
+		for _, tp := range s.getTransportProtocolOrder(symID) {
+			switch tp {
+			case FcTransportProtocol:
+				if useFC {
+					usable = append(usable, tp)
+				}
+			case IscsiTransportProtocol:
+				if useIscsi {
+					usable = append(usable, tp)
+				}
+			case NvmeTCPTransportProtocol:
+				// We do not have to have pre-existing initiators to use NVMe/TCP (we can create them)
+				if _, err = s.verifyInitiatorsNotInADifferentHost(symID, NQNs, hostIDNVMeTCP); err != nil {
+					log.Error("Could not validate NVMe/TCP initiators" + err.Error())
+				} else if len(NQNs) > 0 {
+					usable = append(usable, tp)
+				}
+			case NvmeFCTransportProtocol:
+				// We do have to have pre-existing initiators that were zoned for NVMe/FC
+				validNVMeFC, err := s.verifyInitiatorsNotInADifferentHost(symID, NQNs, hostIDNVMeFC)
+				if err != nil {
+					log.Error("Could not validate NVMe/FC initiators" + err.Error())
+				} else if validNVMeFC > 0 {
+					usable = append(usable, tp)
+				}
+			}
 		}
-
-		if s.arrayTransportProtocolMap == nil {
-			s.arrayTransportProtocolMap = make(map[string]string)
+		log.Infof("usable transport protocols for array %s: %v\n", symID, usable)
+
+		// The first usable protocol, in order of preference, which can be set up is used.
+		// If a preference of several protocols is configured, the hosts of the other usable
+		// protocols are set up as well, so that the controller can fall back to them if it
+		// cannot create the masking view of the selected one.
+		// If none can be set up, the first usable one is still used, as the
+		// host may be fixed up on the array later.
+		if len(usable) == 0 {
+			log.Errorf("No valid initiators- could not initialize FC or iSCSI for array %s", symID)
+			continue
 		}
-		iscsiChroot, _ := csictx.LookupEnv(context.Background(), EnvISCSIChroot)
-		if useFC {
-			s.setupArrayForFC(symID, portWWNs)
+		setupAlternates := s.hasTransportProtocolPreference(symID)
+		selected := ""
+		for _, tp := range usable {
+			if selected != "" && !setupAlternates {
+				break
+			}
+			var setupErr error
+			switch tp {
+			case FcTransportProtocol:
+				setupErr = s.setupArrayForFC(symID, portWWNs)
+			case IscsiTransportProtocol:
+				setupErr = s.setupArrayForIscsi(symID, IQNs)
+			default:
+				setupErr = s.setupArrayForNVMe(symID, NQNs, tp)
+			}
+			if setupErr != nil {
+				log.Errorf("Failed to set up array %s for %s: %s", symID, tp, setupErr.Error())
+				continue
+			}
+			if selected == "" {
+				selected = tp
+			}
+		}
+		if selected == "" {
+			selected = usable[0]
+		}
+		switch selected {
+		case FcTransportProtocol:
 			s.initFCConnector(iscsiChroot)
-			s.arrayTransportProtocolMap[symID] = FcTransportProtocol
-		} else if useIscsi {
-			s.setupArrayForIscsi(symID, IQNs)
+		case IscsiTransportProtocol:
 			s.initISCSIConnector(iscsiChroot)
-			s.arrayTransportProtocolMap[symID] = IscsiTransportProtocol
+			s.startISCSISessionMonitor()
+		default:
+			s.initNVMeConnector(iscsiChroot)
 		}
+		log.Infof("Using transport protocol %s for array %s", selected, symID)
+		s.arrayTransportProtocolMap[symID] = selected
+		nArraysSetup++
 	}
 
-	s.nodeIsInitialized = true
+	if nArraysSetup == 0 && len(symmetrixIDs) > 0 {
+		log.Error("No valid initiators- could not initialize FC or iSCSI")
+		return err
+	}
+
+	s.setNodeInitialized()
 	return nil
 }
 
 func (s *service) setupArrayForFC(array string, portWWNs []string) error {
-	hostName, _, mvName := s.GetFCHostSGAndMVIDFromNodeID(s.opts.NodeName)
+	hostName, _, mvName := s.GetFCHostSGAndMVIDFromNodeID(s.getHostNodeName())
 	log.Infof("setting up array %s for Fibrechannel, host name: %s masking view: %s", array, hostName, mvName)
 
 	_, err := s.createOrUpdateFCHost(array, hostName, portWWNs)
@@ -796,7 +1143,7 @@ func (s *service) setupArrayForFC(array string, portWWNs []string) error {
 
 // setupArrayForIscsi is called to set up a node for iscsi operation.
 func (s *service) setupArrayForIscsi(array string, IQNs []string) error {
-	hostName, _, mvName := s.GetISCSIHostSGAndMVIDFromNodeID(s.opts.NodeName)
+	hostName, _, mvName := s.GetISCSIHostSGAndMVIDFromNodeID(s.getHostNodeName())
 	log.Infof("setting up array %s for Iscsi, host name: %s masking view ID: %s", array, hostName, mvName)
 
 	// Create or update the IscsiHost and Initiators
@@ -821,13 +1168,25 @@ func (s *service) setupArrayForIscsi(array string, IQNs []string) error {
 		for _, tgt := range targets {
 			// discover the targets but do not login
 			log.Debugf("Discovering iSCSI targets on %s", tgt.Portal)
-			_, err = s.iscsiClient.DiscoverTargets(tgt.Portal, true)
-			s.iscsiClient.DiscoverTargets(tgt.Portal, false)
+			_, err = s.discoverTargets(tgt.Portal, true)
+			s.discoverTargets(tgt.Portal, false)
 		}
 	}
 	return nil
 }
 
+// setupArrayForNVMe is called to set up a node for NVMe/TCP or NVMe/FC operation.
+func (s *service) setupArrayForNVMe(array string, NQNs []string, transportProtocol string) error {
+	hostName, _, mvName := s.GetHostSGAndMVIDFromNodeID(s.getHostNodeName(), transportProtocol)
+	log.Infof("setting up array %s for %s, host name: %s masking view ID: %s", array, transportProtocol, hostName, mvName)
+
+	_, err := s.createOrUpdateNVMeHost(array, hostName, NQNs)
+	if err != nil {
+		log.Error(err.Error())
+	}
+	return err
+}
+
 func (s *service) getIscsiTargetsForMaskingView(array string, view *types.MaskingView) ([]goiscsi.ISCSITarget, error) {
 	if array == "" {
 		return []goiscsi.ISCSITarget{}, fmt.Errorf("No array specified")
@@ -874,6 +1233,10 @@ func (s *service) ensureLoggedIntoEveryArray(skipLogin bool) error {
 
 	// for each array known to unisphere, ensure we have performed an iSCSI login at least once
 	for _, array := range arrays.SymmetrixIDs {
+		if tp := s.getTransportProtocolForArray(array); tp == FcTransportProtocol || isNVMeTransportProtocol(tp) {
+			// nothing to do for arrays which are only used with FC or NVMe
+			continue
+		}
 		deadline := time.Now().Add(time.Duration(s.GetPmaxTimeoutSeconds()) * time.Second)
 		for tries := 0; time.Now().Before(deadline); tries++ {
 			var addresses []string
@@ -887,7 +1250,7 @@ func (s *service) ensureLoggedIntoEveryArray(skipLogin bool) error {
 			}
 			for _, addr := range addresses {
 				if skipLogin == false {
-					_, err = s.iscsiClient.DiscoverTargets(addr, true)
+					_, err = s.discoverTargets(addr, true)
 				} else {
 					log.Debug("Skipping iSCSI login due to user request")
 					err = nil
@@ -1004,6 +1367,43 @@ func (s *service) createOrUpdateIscsiHost(array string, nodeName string, IQNs []
 	return host, nil
 }
 
+func (s *service) createOrUpdateNVMeHost(array string, nodeName string, NQNs []string) (*types.Host, error) {
+	log.Debug(fmt.Sprintf("Processing NVMe Host array: %s, nodeName: %s, initiators: %v", array, nodeName, NQNs))
+	if array == "" {
+		return &types.Host{}, fmt.Errorf("createOrUpdateHost: No array specified")
+	}
+	if nodeName == "" {
+		return &types.Host{}, fmt.Errorf("createOrUpdateHost: No nodeName specified")
+	}
+	if len(NQNs) == 0 {
+		return &types.Host{}, fmt.Errorf("createOrUpdateHost: No NQNs specified")
+	}
+
+	host, err := s.adminClient.GetHostByID(array, nodeName)
+	log.Infof(fmt.Sprintf("GetHostById returned: %v, %v", host, err))
+
+	if err != nil {
+		// host does not exist, create it
+		log.Infof(fmt.Sprintf("NVMe Host %s does not exist. Creating it.", nodeName))
+		host, err = s.retryableCreateHost(array, nodeName, NQNs, nil)
+		if err != nil {
+			return &types.Host{}, fmt.Errorf("Unable to create Host: %v", err)
+		}
+	} else {
+		// Make sure we don't update an FC or iSCSI host
+		hostInitiators := stringSliceRegexMatcher(host.Initiators, "^nqn\\.")
+		// host does exist, update it if necessary
+		if len(hostInitiators) != 0 && !stringSlicesEqual(hostInitiators, NQNs) {
+			log.Infof("updating host: %s initiators to: %s", nodeName, NQNs)
+			if _, err := s.retryableUpdateHostInitiators(array, host, NQNs); err != nil {
+				return host, err
+			}
+		}
+	}
+
+	return host, nil
+}
+
 // retryableCreateHost
 func (s *service) retryableCreateHost(array string, nodeName string, hostInitiators []string, flags *types.HostFlags) (*types.Host, error) {
 	var err error
@@ -1163,3 +1563,30 @@ func (s *service) removeWWNFile(id string) {
 	wwnFileName := fmt.Sprintf("%s/%s.wwn", s.privDir, id)
 	os.Remove(wwnFileName)
 }
+
+// writeTransportProtocolFile saves the transport protocol a volume is connected with on the node
+func (s *service) writeTransportProtocolFile(id, transportProtocol string) error {
+	protocolFileName := fmt.Sprintf("%s/%s.protocol", s.privDir, id)
+	err := ioutil.WriteFile(protocolFileName, []byte(transportProtocol), 0644)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Could not write transport protocol file: %s", protocolFileName)
+	}
+	return nil
+}
+
+// readTransportProtocolFile returns the transport protocol a volume was connected with,
+// or "" if it is not known, e.g. because it was staged by an earlier version of the driver
+func (s *service) readTransportProtocolFile(id string) string {
+	protocolFileName := fmt.Sprintf("%s/%s.protocol", s.privDir, id)
+	protocolBytes, err := ioutil.ReadFile(protocolFileName)
+	if err != nil {
+		return ""
+	}
+	return string(protocolBytes)
+}
+
+// removeTransportProtocolFile removes the transport protocol file from the node local disk
+func (s *service) removeTransportProtocolFile(id string) {
+	protocolFileName := fmt.Sprintf("%s/%s.protocol", s.privDir, id)
+	os.Remove(protocolFileName)
+}
@@ -0,0 +1,324 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dell/gobrick"
+)
+
+const (
+	// nvmeTCPDefaultPort is the transport service ID used for NVMe/TCP connections
+	nvmeTCPDefaultPort = "4420"
+	// nvmeTargetSeparator separates the subsystem NQN from the address of an NVMe/TCP target
+	nvmeTargetSeparator = "@"
+)
+
+var (
+	// nvmeDeviceWaitTime is how long ConnectVolume waits for the namespace to appear
+	nvmeDeviceWaitTime = 30 * time.Second
+	// nvmeDevicePollTime is how often ConnectVolume looks for the namespace
+	nvmeDevicePollTime = 1 * time.Second
+	// nvmeNamespaceRegex matches the block devices of NVMe namespaces, e.g. nvme0n1
+	nvmeNamespaceRegex = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
+	// nvmeControllerRegex matches NVMe controllers, e.g. nvme0
+	nvmeControllerRegex = regexp.MustCompile(`^nvme[0-9]+$`)
+)
+
+// NVMeTargetInfo represents basic information about an NVMe target
+type NVMeTargetInfo struct {
+	// Portal is the IP address of an NVMe/TCP target, or the WWPN of an NVMe/FC target
+	Portal string
+	// Target is the subsystem NQN of an NVMe/TCP target. It is discovered for NVMe/FC.
+	Target string
+}
+
+// NVMeVolumeInfo holds the information needed to connect to an NVMe namespace
+type NVMeVolumeInfo struct {
+	Targets []NVMeTargetInfo
+	// WWN is the WWN of the volume, which the array reports as the NGUID of the namespace
+	WWN string
+}
+
+// formatNVMeTCPTarget returns the publish context identifier of an NVMe/TCP target
+func formatNVMeTCPTarget(nqn, portal string) string {
+	return nqn + nvmeTargetSeparator + portal
+}
+
+// parseNVMeTargets parses the NVMe target identifiers from the publish context.
+// NVMe/TCP targets have the form <subsystem NQN>@<IP address> and
+// NVMe/FC targets are the WWPN of the port prefixed with 0x.
+func parseNVMeTargets(targetIdentifiers string) []NVMeTargetInfo {
+	targets := make([]NVMeTargetInfo, 0)
+	for _, identifier := range strings.Split(targetIdentifiers, ",") {
+		identifier = strings.TrimSpace(identifier)
+		if identifier == "" {
+			continue
+		}
+		if strings.HasPrefix(identifier, "0x") {
+			targets = append(targets, NVMeTargetInfo{Portal: strings.Replace(identifier, "0x", "", 1)})
+			continue
+		}
+		i := strings.LastIndex(identifier, nvmeTargetSeparator)
+		if i < 0 {
+			continue
+		}
+		targets = append(targets, NVMeTargetInfo{Target: identifier[:i], Portal: identifier[i+1:]})
+	}
+	return targets
+}
+
+// normalizeNGUID converts an NGUID or WWN to lower case hex without separators,
+// e.g. eui.6000097000019790004653303030 or 60000970-0001-... to 600009700001...
+func normalizeNGUID(nguid string) string {
+	nguid = strings.ToLower(strings.TrimSpace(nguid))
+	nguid = strings.TrimPrefix(nguid, "0x")
+	nguid = strings.TrimPrefix(nguid, "eui.")
+	return strings.Replace(nguid, "-", "", -1)
+}
+
+// nvmeCLIConnector connects NVMe namespaces using the nvme command line utility
+type nvmeCLIConnector struct {
+	chroot          string
+	sysBlockPath    string
+	hostNQNFile     string
+	fcHostPath      string
+	fcRemotePortDir string
+}
+
+// newNVMeCLIConnector returns an NVMe connector which runs nvme in the chroot directory
+func newNVMeCLIConnector(chroot string) *nvmeCLIConnector {
+	return &nvmeCLIConnector{
+		chroot:          chroot,
+		sysBlockPath:    sysBlock,
+		hostNQNFile:     filepath.Join(chroot, "/etc/nvme/hostnqn"),
+		fcHostPath:      "/sys/class/fc_host",
+		fcRemotePortDir: "/sys/class/fc_remote_ports",
+	}
+}
+
+// run runs the nvme utility with the given arguments
+func (c *nvmeCLIConnector) run(ctx context.Context, args ...string) (string, error) {
+	logger := &customLogger{}
+	name := "nvme"
+	if c.chroot != "" {
+		args = append([]string{c.chroot, name}, args...)
+		name = "chroot"
+	}
+	logger.Debug(ctx, "Executing %s %s", name, strings.Join(args, " "))
+	out, err := execCommand(name, args...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("%s %s failed: %s: %s", name, strings.Join(args, " "), err.Error(), string(out))
+	}
+	return string(out), nil
+}
+
+// GetInitiatorName returns the NQN of the host
+func (c *nvmeCLIConnector) GetInitiatorName(ctx context.Context) ([]string, error) {
+	data, err := ioutil.ReadFile(c.hostNQNFile)
+	if err != nil {
+		return []string{}, err
+	}
+	nqns := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "nqn.") {
+			nqns = append(nqns, line)
+		}
+	}
+	return nqns, nil
+}
+
+// ConnectVolume connects to the NVMe targets and waits for the namespace of the volume to appear
+func (c *nvmeCLIConnector) ConnectVolume(ctx context.Context, info NVMeVolumeInfo, useFC bool) (gobrick.Device, error) {
+	logger := &customLogger{}
+	if len(info.Targets) < 1 {
+		return gobrick.Device{}, fmt.Errorf("No targets specified")
+	}
+	// The namespace may already be visible if another volume is connected through the same targets
+	if device, err := c.GetDeviceByNGUID(ctx, info.WWN); err == nil {
+		return device, nil
+	}
+	connected := 0
+	for _, target := range info.Targets {
+		var err error
+		if useFC {
+			err = c.connectFCTarget(ctx, target)
+		} else {
+			_, err = c.run(ctx, "connect", "-t", "tcp", "-n", target.Target,
+				"-a", target.Portal, "-s", nvmeTCPDefaultPort)
+		}
+		if err != nil && !strings.Contains(err.Error(), "already connected") {
+			logger.Error(ctx, "Failed to connect to NVMe target %s %s: %s", target.Target, target.Portal, err.Error())
+			continue
+		}
+		connected++
+	}
+	if connected == 0 {
+		return gobrick.Device{}, fmt.Errorf("Unable to connect to any of the NVMe targets")
+	}
+	deadline := time.Now().Add(nvmeDeviceWaitTime)
+	for {
+		device, err := c.GetDeviceByNGUID(ctx, info.WWN)
+		if err == nil {
+			logger.Info(ctx, "Found NVMe namespace %s for WWN %s", device.Name, info.WWN)
+			return device, nil
+		}
+		if time.Now().After(deadline) {
+			return gobrick.Device{}, err
+		}
+		select {
+		case <-ctx.Done():
+			return gobrick.Device{}, ctx.Err()
+		case <-time.After(nvmeDevicePollTime):
+		}
+	}
+}
+
+// connectFCTarget connects to all the subsystems behind an NVMe/FC target port
+// through each of the local FC ports
+func (c *nvmeCLIConnector) connectFCTarget(ctx context.Context, target NVMeTargetInfo) error {
+	targetAddress, err := c.getFCAddress(c.fcRemotePortDir, target.Portal)
+	if err != nil {
+		return err
+	}
+	hostAddresses, err := c.getFCHostAddresses()
+	if err != nil {
+		return err
+	}
+	// Connect through every local port which can reach the target, for multipathing
+	var lastErr error
+	connected := false
+	for _, hostAddress := range hostAddresses {
+		if _, err := c.run(ctx, "connect-all", "-t", "fc", "-a", targetAddress, "-w", hostAddress); err != nil {
+			lastErr = err
+			continue
+		}
+		connected = true
+	}
+	if connected {
+		return nil
+	}
+	return lastErr
+}
+
+// getFCAddress returns the NVMe/FC transport address (nn-0x...:pn-0x...) of the port with the WWPN
+func (c *nvmeCLIConnector) getFCAddress(dir, wwpn string) (string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		portName, err := ioutil.ReadFile(filepath.Join(dir, entry.Name(), "port_name"))
+		if err != nil || normalizeNGUID(string(portName)) != normalizeNGUID(wwpn) {
+			continue
+		}
+		nodeName, err := ioutil.ReadFile(filepath.Join(dir, entry.Name(), "node_name"))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("nn-%s:pn-%s", strings.TrimSpace(string(nodeName)), strings.TrimSpace(string(portName))), nil
+	}
+	return "", fmt.Errorf("FC port %s not found", wwpn)
+}
+
+// getFCHostAddresses returns the NVMe/FC transport addresses of the local FC ports
+func (c *nvmeCLIConnector) getFCHostAddresses() ([]string, error) {
+	entries, err := ioutil.ReadDir(c.fcHostPath)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, 0)
+	for _, entry := range entries {
+		portName, err := ioutil.ReadFile(filepath.Join(c.fcHostPath, entry.Name(), "port_name"))
+		if err != nil {
+			continue
+		}
+		address, err := c.getFCAddress(c.fcHostPath, string(portName))
+		if err == nil {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("No FC ports found")
+	}
+	return addresses, nil
+}
+
+// GetDeviceByNGUID returns the block device of the NVMe namespace with the NGUID
+func (c *nvmeCLIConnector) GetDeviceByNGUID(ctx context.Context, nguid string) (gobrick.Device, error) {
+	nguid = normalizeNGUID(nguid)
+	entries, err := ioutil.ReadDir(c.sysBlockPath)
+	if err != nil {
+		return gobrick.Device{}, err
+	}
+	for _, entry := range entries {
+		if !nvmeNamespaceRegex.MatchString(entry.Name()) {
+			continue
+		}
+		for _, attr := range []string{"nguid", "wwid"} {
+			data, err := ioutil.ReadFile(filepath.Join(c.sysBlockPath, entry.Name(), attr))
+			if err != nil {
+				continue
+			}
+			if normalizeNGUID(string(data)) == nguid {
+				return gobrick.Device{Name: entry.Name(), WWN: nguid}, nil
+			}
+		}
+	}
+	return gobrick.Device{}, fmt.Errorf("No NVMe namespace found with NGUID %s", nguid)
+}
+
+// DisconnectVolumeByDeviceName flushes the namespace and disconnects its controllers,
+// unless they have other namespaces
+func (c *nvmeCLIConnector) DisconnectVolumeByDeviceName(ctx context.Context, name string) error {
+	logger := &customLogger{}
+	if _, err := c.run(ctx, "flush", "/dev/"+name); err != nil {
+		logger.Error(ctx, "Failed to flush %s: %s", name, err.Error())
+	}
+	// With native multipath the device of the namespace is the subsystem, holding all
+	// the controllers and namespaces. Otherwise it is the controller.
+	devicePath := filepath.Join(c.sysBlockPath, name, "device")
+	controllers := make([]string, 0)
+	entries, _ := filepath.Glob(filepath.Join(devicePath, "nvme*"))
+	for _, entry := range entries {
+		base := filepath.Base(entry)
+		if nvmeNamespaceRegex.MatchString(base) && base != name {
+			logger.Info(ctx, "Not disconnecting %s, namespace %s is still connected", name, base)
+			return nil
+		}
+		if nvmeControllerRegex.MatchString(base) {
+			controllers = append(controllers, base)
+		}
+	}
+	if len(controllers) == 0 {
+		if target, err := filepath.EvalSymlinks(devicePath); err == nil && nvmeControllerRegex.MatchString(filepath.Base(target)) {
+			controllers = append(controllers, filepath.Base(target))
+		}
+	}
+	for _, controller := range controllers {
+		if _, err := c.run(ctx, "disconnect", "-d", controller); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// orphanMetrics publishes the last orphan report of each array
+var orphanMetrics = expvar.NewMap("powermax_orphans")
+
+// orphanReport lists the objects created by the driver for the cluster on an array
+// which no longer appear to be used
+type orphanReport struct {
+	SymmetrixID string `json:"symmetrixID"`
+	// Volumes are the handles of the volumes which are not known volume handles.
+	// They are never removed, as their PersistentVolume may still be being created.
+	Volumes []string `json:"volumes"`
+	// StorageGroups have no volumes, masking views, parent or child storage groups
+	StorageGroups []string `json:"storageGroups"`
+	// MaskingViews are the masking views of hosts with no initiators
+	MaskingViews []string `json:"maskingViews"`
+	// Hosts have no masking views, e.g. nodes which never published a volume
+	Hosts []string `json:"hosts"`
+	// PortGroups were created by the driver and have no masking views
+	PortGroups []string `json:"portGroups"`
+	// Removed are the storage groups and masking views which were removed
+	Removed []string `json:"removed"`
+}
+
+// String returns the report as JSON, so that it can be published with expvar
+func (r *orphanReport) String() string {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// orphanAuditState records whether the orphan auditor is running, and the storage
+// groups of each array which were empty at its last audit
+type orphanAuditState struct {
+	sync.Mutex
+	started            bool
+	emptyStorageGroups map[string]map[string]bool
+}
+
+// setEmptyStorageGroups records the storage groups found empty by an audit of an array, and
+// returns those which were already empty at the previous audit
+func (st *orphanAuditState) setEmptyStorageGroups(symID string, sgIDs map[string]bool) map[string]bool {
+	st.Lock()
+	defer st.Unlock()
+	if st.emptyStorageGroups == nil {
+		st.emptyStorageGroups = make(map[string]map[string]bool)
+	}
+	previous := st.emptyStorageGroups[symID]
+	st.emptyStorageGroups[symID] = sgIDs
+	stillEmpty := make(map[string]bool)
+	for sgID := range sgIDs {
+		if previous[sgID] {
+			stillEmpty[sgID] = true
+		}
+	}
+	return stillEmpty
+}
+
+// startOrphanAuditor starts a goroutine which periodically reports, and optionally
+// removes, the objects created by the driver which no longer appear to be used.
+// It is only started once.
+func (s *service) startOrphanAuditor() {
+	interval := s.opts.OrphanAuditInterval
+	if interval <= 0 {
+		log.Info("Orphan auditor is disabled")
+		return
+	}
+	s.orphanAudit.Lock()
+	defer s.orphanAudit.Unlock()
+	if s.orphanAudit.started {
+		return
+	}
+	s.orphanAudit.started = true
+	log.Infof("Starting orphan auditor, auditing every %s", interval)
+	go func() {
+		for range time.Tick(interval) {
+			s.runOrphanAudit()
+		}
+	}()
+}
+
+// readKnownVolumes reads the volume handles listed in a file, one per line.
+// Blank lines and lines starting with # are ignored.
+func readKnownVolumes(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	known := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			known[line] = true
+		}
+	}
+	return known, scanner.Err()
+}
+
+// runOrphanAudit audits the arrays the driver is allowed to use, and publishes their reports
+func (s *service) runOrphanAudit() {
+	var knownVolumes map[string]bool
+	if s.opts.KnownVolumesFile != "" {
+		known, err := readKnownVolumes(s.opts.KnownVolumesFile)
+		if err != nil {
+			log.Errorf("Could not read %s, volumes are not audited: %s", s.opts.KnownVolumesFile, err.Error())
+		} else if len(known) == 0 {
+			// an empty list is more likely to be a sidecar which has not run yet than an empty cluster
+			log.Warningf("%s lists no volumes, volumes are not audited", s.opts.KnownVolumesFile)
+		} else {
+			knownVolumes = known
+		}
+	}
+	symIDList, err := s.adminClient.GetSymmetrixIDList()
+	if err != nil || symIDList == nil {
+		log.Errorf("Could not retrieve SymmetrixID list for the orphan audit")
+		return
+	}
+	for _, symID := range symIDList.SymmetrixIDs {
+		if allowed, _ := s.adminClient.IsAllowedArray(symID); !allowed {
+			continue
+		}
+		report, err := s.auditOrphans(symID, knownVolumes, s.opts.OrphanCleanup)
+		if err != nil {
+			log.Errorf("Could not audit the orphans of %s: %s", symID, err.Error())
+			continue
+		}
+		log.WithField("SymmetrixID", symID).Infof("Orphan report: %s", report.String())
+		orphanMetrics.Set(symID, report)
+	}
+}
+
+// auditOrphans inventories the volumes, storage groups, masking views, hosts and port
+// groups carrying the cluster prefix on an array. Volumes are only checked against
+// knownVolumes if it is not nil. If cleanup is set, the empty storage groups and the
+// masking views of hosts with no initiators are removed, as nothing can use them.
+// CreateVolume creates its storage group before it adds the volume to it, without a
+// lock, so a storage group is only removed if it was also empty at the previous audit.
+func (s *service) auditOrphans(symID string, knownVolumes map[string]bool, cleanup bool) (*orphanReport, error) {
+	report := &orphanReport{
+		SymmetrixID:   symID,
+		Volumes:       []string{},
+		StorageGroups: []string{},
+		MaskingViews:  []string{},
+		Hosts:         []string{},
+		PortGroups:    []string{},
+		Removed:       []string{},
+	}
+	reqID := fmt.Sprintf("OrphanAudit%d", time.Now().Nanosecond())
+	prefix := s.getClusterPrefix()
+
+	if knownVolumes != nil {
+		volumePrefix := fmt.Sprintf("%s%s-", CsiVolumePrefix, prefix)
+		volumeIDs, err := s.adminClient.GetVolumeIDList(symID, volumePrefix, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, devID := range volumeIDs {
+			vol, err := s.adminClient.GetVolumeByID(symID, devID)
+			if err != nil {
+				log.Warningf("Could not audit volume %s: %s", devID, err.Error())
+				continue
+			}
+			// volumes marked for deletion, and sources kept for their snapshots, are cleaned up by the driver
+			if !strings.HasPrefix(vol.VolumeIdentifier, volumePrefix) || s.isSourceTaggedToDelete(vol.VolumeIdentifier) {
+				continue
+			}
+			handle := fmt.Sprintf("%s-%s-%s", vol.VolumeIdentifier, symID, devID)
+			if !knownVolumes[handle] {
+				report.Volumes = append(report.Volumes, handle)
+			}
+		}
+	}
+
+	// masking views first, so that the objects they used are audited without them
+	mvList, err := s.adminClient.GetMaskingViewList(symID)
+	if err != nil {
+		return nil, err
+	}
+	for _, mvID := range mvList.MaskingViewIDs {
+		if !strings.HasPrefix(mvID, CsiMVPrefix+prefix+"-") {
+			continue
+		}
+		mv, err := s.adminClient.GetMaskingViewByID(symID, mvID)
+		if err != nil || mv.HostID == "" {
+			continue
+		}
+		if !s.hostHasNoInitiators(symID, mv.HostID) {
+			continue
+		}
+		report.MaskingViews = append(report.MaskingViews, mvID)
+		if !cleanup {
+			continue
+		}
+		// the publish calls lock the storage group of the masking view
+		lockNum := RequestLock(mv.StorageGroupID, reqID)
+		if s.hostHasNoInitiators(symID, mv.HostID) {
+			if err := s.adminClient.DeleteMaskingView(symID, mvID); err != nil {
+				log.Errorf("Could not remove orphan masking view %s: %s", mvID, err.Error())
+			} else {
+				log.Infof("Removed masking view %s of host %s which has no initiators", mvID, mv.HostID)
+				report.Removed = append(report.Removed, mvID)
+			}
+		}
+		ReleaseLock(mv.StorageGroupID, reqID, lockNum)
+	}
+
+	sgList, err := s.adminClient.GetStorageGroupIDList(symID)
+	if err != nil {
+		return nil, err
+	}
+	emptySGs := make(map[string]bool)
+	for _, sgID := range sgList.StorageGroupIDs {
+		if !strings.HasPrefix(sgID, CSIPrefix+"-"+prefix+"-") && !strings.HasPrefix(sgID, CsiNoSrpSGPrefix+prefix+"-") {
+			continue
+		}
+		if s.storageGroupIsEmpty(symID, sgID) {
+			report.StorageGroups = append(report.StorageGroups, sgID)
+			emptySGs[sgID] = true
+		}
+	}
+	stillEmptySGs := s.orphanAudit.setEmptyStorageGroups(symID, emptySGs)
+	for _, sgID := range report.StorageGroups {
+		if !cleanup {
+			continue
+		}
+		if !stillEmptySGs[sgID] {
+			log.Infof("Storage group %s is empty, it is removed if it is still empty at the next audit", sgID)
+			continue
+		}
+		lockNum := RequestLock(sgID, reqID)
+		if s.storageGroupIsEmpty(symID, sgID) {
+			if err := s.adminClient.DeleteStorageGroup(symID, sgID); err != nil {
+				log.Errorf("Could not remove orphan storage group %s: %s", sgID, err.Error())
+			} else {
+				log.Infof("Removed empty storage group %s", sgID)
+				report.Removed = append(report.Removed, sgID)
+			}
+		}
+		ReleaseLock(sgID, reqID, lockNum)
+	}
+
+	hostList, err := s.adminClient.GetHostList(symID)
+	if err != nil {
+		return nil, err
+	}
+	for _, hostID := range hostList.HostIDs {
+		if !strings.HasPrefix(hostID, CsiHostPrefix+prefix+"-") {
+			continue
+		}
+		host, err := s.adminClient.GetHostByID(symID, hostID)
+		if err == nil && host.NumberMaskingViews == 0 {
+			report.Hosts = append(report.Hosts, hostID)
+		}
+	}
+
+	pgList, err := s.adminClient.GetPortGroupList(symID, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, pgID := range pgList.PortGroupIDs {
+		if !strings.HasPrefix(pgID, CSIPrefix+"-"+prefix+"-") || !strings.HasSuffix(pgID, PGSuffix) {
+			continue
+		}
+		pg, err := s.adminClient.GetPortGroupByID(symID, pgID)
+		if err == nil && pg.NumberMaskingViews == 0 {
+			report.PortGroups = append(report.PortGroups, pgID)
+		}
+	}
+	return report, nil
+}
+
+// hostHasNoInitiators returns true if a host exists and has no initiators
+func (s *service) hostHasNoInitiators(symID, hostID string) bool {
+	host, err := s.adminClient.GetHostByID(symID, hostID)
+	return err == nil && host.NumberInitiators == 0 && len(host.Initiators) == 0
+}
+
+// storageGroupIsEmpty returns true if a storage group exists and has no volumes,
+// masking views, parent or child storage groups
+func (s *service) storageGroupIsEmpty(symID, sgID string) bool {
+	sg, err := s.adminClient.GetStorageGroup(symID, sgID)
+	return err == nil && sg.NumOfVolumes == 0 && sg.NumOfMaskingViews == 0 &&
+		sg.NumOfParentSGs == 0 && sg.NumOfChildSGs == 0
+}
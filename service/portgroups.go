@@ -0,0 +1,257 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Port Group selection strategies which can be set using X_CSI_POWERMAX_PORTGROUP_SELECTION
+const (
+	// PortGroupSelectionRandom picks a random port group from the list
+	PortGroupSelectionRandom = "random"
+	// PortGroupSelectionRoundRobin cycles through the port groups of an array in order
+	PortGroupSelectionRoundRobin = "round-robin"
+	// PortGroupSelectionLeastMaskingViews picks the port group used by the fewest masking views
+	PortGroupSelectionLeastMaskingViews = "least-masking-views"
+	// PortGroupSelectionLeastDirectorMaskingViews picks the port group whose directors are
+	// used by the fewest masking views
+	PortGroupSelectionLeastDirectorMaskingViews = "least-director-masking-views"
+)
+
+// PortGroupCacheDuration is how long the port groups of an array are cached for their selection.
+// The masking view counts of the cache are kept up to date with the port groups it selects.
+const PortGroupCacheDuration = 5 * time.Minute
+
+// portGroupInfo holds the details of a port group used to select port groups
+type portGroupInfo struct {
+	directors    []string
+	maskingViews int64
+}
+
+// pgRoundRobin holds the index of the next port group to be handed out for each array
+var pgRoundRobin = struct {
+	sync.Mutex
+	next map[string]int
+}{next: make(map[string]int)}
+
+// getPortGroupSelection validates the port group selection strategy
+// An empty or invalid value selects the random strategy
+func getPortGroupSelection(value string) string {
+	strategy := strings.ToLower(strings.TrimSpace(value))
+	switch strategy {
+	case PortGroupSelectionRandom, PortGroupSelectionRoundRobin,
+		PortGroupSelectionLeastMaskingViews, PortGroupSelectionLeastDirectorMaskingViews:
+		return strategy
+	case "":
+		return PortGroupSelectionRandom
+	default:
+		log.Errorf("Invalid port group selection: %s, valid values are %s, %s, %s or %s. Using %s",
+			value, PortGroupSelectionRandom, PortGroupSelectionRoundRobin,
+			PortGroupSelectionLeastMaskingViews, PortGroupSelectionLeastDirectorMaskingViews, PortGroupSelectionRandom)
+		return PortGroupSelectionRandom
+	}
+}
+
+// parseArrayPortGroups parses a list of per array port groups
+// of the form "SYMID1:pg1,pg2;SYMID2:pg3"
+func (s *service) parseArrayPortGroups(values string) (map[string][]string, error) {
+	results := make(map[string][]string)
+	for _, entry := range strings.Split(values, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("port group entry %s is not of the form SYMID:pg1,pg2", entry)
+		}
+		symID := strings.TrimSpace(parts[0])
+		portGroups, _ := s.parseCommaSeperatedList(parts[1])
+		if symID == "" || len(portGroups) == 0 {
+			return nil, fmt.Errorf("port group entry %s is not of the form SYMID:pg1,pg2", entry)
+		}
+		results[symID] = append(results[symID], portGroups...)
+	}
+	return results, nil
+}
+
+// getPortGroupsForArray returns the port groups configured for an array,
+// from the array configuration file or X_CSI_POWERMAX_ARRAY_PORTGROUPS,
+// falling back to the global list if the array has none of its own
+func (s *service) getPortGroupsForArray(symID string) []string {
+	if config := s.getArrayConfig(symID); config != nil && len(config.PortGroups) > 0 {
+		return config.PortGroups
+	}
+	if portGroups, ok := s.opts.ArrayPortGroups[symID]; ok && len(portGroups) > 0 {
+		return portGroups
+	}
+	return s.opts.PortGroups
+}
+
+// selectPortGroupRoundRobin returns the next port group for the array in round robin order
+func selectPortGroupRoundRobin(symID string, portGroups []string) string {
+	pgRoundRobin.Lock()
+	defer pgRoundRobin.Unlock()
+	n := pgRoundRobin.next[symID] % len(portGroups)
+	pgRoundRobin.next[symID] = n + 1
+	return portGroups[n]
+}
+
+// selectPortGroupWithLowestScore returns the port group with the lowest score.
+// Ties are broken randomly so that concurrent requests don't all land on the same port group.
+// If no port group could be scored, a random port group is returned.
+func selectPortGroupWithLowestScore(portGroups []string, scores map[string]float64) string {
+	candidates := make([]string, 0)
+	lowest := 0.0
+	for _, pg := range portGroups {
+		score, ok := scores[pg]
+		if !ok {
+			continue
+		}
+		if len(candidates) == 0 || score < lowest {
+			candidates = []string{pg}
+			lowest = score
+		} else if score == lowest {
+			candidates = append(candidates, pg)
+		}
+	}
+	if len(candidates) == 0 {
+		log.Warning("Unable to score any of the port groups, selecting one randomly")
+		return portGroups[rand.Int()%len(portGroups)]
+	}
+	return candidates[rand.Int()%len(candidates)]
+}
+
+// getCachedPortGroups returns the details of the iSCSI port groups of an array and of portGroups.
+// They are fetched from the array when they are not cached, or PortGroupCacheDuration after they
+// were fetched. The array is queried without holding s.cacheMutex, and the result is swapped into
+// the cache under it. The caller must hold s.cacheMutex to read or update the returned details.
+func (s *service) getCachedPortGroups(symID string, portGroups []string) map[string]*portGroupInfo {
+	s.cacheMutex.Lock()
+	cache := getPmaxCache(symID)
+	if cache.portGroups != nil && time.Now().Sub(cache.portGroups.second.(time.Time)) < PortGroupCacheDuration {
+		pgInfo := cache.portGroups.first.(map[string]*portGroupInfo)
+		cached := true
+		for _, pg := range portGroups {
+			if pgInfo[pg] == nil {
+				cached = false
+			}
+		}
+		if cached {
+			s.cacheMutex.Unlock()
+			return pgInfo
+		}
+	}
+	s.cacheMutex.Unlock()
+	pgInfo, complete := s.fetchPortGroups(symID, portGroups)
+	// without the other port groups of the array, the directors can't be scored correctly
+	if complete {
+		s.cacheMutex.Lock()
+		getPmaxCache(symID).portGroups = &Pair{first: pgInfo, second: time.Now()}
+		s.cacheMutex.Unlock()
+	}
+	return pgInfo
+}
+
+// fetchPortGroups fetches the details of the iSCSI port groups of an array and of portGroups
+// from the array. It returns false if the list of port groups of the array can't be fetched.
+func (s *service) fetchPortGroups(symID string, portGroups []string) (map[string]*portGroupInfo, bool) {
+	allPortGroups := make([]string, 0)
+	pgList, listErr := s.adminClient.GetPortGroupList(symID, "iscsi")
+	if listErr != nil {
+		log.Errorf("Failed to fetch the list of port groups for %s: %s", symID, listErr.Error())
+	} else {
+		allPortGroups = append(allPortGroups, pgList.PortGroupIDs...)
+	}
+	for _, pg := range portGroups {
+		allPortGroups = appendIfMissing(allPortGroups, pg)
+	}
+	pgInfo := make(map[string]*portGroupInfo)
+	for _, pg := range allPortGroups {
+		portGroup, err := s.adminClient.GetPortGroupByID(symID, pg)
+		if err != nil {
+			log.Errorf("Failed to fetch details for port group %s on %s: %s", pg, symID, err.Error())
+			continue
+		}
+		directors := make([]string, 0)
+		for _, portKey := range portGroup.SymmetrixPortKey {
+			directors = appendIfMissing(directors, portKey.DirectorID)
+		}
+		pgInfo[pg] = &portGroupInfo{directors: directors, maskingViews: portGroup.NumberMaskingViews}
+	}
+	return pgInfo, listErr == nil
+}
+
+// getPortGroupMaskingViewScores returns the number of masking views using each port group
+func getPortGroupMaskingViewScores(symID string, portGroups []string, pgInfo map[string]*portGroupInfo) map[string]float64 {
+	scores := make(map[string]float64)
+	for _, pg := range portGroups {
+		info, ok := pgInfo[pg]
+		if !ok {
+			continue
+		}
+		scores[pg] = float64(info.maskingViews)
+		log.Debugf("Port group %s on %s is used by %d masking views", pg, symID, info.maskingViews)
+	}
+	return scores
+}
+
+// getPortGroupDirectorScores returns the average number of masking views using the directors of
+// each port group. A director is used by the masking views of every iSCSI port group on the array
+// which contains one of its ports. The load of the ports is not known to the driver.
+func getPortGroupDirectorScores(symID string, portGroups []string, pgInfo map[string]*portGroupInfo) map[string]float64 {
+	scores := make(map[string]float64)
+	directorMaskingViews := make(map[string]int64)
+	for _, info := range pgInfo {
+		for _, director := range info.directors {
+			directorMaskingViews[director] += info.maskingViews
+		}
+	}
+	for _, pg := range portGroups {
+		info, ok := pgInfo[pg]
+		if !ok || len(info.directors) == 0 {
+			continue
+		}
+		var maskingViews int64
+		for _, director := range info.directors {
+			maskingViews += directorMaskingViews[director]
+		}
+		scores[pg] = float64(maskingViews) / float64(len(info.directors))
+		log.Debugf("Port group %s on %s has directors %v used by %.2f masking views on average",
+			pg, symID, info.directors, scores[pg])
+	}
+	return scores
+}
+
+// selectPortGroupByScore selects the port group with the lowest score from the cached port
+// groups of an array, and counts the masking view which is created with it in the cache
+func (s *service) selectPortGroupByScore(symID string, portGroups []string,
+	getScores func(string, []string, map[string]*portGroupInfo) map[string]float64) string {
+	pgInfo := s.getCachedPortGroups(symID, portGroups)
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+	pg := selectPortGroupWithLowestScore(portGroups, getScores(symID, portGroups, pgInfo))
+	if info, ok := pgInfo[pg]; ok {
+		info.maskingViews++
+	}
+	return pg
+}
@@ -0,0 +1,50 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+	"time"
+)
+
+// snapshotRetention returns the time until which the sessions of a secure snapshot cannot be
+// terminated, and false if none of its sessions is secure or their retention has expired
+func snapshotRetention(sessions []SnapSession, snapID string, now time.Time) (time.Time, bool) {
+	var lockedUntil time.Time
+	locked := false
+	for _, session := range sessions {
+		if session.Name != snapID || !session.Secured {
+			continue
+		}
+		expiry := timeFromEpoch(session.ProtectionExpireTime)
+		if expiry.After(now) && expiry.After(lockedUntil) {
+			lockedUntil = expiry
+			locked = true
+		}
+	}
+	return lockedUntil, locked
+}
+
+// getSnapshotRetention returns the time until which a secure snapshot on a source volume cannot
+// be terminated, and false if it is not secure or its retention has expired. An error is returned
+// if the snapshots of the volume cannot be read, as the snapshot must then be assumed to be secure.
+func (s *service) getSnapshotRetention(symID, devID, snapID string) (time.Time, bool, error) {
+	srcSessions, _, err := s.GetSnapSessions(symID, devID)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("Could not check the retention of snapshot (%s): %s", snapID, err.Error())
+	}
+	lockedUntil, locked := snapshotRetention(srcSessions, snapID, time.Now())
+	return lockedUntil, locked, nil
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
 
@@ -88,11 +89,25 @@ type Opts struct {
 	SystemName                 string
 	NodeName                   string
 	TransportProtocol          string
+	TransportPreference        []string // order in which transport protocols are tried when none is set
 	Insecure                   bool
 	Thick                      bool
 	AutoProbe                  bool
 	EnableBlock                bool
 	PortGroups                 []string
+	ArrayPortGroups            map[string][]string // port groups for individual arrays, keyed by array SN
+	PortGroupSelection         string              // strategy used to select a port group
+	ArrayConfigPath            string              // path to the per array configuration file
+	ISCSICHAP                  chapCredentials     // CHAP credentials used for iSCSI session login
+	ISCSIDiscoveryCHAP         chapCredentials     // CHAP credentials used for iSCSI discovery
+	ISCSISessionCheckInterval  time.Duration       // how often the iSCSI sessions are checked, 0 to disable
+	MetricsAddress             string              // address on which the metrics are served
+	StaleDeviceCheckInterval   time.Duration       // how often stale devices are removed from the node, 0 to disable
+	ClusterFsTypes             []string            // cluster filesystems which may be mounted MULTI_NODE_MULTI_WRITER
+	OrphanAuditInterval        time.Duration       // how often the orphan objects on the arrays are reported, 0 to disable
+	KnownVolumesFile           string              // file listing the volume handles known to the cluster
+	OrphanCleanup              bool                // remove empty storage groups and masking views of hosts with no initiators
+	InitiatorConflictPolicy    string              // what the node does when its initiators belong to another host
 	ClusterPrefix              string
 	AllowedArrays              []string
 	DisableCerts               bool   // used for unit testing only
@@ -121,6 +136,11 @@ type service struct {
 	mutex             sync.Mutex
 	cacheMutex        sync.Mutex
 	nodeIsInitialized bool
+	// nodeIsInitializedMutex guards nodeIsInitialized, which the node goroutines read
+	nodeIsInitializedMutex sync.Mutex
+	// hostNodeName is the node name adopted by the adopt initiator conflict policy
+	hostNodeName      string
+	hostNodeNameMutex sync.Mutex
 	// Timeout for storage pool cache
 	storagePoolCacheDuration time.Duration
 	// only used for testing, indicates if the deletion worked finished populating queue
@@ -129,7 +149,20 @@ type service struct {
 	// Gobrick stuff
 	fcConnector               fcConnector
 	iscsiConnector            iSCSIConnector
-	arrayTransportProtocolMap map[string]string // map of array SN to IscsiTransportProtocol or FcTransportProtocol
+	nvmeConnector             nvmeConnector
+	arrayTransportProtocolMap map[string]string // map of array SN to the transport protocol used with it
+
+	// per array configuration, loaded from Opts.ArrayConfigPath
+	arrayConfig *arrayConfigCache
+
+	// iSCSI sessions found by the session monitor
+	iscsiSessions iscsiSessionState
+
+	// stale devices found by the stale device collector
+	staleDevices staleDeviceState
+
+	// whether the orphan auditor was started
+	orphanAudit orphanAuditState
 }
 
 // New returns a new Service.
@@ -155,9 +188,22 @@ func (s *service) BeforeServe(
 			"autoprobe":      s.opts.AutoProbe,
 			"enableblock":    s.opts.EnableBlock,
 			"portgroups":     s.opts.PortGroups,
+			"arraypgs":       s.opts.ArrayPortGroups,
+			"pgselection":    s.opts.PortGroupSelection,
 			"clusterprefix":  s.opts.ClusterPrefix,
 			"arrays":         s.opts.AllowedArrays,
 			"transport":      s.opts.TransportProtocol,
+			"arrayconfig":    s.opts.ArrayConfigPath,
+			"iscsichap":      s.opts.ISCSICHAP.isSet(),
+			"discoverychap":  s.opts.ISCSIDiscoveryCHAP.isSet(),
+			"sessioncheck":   s.opts.ISCSISessionCheckInterval,
+			"metrics":        s.opts.MetricsAddress,
+			"staledevices":   s.opts.StaleDeviceCheckInterval,
+			"clusterfs":      s.opts.ClusterFsTypes,
+			"orphanaudit":    s.opts.OrphanAuditInterval,
+			"knownvolumes":   s.opts.KnownVolumesFile,
+			"orphancleanup":  s.opts.OrphanCleanup,
+			"initconflicts":  s.opts.InitiatorConflictPolicy,
 			"mode":           s.mode,
 		}
 
@@ -209,12 +255,91 @@ func (s *service) BeforeServe(
 		}
 		opts.PortGroups = tempList
 	}
+	if arrayPortGroups, ok := csictx.LookupEnv(ctx, EnvArrayPortGroups); ok {
+		pgMap, err := s.parseArrayPortGroups(arrayPortGroups)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", EnvArrayPortGroups, err.Error())
+		}
+		opts.ArrayPortGroups = pgMap
+	}
+	pgSelection, _ := csictx.LookupEnv(ctx, EnvPortGroupSelection)
+	opts.PortGroupSelection = getPortGroupSelection(pgSelection)
 	if arrays, ok := csictx.LookupEnv(ctx, EnvArrayWhitelist); ok {
 		opts.AllowedArrays, _ = s.parseCommaSeperatedList(arrays)
 	} else {
 		opts.AllowedArrays = []string{}
 	}
 	opts.TransportProtocol = s.getTransportProtocolFromEnv()
+	if preference, ok := csictx.LookupEnv(ctx, EnvTransportProtocolPreference); ok {
+		tpList, err := s.parseTransportProtocolPreference(preference)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", EnvTransportProtocolPreference, err.Error())
+		}
+		opts.TransportPreference = tpList
+	}
+	if arrayConfig, ok := csictx.LookupEnv(ctx, EnvArrayConfig); ok && arrayConfig != "" {
+		cache, err := newArrayConfigCache(arrayConfig)
+		if err != nil {
+			return fmt.Errorf("Unable to load %s: %s", EnvArrayConfig, err.Error())
+		}
+		opts.ArrayConfigPath = arrayConfig
+		s.arrayConfig = cache
+	}
+
+	chapUsername, _ := csictx.LookupEnv(ctx, EnvISCSICHAPUsername)
+	chapPassword, _ := csictx.LookupEnv(ctx, EnvISCSICHAPPassword)
+	chap, err := parseCHAPCredentials(chapUsername, chapPassword)
+	if err != nil {
+		return fmt.Errorf("Invalid value for %s/%s: %s", EnvISCSICHAPUsername, EnvISCSICHAPPassword, err.Error())
+	}
+	opts.ISCSICHAP = chap
+	chapUsername, _ = csictx.LookupEnv(ctx, EnvISCSIDiscoveryCHAPUsername)
+	chapPassword, _ = csictx.LookupEnv(ctx, EnvISCSIDiscoveryCHAPPassword)
+	chap, err = parseCHAPCredentials(chapUsername, chapPassword)
+	if err != nil {
+		return fmt.Errorf("Invalid value for %s/%s: %s", EnvISCSIDiscoveryCHAPUsername, EnvISCSIDiscoveryCHAPPassword, err.Error())
+	}
+	opts.ISCSIDiscoveryCHAP = chap
+
+	opts.ISCSISessionCheckInterval = defaultISCSISessionCheckInterval
+	if interval, ok := csictx.LookupEnv(ctx, EnvISCSISessionCheckInterval); ok && interval != "" {
+		if interval == "0" {
+			opts.ISCSISessionCheckInterval = 0
+		} else if d, err := time.ParseDuration(interval); err != nil || d < 0 {
+			return fmt.Errorf("Invalid value for %s: %s", EnvISCSISessionCheckInterval, interval)
+		} else {
+			opts.ISCSISessionCheckInterval = d
+		}
+	}
+	opts.MetricsAddress, _ = csictx.LookupEnv(ctx, EnvMetricsAddress)
+
+	opts.StaleDeviceCheckInterval = defaultStaleDeviceCheckInterval
+	if interval, ok := csictx.LookupEnv(ctx, EnvStaleDeviceCheckInterval); ok && interval != "" {
+		if interval == "0" {
+			opts.StaleDeviceCheckInterval = 0
+		} else if d, err := time.ParseDuration(interval); err != nil || d < 0 {
+			return fmt.Errorf("Invalid value for %s: %s", EnvStaleDeviceCheckInterval, interval)
+		} else {
+			opts.StaleDeviceCheckInterval = d
+		}
+	}
+
+	opts.ClusterFsTypes = defaultClusterFsTypes
+	if clusterFsTypes, ok := csictx.LookupEnv(ctx, EnvClusterFsTypes); ok {
+		opts.ClusterFsTypes, _ = s.parseCommaSeperatedList(clusterFsTypes)
+	}
+
+	if interval, ok := csictx.LookupEnv(ctx, EnvOrphanAuditInterval); ok && interval != "" && interval != "0" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < 0 {
+			return fmt.Errorf("Invalid value for %s: %s", EnvOrphanAuditInterval, interval)
+		}
+		opts.OrphanAuditInterval = d
+	}
+	opts.KnownVolumesFile, _ = csictx.LookupEnv(ctx, EnvKnownVolumesFile)
+
+	conflictPolicy, _ := csictx.LookupEnv(ctx, EnvInitiatorConflictPolicy)
+	opts.InitiatorConflictPolicy = getInitiatorConflictPolicy(conflictPolicy)
 
 	opts.GrpcMaxThreads = 4
 	if maxThreads, ok := csictx.LookupEnv(ctx, EnvGrpcMaxThreads); ok {
@@ -279,6 +404,7 @@ func (s *service) BeforeServe(
 	opts.Thick = pb(EnvThick)
 	opts.AutoProbe = pb(EnvAutoProbe)
 	opts.EnableBlock = pb(EnvEnableBlock)
+	opts.OrphanCleanup = pb(EnvOrphanCleanup)
 
 	s.opts = opts
 
@@ -289,6 +415,11 @@ func (s *service) BeforeServe(
 	}
 	s.iscsiClient = goiscsi.NewLinuxISCSI(iscsiOpts)
 
+	// serve the metrics, which are published using expvar
+	if opts.MetricsAddress != "" {
+		startMetricsServer(opts.MetricsAddress)
+	}
+
 	// seed the random methods
 	rand.Seed(time.Now().Unix())
 
@@ -332,32 +463,59 @@ func (s *service) BeforeServe(
 		}
 	}
 
+	// Start the orphan auditor
+	if !strings.EqualFold(s.mode, "node") {
+		s.startOrphanAuditor()
+	}
+
 	return nil
 }
 
+// startMetricsServer serves the driver metrics at /debug/vars on address
+func startMetricsServer(address string) {
+	go func() {
+		log.Infof("Serving metrics on %s", address)
+		if err := http.ListenAndServe(address, nil); err != nil {
+			log.Errorf("Unable to serve metrics on %s: %s", address, err.Error())
+		}
+	}()
+}
+
 func (s *service) getTransportProtocolFromEnv() string {
 	transportProtocol := ""
 	if tp, ok := csictx.LookupEnv(context.Background(), EnvPreferredTransportProtocol); ok {
-		tp = strings.ToUpper(tp)
-		switch tp {
-		case "FIBRE":
-			tp = "FC"
-			break
-		case "FC":
-			break
-		case "ISCSI":
-			break
-		case "":
-			break
-		default:
-			log.Errorf("Invalid transport protocol: %s, valid values FC or ISCSI", tp)
+		var err error
+		transportProtocol, err = normalizeTransportProtocol(tp)
+		if err != nil {
+			log.Error(err.Error())
 			return ""
 		}
-		transportProtocol = tp
 	}
 	return transportProtocol
 }
 
+// allTransportProtocols are the transport protocols supported by the driver
+var allTransportProtocols = []string{FcTransportProtocol, IscsiTransportProtocol, NvmeTCPTransportProtocol, NvmeFCTransportProtocol}
+
+// normalizeTransportProtocol validates a transport protocol setting and
+// returns it as FC, ISCSI, NVMETCP, NVMEFC or ""
+func normalizeTransportProtocol(tp string) (string, error) {
+	tp = strings.ToUpper(strings.TrimSpace(tp))
+	switch tp {
+	case "FIBRE":
+		tp = FcTransportProtocol
+	case "NVME/TCP", "NVME-TCP":
+		tp = NvmeTCPTransportProtocol
+	case "NVME/FC", "NVME-FC":
+		tp = NvmeFCTransportProtocol
+	case FcTransportProtocol, IscsiTransportProtocol, NvmeTCPTransportProtocol, NvmeFCTransportProtocol:
+	case "":
+	default:
+		return "", fmt.Errorf("Invalid transport protocol: %s, valid values FC, ISCSI, NVMETCP or NVMEFC", tp)
+	}
+	return tp, nil
+}
+
 // get the amount of time to retry pmax calls
 func (s *service) GetPmaxTimeoutSeconds() int64 {
 	return s.pmaxTimeoutSeconds
@@ -16,8 +16,10 @@ package service
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,8 +27,14 @@ import (
 	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/dell/gofsutil"
+	"github.com/dell/goiscsi"
+	types "github.com/dell/gopowermax/types/v90"
+	"github.com/golang/protobuf/ptypes"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -307,6 +315,28 @@ func TestVolumeIdentifier(t *testing.T) {
 	}
 }
 
+func TestGetVolumeIdentifier(t *testing.T) {
+	svc := &service{opts: Opts{ClusterPrefix: "TST"}}
+	atLimit := "pv-" + strings.Repeat("a", 50)
+	tests := []struct {
+		name       string
+		identifier string
+	}{
+		{"pv-1", "csi-TST-pv-1"},
+		{atLimit, "csi-TST-" + atLimit},
+		{"pv-" + strings.Repeat("a", 23) + "x" + strings.Repeat("b", 27), "csi-TST-pv-" + strings.Repeat("a", 23) + strings.Repeat("b", 27)},
+	}
+	for _, test := range tests {
+		identifier := svc.getVolumeIdentifier(test.name)
+		if identifier != test.identifier {
+			t.Errorf("Expected the identifier of %s to be %s but got %s", test.name, test.identifier, identifier)
+		}
+		if len(identifier) > MaxVolIdentifierLength {
+			t.Errorf("Identifier %s is longer than %d characters", identifier, MaxVolIdentifierLength)
+		}
+	}
+}
+
 func TestStringSliceComparison(t *testing.T) {
 
 	valA := []string{"a", "b", "c"}
@@ -404,6 +434,662 @@ func TestFibreChannelSplitInitiatorID(t *testing.T) {
 	}
 }
 
+func TestParseArrayPortGroups(t *testing.T) {
+	pgMap, err := s.parseArrayPortGroups(" 000000000001:pg1, pg2 ;000000000002:pg3;")
+	if err != nil {
+		t.Errorf("Expected no error but got %s", err.Error())
+	}
+	if len(pgMap) != 2 || !stringSlicesEqual(pgMap["000000000001"], []string{"pg1", "pg2"}) ||
+		!stringSlicesEqual(pgMap["000000000002"], []string{"pg3"}) {
+		t.Errorf("Unexpected port groups parsed: %v", pgMap)
+	}
+	for _, bad := range []string{"000000000001", "000000000001:", ":pg1"} {
+		if _, err := s.parseArrayPortGroups(bad); err == nil {
+			t.Errorf("Expected an error parsing %s but got none", bad)
+		}
+	}
+}
+
+func TestGetPortGroupSelection(t *testing.T) {
+	tests := map[string]string{
+		"":                             PortGroupSelectionRandom,
+		"Round-Robin":                  PortGroupSelectionRoundRobin,
+		"least-masking-views":          PortGroupSelectionLeastMaskingViews,
+		"least-director-masking-views": PortGroupSelectionLeastDirectorMaskingViews,
+		"bogus":                        PortGroupSelectionRandom,
+	}
+	for value, expected := range tests {
+		if strategy := getPortGroupSelection(value); strategy != expected {
+			t.Errorf("Expected %s for %s but got %s", expected, value, strategy)
+		}
+	}
+}
+
+func TestGetInitiatorConflictPolicy(t *testing.T) {
+	tests := map[string]string{
+		"":      InitiatorConflictFail,
+		"fail":  InitiatorConflictFail,
+		"Move":  InitiatorConflictMove,
+		"adopt": InitiatorConflictAdopt,
+		"bogus": InitiatorConflictFail,
+	}
+	for value, expected := range tests {
+		if policy := getInitiatorConflictPolicy(value); policy != expected {
+			t.Errorf("Expected %s for %s but got %s", expected, value, policy)
+		}
+	}
+}
+
+func TestGetNodeNameFromHostID(t *testing.T) {
+	s := &service{opts: Opts{ClusterPrefix: "TST"}}
+	tests := map[string]string{
+		"csi-node-TST-node1":         "node1",
+		"csi-node-TST-node1-FC":      "node1",
+		"csi-node-TST-node1-NVMETCP": "node1",
+		"csi-node-TST-node1-NVMEFC":  "node1",
+		"csi-node-ABC-node1":         "",
+		"legacy-host":                "",
+	}
+	for hostID, expected := range tests {
+		if nodeName := s.getNodeNameFromHostID(hostID); nodeName != expected {
+			t.Errorf("Expected node name %q for host %s but got %q", expected, hostID, nodeName)
+		}
+	}
+}
+
+func TestParseArrayConfig(t *testing.T) {
+	arrays, err := parseArrayConfig([]byte(`
+arrays:
+  - symmetrixID: "000000000001"
+    portGroups: [pg1, pg2]
+    fcDirectors: [FA-1D]
+    transportProtocol: fibre
+  - symmetrixID: "000000000002"
+`))
+	if err != nil {
+		t.Errorf("Expected no error but got %s", err.Error())
+	}
+	if len(arrays) != 2 || arrays["000000000001"].TransportProtocol != FcTransportProtocol ||
+		len(arrays["000000000001"].PortGroups) != 2 || arrays["000000000002"].TransportProtocol != "" {
+		t.Errorf("Unexpected array configuration parsed: %v", arrays)
+	}
+	badConfigs := []string{
+		"arrays:\n  - portGroups: [pg1]\n",
+		"arrays:\n  - symmetrixID: \"1\"\n  - symmetrixID: \"1\"\n",
+		"arrays:\n  - symmetrixID: \"1\"\n    transportProtocol: nvme\n",
+		"arrays:\n  - symmetrixID: \"1\"\n    portgroup: pg1\n",
+	}
+	for _, bad := range badConfigs {
+		if _, err := parseArrayConfig([]byte(bad)); err == nil {
+			t.Errorf("Expected an error parsing %q but got none", bad)
+		}
+	}
+}
+
+func TestArrayConfigReload(t *testing.T) {
+	file, err := ioutil.TempFile("", "array-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	ioutil.WriteFile(file.Name(), []byte("arrays:\n  - symmetrixID: \"1\"\n    transportProtocol: FC\n"), 0644)
+	cache, err := newArrayConfigCache(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.get("1").TransportProtocol != FcTransportProtocol {
+		t.Error("Expected transport protocol FC for array 1")
+	}
+	defer func(interval time.Duration) { arrayConfigRecheckInterval = interval }(arrayConfigRecheckInterval)
+	arrayConfigRecheckInterval = 0
+	// An invalid file keeps the previous configuration
+	ioutil.WriteFile(file.Name(), []byte("arrays: [[["), 0644)
+	os.Chtimes(file.Name(), time.Now(), time.Now().Add(time.Minute))
+	if cache.get("1") == nil {
+		t.Error("Expected the previous configuration to be kept")
+	}
+	ioutil.WriteFile(file.Name(), []byte("arrays:\n  - symmetrixID: \"1\"\n    transportProtocol: ISCSI\n"), 0644)
+	os.Chtimes(file.Name(), time.Now(), time.Now().Add(2*time.Minute))
+	if cache.get("1").TransportProtocol != IscsiTransportProtocol {
+		t.Error("Expected transport protocol ISCSI for array 1 after reload")
+	}
+}
+
+func TestFilterPortsByDirectors(t *testing.T) {
+	ports := filterPortsByDirectors([]string{"FA-1D:4", "FA-2D:4", "FA-1D:5"}, []string{"fa-1d"})
+	if !stringSlicesEqual(ports, []string{"FA-1D:4", "FA-1D:5"}) {
+		t.Errorf("Unexpected ports %v", ports)
+	}
+}
+
+func TestTransportProtocolOrder(t *testing.T) {
+	s := &service{}
+	if _, err := s.parseTransportProtocolPreference("ISCSI,NFS"); err == nil {
+		t.Error("Expected an error for an invalid transport protocol")
+	}
+	preference, err := s.parseTransportProtocolPreference("iscsi, fibre, ISCSI")
+	if err != nil {
+		t.Errorf("Expected no error but got %s", err.Error())
+	}
+	if strings.Join(preference, ",") != "ISCSI,FC" {
+		t.Errorf("Expected ISCSI,FC but got %v", preference)
+	}
+	if order := s.getTransportProtocolOrder("000000000001"); strings.Join(order, ",") != "FC,ISCSI" {
+		t.Errorf("Expected the default order FC,ISCSI but got %v", order)
+	}
+	s.opts.TransportPreference = preference
+	if order := s.getTransportProtocolOrder("000000000001"); strings.Join(order, ",") != "ISCSI,FC" {
+		t.Errorf("Expected ISCSI,FC but got %v", order)
+	}
+	s.opts.TransportProtocol = FcTransportProtocol
+	if order := s.getTransportProtocolOrder("000000000001"); strings.Join(order, ",") != "FC" {
+		t.Errorf("Expected FC but got %v", order)
+	}
+}
+
+func TestParseNVMeTargets(t *testing.T) {
+	targets := parseNVMeTargets("nqn.1988-11.com.dell:powermax:00:1@10.0.0.1, 0x5000000000000001,bogus,")
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets but got %v", targets)
+	}
+	if targets[0].Target != "nqn.1988-11.com.dell:powermax:00:1" || targets[0].Portal != "10.0.0.1" {
+		t.Errorf("Unexpected NVMe/TCP target %v", targets[0])
+	}
+	if targets[1].Target != "" || targets[1].Portal != "5000000000000001" {
+		t.Errorf("Unexpected NVMe/FC target %v", targets[1])
+	}
+	for _, value := range []string{"NVMe/TCP", "nvme-fc", "NVMETCP"} {
+		if _, err := normalizeTransportProtocol(value); err != nil {
+			t.Errorf("Expected %s to be a valid transport protocol but got %s", value, err.Error())
+		}
+	}
+}
+
+func TestNVMeGetDeviceByNGUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nvme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(dir+"/block/nvme0n1", 0755)
+	os.MkdirAll(dir+"/block/nvme0n2", 0755)
+	ioutil.WriteFile(dir+"/block/nvme0n1/nguid", []byte("60000970-0000-1979-0004-6533030300501\n"), 0644)
+	ioutil.WriteFile(dir+"/block/nvme0n2/wwid", []byte("eui.60000970000019790004653303030502\n"), 0644)
+	ioutil.WriteFile(dir+"/hostnqn", []byte("nqn.2014-08.org.nvmexpress:uuid:1234\n"), 0644)
+	c := newNVMeCLIConnector("")
+	c.sysBlockPath = dir + "/block"
+	c.hostNQNFile = dir + "/hostnqn"
+	device, err := c.GetDeviceByNGUID(context.Background(), "600009700000197900046533030300501")
+	if err != nil || device.Name != "nvme0n1" {
+		t.Errorf("Expected nvme0n1 but got %v, %v", device, err)
+	}
+	device, err = c.GetDeviceByNGUID(context.Background(), "0x60000970000019790004653303030502")
+	if err != nil || device.Name != "nvme0n2" {
+		t.Errorf("Expected nvme0n2 but got %v, %v", device, err)
+	}
+	if _, err = c.GetDeviceByNGUID(context.Background(), "60000970000019790004653303030503"); err == nil {
+		t.Error("Expected an error for an unknown NGUID")
+	}
+	nqns, err := c.GetInitiatorName(context.Background())
+	if err != nil || len(nqns) != 1 || nqns[0] != "nqn.2014-08.org.nvmexpress:uuid:1234" {
+		t.Errorf("Unexpected host NQNs %v, %v", nqns, err)
+	}
+}
+
+func TestParseCHAPCredentials(t *testing.T) {
+	creds, err := parseCHAPCredentials(" chapuser ", "chapsecret")
+	if err != nil || !creds.isSet() || creds.Username != "chapuser" {
+		t.Errorf("Unexpected CHAP credentials %v, %v", creds, err)
+	}
+	if creds, err = parseCHAPCredentials("", ""); err != nil || creds.isSet() {
+		t.Errorf("Expected CHAP to be disabled but got %v, %v", creds, err)
+	}
+	if _, err = parseCHAPCredentials("chapuser", ""); err == nil {
+		t.Error("Expected an error for a CHAP username without a password")
+	}
+}
+
+func TestParseDiscoveredTargets(t *testing.T) {
+	targets := parseDiscoveredTargets("[fe80::1]:3260,2 iqn.1992-04.com.emc:600009700bcbb70e3287017400000002\n" +
+		"iscsiadm: connection login retries reached\n")
+	if len(targets) != 1 || targets[0].Portal != "[fe80::1]:3260" || targets[0].GroupTag != "2" ||
+		targets[0].Target != "iqn.1992-04.com.emc:600009700bcbb70e3287017400000002" {
+		t.Errorf("Unexpected targets %v", targets)
+	}
+}
+
+func TestDiscoverTargetsWithCHAP(t *testing.T) {
+	var commands []*exec.Cmd
+	defer func(f func(string, ...string) *exec.Cmd) { execCommand = f }(execCommand)
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		cs := append([]string{"-test.run=TestExecCommandHelper", "--", name}, args...)
+		cmd := exec.Command(os.Args[0], cs...)
+		cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1", "EXIT_STATUS=0",
+			"STDOUT=10.0.0.1:3260,1 iqn.1992-04.com.emc:600009700bcbb70e3287017400000001\n"}
+		commands = append(commands, cmd)
+		return cmd
+	}
+	s := &service{}
+	s.opts.ISCSIDiscoveryCHAP = chapCredentials{Username: "discuser", Password: "discsecret"}
+	targets, err := s.discoverTargetsWithCHAP("10.0.0.1")
+	if err != nil {
+		t.Fatalf("Expected no error but got %s", err.Error())
+	}
+	if len(targets) != 1 || targets[0].Portal != "10.0.0.1:3260" || targets[0].GroupTag != "1" {
+		t.Errorf("Unexpected targets %v", targets)
+	}
+	if len(commands) != 5 || !strings.HasSuffix(strings.Join(commands[4].Args, " "), "-p 10.0.0.1:3260 --discover") {
+		t.Fatalf("Unexpected iscsiadm commands %v", commands)
+	}
+	for _, command := range commands {
+		if strings.Contains(strings.Join(command.Args, " "), "discsecret") {
+			t.Errorf("The CHAP password was passed to iscsiadm on its command line: %v", command.Args)
+		}
+	}
+	password := strings.Join(commands[3].Args, " ")
+	if !strings.Contains(password, "-p 10.0.0.1:3260 -o update -n "+iscsiDiscoveryAuthPassword) {
+		t.Errorf("Unexpected iscsiadm command to set the CHAP password %s", password)
+	}
+	found := false
+	for _, env := range commands[3].Env {
+		found = found || env == iscsiPasswordEnv+"=discsecret"
+	}
+	if !found {
+		t.Errorf("The CHAP password was not passed to iscsiadm in its environment %v", commands[3].Env)
+	}
+}
+
+func TestSessionMatchesTarget(t *testing.T) {
+	session := goiscsi.ISCSISession{Portal: "10.0.0.1:3260", Target: "iqn.1992-04.com.emc:1"}
+	tests := []struct {
+		target  goiscsi.ISCSITarget
+		matches bool
+	}{
+		{goiscsi.ISCSITarget{Portal: "10.0.0.1"}, true},
+		{goiscsi.ISCSITarget{Portal: "10.0.0.1:3260", Target: "iqn.1992-04.com.emc:1"}, true},
+		{goiscsi.ISCSITarget{Portal: "10.0.0.1", Target: "iqn.1992-04.com.emc:2"}, false},
+		{goiscsi.ISCSITarget{Portal: "10.0.0.2"}, false},
+	}
+	for _, test := range tests {
+		if sessionMatchesTarget(session, test.target) != test.matches {
+			t.Errorf("Expected match %t for target %v", test.matches, test.target)
+		}
+	}
+	if ip := iscsiPortalIP("[fe80::1]:3260"); ip != "fe80::1" {
+		t.Errorf("Expected fe80::1 but got %s", ip)
+	}
+	targets := uniqueISCSITargets([]goiscsi.ISCSITarget{{Portal: "10.0.0.1"}, {Portal: "10.0.0.1:3260"}})
+	if len(targets) != 1 {
+		t.Errorf("Expected duplicate targets to be removed but got %v", targets)
+	}
+}
+
+func TestWWNFromDiskByIDName(t *testing.T) {
+	tests := map[string]string{
+		"wwn-0x60000970000197900046533030300501":          "60000970000197900046533030300501",
+		"dm-uuid-mpath-360000970000197900046533030300501": "60000970000197900046533030300501",
+		"wwn-0x60000970000197900046533030300501-part1":    "",
+		"wwn-0x6001405b1e2a4c3d8e9f000000000001":          "",
+		"scsi-360000970000197900046533030300501":          "",
+		"nvme-eui.12635330303134340000976000012000":       "",
+	}
+	for name, expected := range tests {
+		if wwn := wwnFromDiskByIDName(name); wwn != expected {
+			t.Errorf("Expected WWN %q for %s but got %q", expected, name, wwn)
+		}
+	}
+	if symID := symIDFromWWN("60000970000197900046533030300501"); symID != "000197900046" {
+		t.Errorf("Expected array 000197900046 but got %s", symID)
+	}
+	if symID := symIDFromWWN("6000097000"); symID != "" {
+		t.Errorf("Expected no array for a short WWN but got %s", symID)
+	}
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	tests := []struct {
+		fsType     string
+		fsCheck    string
+		readOnly   bool
+		checkExit  int
+		repairExit int
+		commands   []string
+		code       codes.Code
+	}{
+		{"ext4", "", false, 0, 0, nil, codes.OK},
+		{"ext4", FsCheckNone, false, 0, 0, nil, codes.OK},
+		{"", FsCheckRepair, false, 0, 0, nil, codes.OK},
+		{"vfat", FsCheckRepair, false, 0, 0, nil, codes.OK},
+		{"btrfs", FsCheckRepair, false, 0, 0, []string{"btrfs check --readonly /dev/fake"}, codes.OK},
+		{"btrfs", FsCheckRepair, false, 1, 0, []string{"btrfs check --readonly /dev/fake"}, codes.FailedPrecondition},
+		{"ext4", FsCheckCheck, false, 0, 0, []string{"e2fsck -n /dev/fake"}, codes.OK},
+		{"ext4", FsCheckCheck, false, 4, 0, []string{"e2fsck -n /dev/fake"}, codes.FailedPrecondition},
+		{"ext4", FsCheckCheck, false, 8, 0, []string{"e2fsck -n /dev/fake"}, codes.Internal},
+		{"ext4", FsCheckCheck, false, 1, 0, []string{"e2fsck -n /dev/fake"}, codes.OK},
+		{"ext4", FsCheckCheck, false, 12, 0, []string{"e2fsck -n /dev/fake"}, codes.FailedPrecondition},
+		{"ext4", FsCheckRepair, false, 12, 1, []string{"e2fsck -n /dev/fake", "e2fsck -p /dev/fake"}, codes.OK},
+		{"ext4", FsCheckRepair, false, 4, 5, []string{"e2fsck -n /dev/fake", "e2fsck -p /dev/fake"}, codes.FailedPrecondition},
+		{"ext4", FsCheckRepair, false, 4, 1, []string{"e2fsck -n /dev/fake", "e2fsck -p /dev/fake"}, codes.OK},
+		{"ext4", FsCheckRepair, false, 4, 4, []string{"e2fsck -n /dev/fake", "e2fsck -p /dev/fake"}, codes.FailedPrecondition},
+		{"ext4", FsCheckRepair, true, 4, 0, []string{"e2fsck -n /dev/fake"}, codes.FailedPrecondition},
+		{"xfs", FsCheckCheck, false, 2, 0, []string{"xfs_repair -n /dev/fake"}, codes.OK},
+		{"xfs", FsCheckRepair, false, 1, 0, []string{"xfs_repair -n /dev/fake", "xfs_repair /dev/fake"}, codes.OK},
+		{"xfs", FsCheckRepair, false, 1, 2, []string{"xfs_repair -n /dev/fake", "xfs_repair /dev/fake"}, codes.FailedPrecondition},
+	}
+	gofsutil.UseMockFS()
+	defer func(mounts []gofsutil.Info) { gofsutil.GOFSMockMounts = mounts }(gofsutil.GOFSMockMounts)
+	defer func(f func(string, ...string) *exec.Cmd) { execCommand = f }(execCommand)
+	for _, test := range tests {
+		var commands []string
+		execCommand = func(name string, args ...string) *exec.Cmd {
+			commands = append(commands, name+" "+strings.Join(args, " "))
+			exit := test.checkExit
+			if args[0] != "-n" && args[0] != "check" {
+				exit = test.repairExit
+			}
+			cs := append([]string{"-test.run=TestExecCommandHelper", "--", name}, args...)
+			cmd := exec.Command(os.Args[0], cs...)
+			cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1", fmt.Sprintf("EXIT_STATUS=%d", exit),
+				fmt.Sprintf("STDOUT=%s exited with %d", name, exit)}
+			return cmd
+		}
+		gofsutil.GOFSMockMounts = []gofsutil.Info{{Device: "/dev/fake", Type: test.fsType}}
+		err := checkFilesystem(context.Background(), "/dev/fake", test.fsCheck, test.readOnly)
+		if status.Code(err) != test.code {
+			t.Errorf("Expected code %s for %+v but got %v", test.code, test, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "exited with") {
+			t.Errorf("Expected the checker output in the error for %+v but got %s", test, err.Error())
+		}
+		if strings.Join(commands, ",") != strings.Join(test.commands, ",") {
+			t.Errorf("Expected commands %v for %+v but got %v", test.commands, test, commands)
+		}
+	}
+
+	// e2fsck -n reports errors on a filesystem whose journal needs to be recovered
+	for _, test := range []struct {
+		fsCheck  string
+		readOnly bool
+		commands []string
+	}{
+		{FsCheckCheck, false, []string{"e2fsck -n /dev/fake"}},
+		{FsCheckRepair, true, []string{"e2fsck -n /dev/fake"}},
+		{FsCheckRepair, false, []string{"e2fsck -n /dev/fake", "e2fsck -p /dev/fake"}},
+	} {
+		var commands []string
+		execCommand = func(name string, args ...string) *exec.Cmd {
+			commands = append(commands, name+" "+strings.Join(args, " "))
+			exit, stdout := e2fsckErrorsUncorrected, "Warning: skipping journal recovery because doing a read-only filesystem check."
+			if args[0] != "-n" {
+				exit, stdout = e2fsckErrorsCorrected, "recovering journal"
+			}
+			cs := append([]string{"-test.run=TestExecCommandHelper", "--", name}, args...)
+			cmd := exec.Command(os.Args[0], cs...)
+			cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1", fmt.Sprintf("EXIT_STATUS=%d", exit), "STDOUT=" + stdout}
+			return cmd
+		}
+		gofsutil.GOFSMockMounts = []gofsutil.Info{{Device: "/dev/fake", Type: "ext4"}}
+		if err := checkFilesystem(context.Background(), "/dev/fake", test.fsCheck, test.readOnly); err != nil {
+			t.Errorf("Expected a filesystem with a journal to recover to be mounted for %+v but got %s", test, err.Error())
+		}
+		if strings.Join(commands, ",") != strings.Join(test.commands, ",") {
+			t.Errorf("Expected commands %v for %+v but got %v", test.commands, test, commands)
+		}
+	}
+	if err := validateFsCheck("fix"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected an invalid FsCheck to be rejected but got %v", err)
+	}
+}
+
+func TestParseMkfsOptions(t *testing.T) {
+	tests := []struct {
+		fsType  string
+		options string
+		args    []string
+		code    codes.Code
+	}{
+		{"xfs", "", nil, codes.OK},
+		{"xfs", "-m reflink=1", []string{"-m", "reflink=1"}, codes.OK},
+		{"", " -i  65536 ", []string{"-i", "65536"}, codes.OK},
+		{"btrfs", "-L data --nodesize 16k", []string{"-L", "data", "--nodesize", "16k"}, codes.OK},
+		{"vfat", "-n DATA", nil, codes.InvalidArgument},
+		{"ext4", "65536", nil, codes.InvalidArgument},
+		{"ext4", "-L a;reboot", nil, codes.InvalidArgument},
+		{"ext4", "-L data /dev/sdb", nil, codes.InvalidArgument},
+		{"xfs", "-p /etc/shadow", nil, codes.InvalidArgument},
+		{"ext4", "-d ../../etc", nil, codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		args, err := parseMkfsOptions(test.fsType, test.options)
+		if status.Code(err) != test.code {
+			t.Errorf("Expected code %s for %+v but got %v", test.code, test, err)
+		}
+		if strings.Join(args, " ") != strings.Join(test.args, " ") {
+			t.Errorf("Expected arguments %v for %+v but got %v", test.args, test, args)
+		}
+	}
+}
+
+func TestFormatWithOptions(t *testing.T) {
+	var commands []string
+	gofsutil.UseMockFS()
+	defer func(mounts []gofsutil.Info) { gofsutil.GOFSMockMounts = mounts }(gofsutil.GOFSMockMounts)
+	defer func(f func(string, ...string) *exec.Cmd) { execCommand = f }(execCommand)
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		cs := append([]string{"-test.run=TestExecCommandHelper", "--", name}, args...)
+		cmd := exec.Command(os.Args[0], cs...)
+		cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1", "EXIT_STATUS=0"}
+		return cmd
+	}
+	gofsutil.GOFSMockMounts = nil
+	if err := formatWithOptions(context.Background(), "/dev/fake", "xfs", []string{"-m", "reflink=1"}); err != nil {
+		t.Errorf("Expected no error but got %s", err.Error())
+	}
+	if len(commands) != 1 || commands[0] != "mkfs.xfs -K -m reflink=1 /dev/fake" {
+		t.Errorf("Unexpected mkfs commands %v", commands)
+	}
+	// the options are only applied on first format
+	commands = nil
+	gofsutil.GOFSMockMounts = []gofsutil.Info{{Device: "/dev/fake", Type: "xfs"}}
+	if err := formatWithOptions(context.Background(), "/dev/fake", "xfs", []string{"-m", "reflink=1"}); err != nil {
+		t.Errorf("Expected no error but got %s", err.Error())
+	}
+	if len(commands) != 0 {
+		t.Errorf("Expected a formatted device not to be formatted again but got %v", commands)
+	}
+}
+
+func TestValVolumeCapsClusterFs(t *testing.T) {
+	multiWriterMount := func(fsType string) []*csi.VolumeCapability {
+		return []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}}
+	}
+	tests := []struct {
+		fsType         string
+		clusterFsTypes []string
+		supported      bool
+	}{
+		{"gfs2", defaultClusterFsTypes, true},
+		{"OCFS2", defaultClusterFsTypes, true},
+		{"ext4", defaultClusterFsTypes, false},
+		{"", defaultClusterFsTypes, false},
+		{"gfs2", nil, false},
+	}
+	for _, test := range tests {
+		supported, reason := valVolumeCaps(multiWriterMount(test.fsType), nil, test.clusterFsTypes)
+		if supported != test.supported {
+			t.Errorf("Expected supported %t for %+v but got %t: %s", test.supported, test, supported, reason)
+		}
+	}
+}
+
+func TestParseSnapshotTimestamp(t *testing.T) {
+	expected := time.Date(2020, time.June, 7, 10, 8, 58, 0, time.UTC)
+	for _, timestamp := range []string{"Sun Jun  7 10:08:58 2020", "1591524538", "1591524538000"} {
+		parsed, err := parseSnapshotTimestamp(timestamp)
+		if err != nil {
+			t.Errorf("Expected no error for %s but got %s", timestamp, err.Error())
+		} else if !parsed.Equal(expected) {
+			t.Errorf("Expected %s for %s but got %s", expected, timestamp, parsed)
+		}
+	}
+	if _, err := parseSnapshotTimestamp("yesterday"); err == nil {
+		t.Error("Expected an error for an unsupported timestamp")
+	}
+}
+
+func TestGetCSISnapshot(t *testing.T) {
+	tests := []struct {
+		state      string
+		linked     []types.LinkedVolumes
+		generation int64
+		ready      bool
+	}{
+		{"Established", nil, 0, true},
+		{"EstablishInProg", nil, 0, false},
+		{"Restored", nil, 0, true},
+		{"Established", []types.LinkedVolumes{{TargetDevice: "00002", Defined: false}}, 0, false},
+		{"Established", []types.LinkedVolumes{{TargetDevice: "00002", Defined: true}}, 0, true},
+		{"Established", nil, 1, false},
+	}
+	for _, test := range tests {
+		snapInfo := &types.VolumeSnapshot{
+			VolumeSnapshotSource: []types.VolumeSnapshotSource{{
+				SnapshotName:  "snap1",
+				Generation:    test.generation,
+				TimeStamp:     "Sun Jun  7 10:08:58 2020",
+				State:         test.state,
+				LinkedVolumes: test.linked,
+			}},
+		}
+		snapshot := getCSISnapshot(snapInfo, "snap1-000197900046-00001", "vol1")
+		if snapshot.ReadyToUse != test.ready {
+			t.Errorf("Expected ReadyToUse %t for %+v", test.ready, test)
+		}
+		if test.generation == 0 && ptypes.TimestampString(snapshot.CreationTime) != "2020-06-07T10:08:58Z" {
+			t.Errorf("Expected the creation time of the array for %+v but got %s", test, ptypes.TimestampString(snapshot.CreationTime))
+		}
+	}
+}
+
+func TestParseSnapshotTTL(t *testing.T) {
+	tests := []struct {
+		ttl  string
+		days int64
+	}{
+		{"", 0},
+		{"12h", 1},
+		{"24h", 1},
+		{"25h", 2},
+		{"7d", 7},
+		{"400d", 400},
+	}
+	for _, test := range tests {
+		days, err := parseSnapshotTTL(test.ttl)
+		if err != nil {
+			t.Errorf("Expected no error for %s but got %s", test.ttl, err.Error())
+		} else if days != test.days {
+			t.Errorf("Expected %d days for %s but got %d", test.days, test.ttl, days)
+		}
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	now := time.Now()
+	future := now.Add(48 * time.Hour)
+	past := now.Add(-time.Hour)
+	sessions := []SnapSession{
+		{Name: "secure", Secured: true, ProtectionExpireTime: future.Unix()},
+		{Name: "secure", Generation: 1, Secured: true, ProtectionExpireTime: past.Unix()},
+		{Name: "expired", Secured: true, ProtectionExpireTime: past.Unix()},
+		{Name: "plain", ProtectionExpireTime: future.Unix()},
+	}
+	tests := []struct {
+		snapID string
+		locked bool
+	}{
+		{"secure", true},
+		{"expired", false},
+		{"plain", false},
+		{"missing", false},
+	}
+	for _, test := range tests {
+		lockedUntil, locked := snapshotRetention(sessions, test.snapID, now)
+		if locked != test.locked {
+			t.Errorf("Expected %s to be locked %t but got %t", test.snapID, test.locked, locked)
+		} else if locked && lockedUntil.Unix() != future.Unix() {
+			t.Errorf("Expected %s to be locked until %s but got %s", test.snapID, future, lockedUntil)
+		}
+	}
+}
+
+func TestSnapCleanupRetryBackoff(t *testing.T) {
+	scw := &snapCleanupWorker{RetryInterval: 30 * time.Second, MaxRetryInterval: 10 * time.Minute}
+	tests := []struct {
+		retries int
+		backoff time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, 1 * time.Minute},
+		{4, 4 * time.Minute},
+		{5, 8 * time.Minute},
+		{6, 10 * time.Minute},
+		{10, 10 * time.Minute},
+	}
+	for _, test := range tests {
+		if backoff := scw.retryBackoff(test.retries); backoff != test.backoff {
+			t.Errorf("Expected a backoff of %s after %d retries but got %s", test.backoff, test.retries, backoff)
+		}
+	}
+}
+
+func TestSnapCleanupQueue(t *testing.T) {
+	now := time.Now()
+	scw := &snapCleanupWorker{Queue: make(snapCleanupQueue, 0), wake: make(chan struct{}, 1)}
+	if req, due := scw.removeItem(now); req != nil || !due.IsZero() {
+		t.Errorf("Expected an empty queue")
+	}
+	scw.requestCleanup(&snapCleanupRequest{snapshotID: "later", symmetrixID: "sym", notBefore: now.Add(time.Hour)})
+	scw.requestCleanup(&snapCleanupRequest{snapshotID: "now", symmetrixID: "sym"})
+	scw.requestCleanup(&snapCleanupRequest{snapshotID: "soon", symmetrixID: "sym", notBefore: now.Add(time.Minute)})
+	select {
+	case <-scw.wake:
+	default:
+		t.Errorf("Expected the worker to be woken up")
+	}
+	if req, _ := scw.removeItem(now); req == nil || req.snapshotID != "now" {
+		t.Errorf("Expected the request which is due to be removed but got %v", req)
+	}
+	if req, due := scw.removeItem(now); req != nil || !due.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected no request to be due before %s but got %v due %s", now.Add(time.Minute), req, due)
+	}
+	if req, _ := scw.removeItem(now.Add(2 * time.Hour)); req == nil || req.snapshotID != "soon" {
+		t.Errorf("Expected the request due first to be removed but got %v", req)
+	}
+}
+
+func TestReadKnownVolumes(t *testing.T) {
+	file, err := ioutil.TempFile("", "known-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	ioutil.WriteFile(file.Name(), []byte("# volume handles\ncsi-TST-pv1-000197900046-00001\n\n  csi-TST-pv2-000197900046-00002  \n"), 0644)
+	known, err := readKnownVolumes(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(known) != 2 || !known["csi-TST-pv1-000197900046-00001"] || !known["csi-TST-pv2-000197900046-00002"] {
+		t.Errorf("Unexpected known volumes %v", known)
+	}
+	if _, err := readKnownVolumes(file.Name() + "-missing"); err == nil {
+		t.Error("Expected an error reading a missing file")
+	}
+}
+
 func TestPending(t *testing.T) {
 	tests := []struct {
 		npending     int
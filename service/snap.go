@@ -19,11 +19,14 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	types "github.com/dell/gopowermax/types/v90"
+	"github.com/golang/protobuf/ptypes"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -48,14 +51,26 @@ type SnapSession struct {
 	Name       string
 	Generation int64
 	Expired    bool
-	Target     []types.SnapTarget
+	Timestamp  string
+	// Secured snapshots cannot be terminated before their ProtectionExpireTime
+	Secured              bool
+	ProtectionExpireTime int64
+	Target               []types.SnapTarget
 }
 
+// snapCleanupWorker terminates the snapshots queued for cleanup as soon as they are due.
+// The queue is not saved by the driver: the temporary snapshots and the snapshots marked for
+// deletion are named as such on the array, so the queue is rebuilt by the periodic scans of
+// the arrays, including after the driver restarts.
 type snapCleanupWorker struct {
-	PollingInterval time.Duration
-	Mutex           sync.Mutex
-	Queue           snapCleanupQueue
-	MaxRetries      int
+	// RetryInterval is the delay before the first retry of a failed request, doubled on each retry up to MaxRetryInterval
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	Mutex            sync.Mutex
+	Queue            snapCleanupQueue
+	MaxRetries       int
+	// wake is signalled when a request is queued
+	wake chan struct{}
 }
 
 // snapCleanupRequest holds information required for clean up action
@@ -65,6 +80,8 @@ type snapCleanupRequest struct {
 	volumeID    string
 	requestID   string
 	retries     int
+	// notBefore is the earliest time the request is processed
+	notBefore time.Time
 }
 
 type snapCleanupQueue []*snapCleanupRequest
@@ -73,10 +90,9 @@ func (q snapCleanupQueue) Len() int {
 	return len(q)
 }
 
-// Less compares two elements in the queue, return true if the ith is less than the jth
+// Less compares two elements in the queue, return true if the ith is due before the jth
 func (q snapCleanupQueue) Less(i, j int) bool {
-	// Return dummy to make the impl happy
-	return false
+	return q[i].notBefore.Before(q[j].notBefore)
 }
 
 // Swap swaps two elements in the queue and updates their index.
@@ -128,6 +144,7 @@ func (scw *snapCleanupWorker) requestCleanup(req *snapCleanupRequest) {
 	}
 	heap.Push(&scw.Queue, req)
 	log.WithFields(fields).Debug("Queued for Deletion")
+	scw.notify()
 }
 
 func (scw *snapCleanupWorker) queueForRetry(req *snapCleanupRequest) {
@@ -136,16 +153,41 @@ func (scw *snapCleanupWorker) queueForRetry(req *snapCleanupRequest) {
 	heap.Push(&scw.Queue, req)
 }
 
-// removeItem removes the top priority item so it can be worked on
-func (scw *snapCleanupWorker) removeItem() *snapCleanupRequest {
+// notify wakes up snapCleanupThread without blocking, a pending wake up is enough
+func (scw *snapCleanupWorker) notify() {
+	select {
+	case scw.wake <- struct{}{}:
+	default:
+	}
+}
+
+// retryBackoff returns the delay before a request is retried after the given number of retries
+func (scw *snapCleanupWorker) retryBackoff(retries int) time.Duration {
+	backoff := scw.RetryInterval
+	for i := 1; i < retries && backoff < scw.MaxRetryInterval; i++ {
+		backoff *= 2
+	}
+	if backoff > scw.MaxRetryInterval {
+		backoff = scw.MaxRetryInterval
+	}
+	return backoff
+}
+
+// removeItem removes the request which is due first so it can be worked on. If no request
+// is due at now, it returns nil and the time the next request is due, or the zero time if
+// the queue is empty.
+func (scw *snapCleanupWorker) removeItem(now time.Time) (*snapCleanupRequest, time.Time) {
 	scw.Mutex.Lock()
 	defer scw.Mutex.Unlock()
 	if len(scw.Queue) == 0 {
-		return nil
+		return nil, time.Time{}
+	}
+	if scw.Queue[0].notBefore.After(now) {
+		return nil, scw.Queue[0].notBefore
 	}
 	reqx := heap.Pop(&scw.Queue)
 	req := reqx.(snapCleanupRequest)
-	return &req
+	return &req, time.Time{}
 }
 
 //IsSnapshotLicensed return true if the symmetrix array has
@@ -340,6 +382,10 @@ func (s *service) GetSnapSessions(symID, deviceID string) (srcSession []SnapSess
 			Generation: volumeSnapshotSource.Generation,
 			Name:       volumeSnapshotSource.SnapshotName,
 			Expired:    volumeSnapshotSource.Expired,
+			Timestamp:  volumeSnapshotSource.TimeStamp,
+
+			Secured:              volumeSnapshotSource.Secured,
+			ProtectionExpireTime: volumeSnapshotSource.ProtectionExpireTime,
 		}
 		for _, targets := range volumeSnapshotSource.LinkedVolumes {
 			snapTgt := types.SnapTarget{
@@ -567,9 +613,11 @@ func (s *service) startSnapCleanupWorker() error {
 	}
 	if snapCleaner == nil {
 		snapCleaner = new(snapCleanupWorker)
-		snapCleaner.PollingInterval = 3 * time.Minute
+		snapCleaner.RetryInterval = 30 * time.Second
+		snapCleaner.MaxRetryInterval = 10 * time.Minute
 		snapCleaner.Queue = make(snapCleanupQueue, 0)
 		snapCleaner.MaxRetries = 10
+		snapCleaner.wake = make(chan struct{}, 1)
 	}
 
 	log.Printf("Starting snapshots cleanup worker thread")
@@ -581,104 +629,101 @@ func (s *service) startSnapCleanupWorker() error {
 }
 
 // snapCleanupThread - Deletes temporary snapshots and snapshots
-// that are pending but marked for deletion
+// that are pending but marked for deletion. The arrays are scanned for them
+// at startup and every expiredSnapshotScanInterval, and queued requests are
+// processed as soon as they are due.
 func snapCleanupThread(scw *snapCleanupWorker, s *service) {
-	symLicenseList := make(map[string]bool)
-	var symIDList *types.SymmetrixIDList
-	var err error
-	var tempSnapTag string
-	var delSnapTag string
-
-	tempSnapTag = fmt.Sprintf("%s%s", TempSnap, s.getClusterPrefix())
-	delSnapTag = fmt.Sprintf("%s-%s%s", SnapDelPrefix, CsiVolumePrefix, s.getClusterPrefix())
-
-	for i := 0; i < 10; i++ {
-		symIDList, err = s.adminClient.GetSymmetrixIDList()
-		if err != nil {
-			log.Error("Could not retrieve SymmetrixID list: " + err.Error())
-			time.Sleep(1 * time.Minute)
-		} else if symIDList != nil {
-			break
-		}
-	}
-	if symIDList == nil {
-		panic("Couldn't fetch SymmetrixID list")
-	}
-
-	// Check snapshot license for all connected PowerMax
-	for _, symID := range symIDList.SymmetrixIDs {
-		if err := s.IsSnapshotLicensed(symID); err == nil {
-			symLicenseList[symID] = true
+	// Queue the temporary, deleted and expired snapshots for cleanup
+	scanSnapshots := func() {
+		symIDList, err := s.adminClient.GetSymmetrixIDList()
+		if err != nil || symIDList == nil {
+			log.Errorf("Could not retrieve SymmetrixID list, snapshots are scanned again in %s", expiredSnapshotScanInterval)
+			return
 		}
-	}
-	if symIDList != nil {
 		for _, symID := range symIDList.SymmetrixIDs {
-			if licensed, ok := symLicenseList[symID]; ok {
-				if !licensed {
-					continue
-				}
+			if err := s.IsSnapshotLicensed(symID); err != nil {
+				log.Debugf("Not scanning the snapshots of (%s): %s", symID, err.Error())
+				continue
 			}
-			volList, err := s.adminClient.GetSnapVolumeList(symID, types.QueryParams{
-				types.IncludeDetails: true,
-			})
+			reqs, err := s.findSnapshotsForCleanup(symID)
 			if err != nil {
 				log.Error("Could not retrieve Snapshot IDs to be deleted")
 				continue
-			} else {
-				for _, id := range volList.SymDevice {
-					for _, snap := range id.Snapshot {
-						if snap.Generation == 0 {
-							success, snapID := s.findSnapIDFromSnapName(snap.Name)
-							if success {
-								if (strings.HasPrefix(snapID, tempSnapTag)) ||
-									strings.HasPrefix(snapID, delSnapTag) {
-									// Push the snapshot to cleanup worker
-									var cleanReq snapCleanupRequest
-									cleanReq.snapshotID = snapID
-									cleanReq.symmetrixID = symID
-									cleanReq.volumeID = id.Name
-									log.Debugf("Pushing (%s) on vol (%s) to the queue", snapID, id.Name)
-									snapCleaner.requestCleanup(&cleanReq)
-								}
-							} else {
-								log.Infof("Snapshot ID (%s) is not in supported format", snapID)
-							}
-						}
-					}
-				}
+			}
+			for i := range reqs {
+				scw.requestCleanup(&reqs[i])
 			}
 		}
 	}
+	scanSnapshots()
+	nextScan := time.Now().Add(expiredSnapshotScanInterval)
 	for {
-		req := scw.removeItem()
+		if !time.Now().Before(nextScan) {
+			scanSnapshots()
+			nextScan = time.Now().Add(expiredSnapshotScanInterval)
+		}
+		req, due := scw.removeItem(time.Now())
 		if req != nil {
-			var reqID string
-			if req.requestID == "" {
-				reqID = fmt.Sprintf("ReqID%d", time.Now().Nanosecond())
-			} else {
-				reqID = req.requestID
-			}
-			lockHandle := fmt.Sprintf("%s%s", req.volumeID, req.symmetrixID)
-			lockNum := RequestLock(lockHandle, reqID)
-			err = s.UnlinkAndTerminate(req.symmetrixID, req.volumeID, req.snapshotID)
-			if err != nil {
-				//Check if Snapshot is already deleted
-				if strings.Contains(err.Error(), "Volume is neither a source nor target") {
-					log.Errorf("Snapshot (%s) already terminated from Volume (%s) on PowerMax (%s)", req.snapshotID, req.volumeID, req.symmetrixID)
-				} else {
-					if req.retries == scw.MaxRetries {
-						//push back to the que for retry
-						req.retries++
-						scw.queueForRetry(req)
-					}
-					log.Infof("Could not terminate Snapshot (%s) Error (%s)", req.snapshotID, err.Error())
-				}
-			} else {
-				log.Infof("Snapshot (%s) is terminated from Volume (%s) on PowerMax (%s)", req.snapshotID, req.volumeID, req.symmetrixID)
-			}
-			ReleaseLock(lockHandle, reqID, lockNum)
+			scw.terminateSnapshot(s, req)
+			continue
+		}
+		wait := time.Until(nextScan)
+		if !due.IsZero() && time.Until(due) < wait {
+			wait = time.Until(due)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-scw.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// terminateSnapshot unlinks and terminates the snapshot of a cleanup request. A request
+// which fails is queued again with an increasing delay, up to MaxRetries times.
+func (scw *snapCleanupWorker) terminateSnapshot(s *service, req *snapCleanupRequest) {
+	defer func() {
+		// a failure to clean up a snapshot must not stop the controller
+		if r := recover(); r != nil {
+			log.WithFields(req.fields()).Errorf("Snapshot cleanup failed: %v", r)
+		}
+	}()
+	var reqID string
+	if req.requestID == "" {
+		reqID = fmt.Sprintf("ReqID%d", time.Now().Nanosecond())
+	} else {
+		reqID = req.requestID
+	}
+	lockHandle := fmt.Sprintf("%s%s", req.volumeID, req.symmetrixID)
+	lockNum := RequestLock(lockHandle, reqID)
+	defer ReleaseLock(lockHandle, reqID, lockNum)
+	lockedUntil, locked, err := s.getSnapshotRetention(req.symmetrixID, req.volumeID, req.snapshotID)
+	if err == nil && locked {
+		// Secure snapshots are found again by the next scan, rather than retried until they expire
+		log.Infof("Secure snapshot (%s) on Volume (%s) cannot be terminated until %s", req.snapshotID, req.volumeID, lockedUntil)
+		return
+	}
+	if err == nil {
+		err = s.UnlinkAndTerminate(req.symmetrixID, req.volumeID, req.snapshotID)
+	}
+	if err != nil {
+		//Check if Snapshot is already deleted
+		if strings.Contains(err.Error(), "Volume is neither a source nor target") {
+			log.Errorf("Snapshot (%s) already terminated from Volume (%s) on PowerMax (%s)", req.snapshotID, req.volumeID, req.symmetrixID)
+		} else if req.retries < scw.MaxRetries {
+			//push back to the queue for retry
+			req.retries++
+			backoff := scw.retryBackoff(req.retries)
+			req.notBefore = time.Now().Add(backoff)
+			scw.queueForRetry(req)
+			log.Infof("Could not terminate Snapshot (%s) Error (%s), retrying in %s", req.snapshotID, err.Error(), backoff)
+		} else {
+			log.Errorf("Could not terminate Snapshot (%s) after %d retries Error (%s), it is left to the next scan",
+				req.snapshotID, req.retries, err.Error())
 		}
-		time.Sleep(scw.PollingInterval)
+	} else {
+		log.Infof("Snapshot (%s) is terminated from Volume (%s) on PowerMax (%s)", req.snapshotID, req.volumeID, req.symmetrixID)
 	}
 }
 
@@ -712,3 +757,75 @@ func (s *service) findSnapIDFromSnapName(snapName string) (ok bool, snapID strin
 	snapID = strings.Join(snapComponents[2:len(snapComponents)-1], "-")
 	return
 }
+
+// snapshotTimestampFormat is the format of the snapshot timestamps reported by Unisphere
+const snapshotTimestampFormat = "Mon Jan _2 15:04:05 2006"
+
+// parseSnapshotTimestamp parses the timestamp of a snapshot, which Unisphere reports
+// either formatted, in UTC, or as the number of seconds or milliseconds since the epoch
+func parseSnapshotTimestamp(timestamp string) (time.Time, error) {
+	if t, err := time.ParseInLocation(snapshotTimestampFormat, strings.TrimSpace(timestamp), time.UTC); err == nil {
+		return t, nil
+	}
+	epoch, err := strconv.ParseInt(strings.TrimSpace(timestamp), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Snapshot timestamp (%s) is not in a supported format", timestamp)
+	}
+	return timeFromEpoch(epoch), nil
+}
+
+// timeFromEpoch returns the time of a number of seconds or milliseconds since the epoch
+func timeFromEpoch(epoch int64) time.Time {
+	// timestamps after 2286 in seconds are in milliseconds
+	if epoch > 9999999999 {
+		return time.Unix(0, epoch*int64(time.Millisecond)).UTC()
+	}
+	return time.Unix(epoch, 0).UTC()
+}
+
+// isSnapshotSessionReady returns true once a snapshot session has been established,
+// and all the targets linked to it are defined
+func isSnapshotSessionReady(source types.VolumeSnapshotSource) bool {
+	state := strings.ToLower(source.State)
+	if !strings.HasPrefix(state, "established") && state != "restored" {
+		return false
+	}
+	for _, target := range source.LinkedVolumes {
+		if !target.Defined {
+			return false
+		}
+	}
+	return true
+}
+
+// getCSISnapshot builds the CSI snapshot of a snapshot on the array, with its
+// creation time as reported by the array and ReadyToUse from its session state
+func getCSISnapshot(snapInfo *types.VolumeSnapshot, snapshotID, sourceVolumeID string) *csi.Snapshot {
+	snapshot := &csi.Snapshot{
+		SnapshotId:     snapshotID,
+		SourceVolumeId: sourceVolumeID,
+	}
+	var source *types.VolumeSnapshotSource
+	for i := range snapInfo.VolumeSnapshotSource {
+		// generation 0 is the latest snapshot with this name
+		if snapInfo.VolumeSnapshotSource[i].Generation == 0 {
+			source = &snapInfo.VolumeSnapshotSource[i]
+			break
+		}
+	}
+	if source == nil {
+		log.Warningf("Snapshot (%s) has no session on the array, it is not ready to use", snapshotID)
+		snapshot.CreationTime = ptypes.TimestampNow()
+		return snapshot
+	}
+	snapshot.ReadyToUse = isSnapshotSessionReady(*source)
+	creationTime, err := parseSnapshotTimestamp(source.TimeStamp)
+	if err == nil {
+		snapshot.CreationTime, err = ptypes.TimestampProto(creationTime)
+	}
+	if err != nil {
+		log.Warningf("Using the current time as the creation time of snapshot (%s): %s", snapshotID, err.Error())
+		snapshot.CreationTime = ptypes.TimestampNow()
+	}
+	return snapshot
+}
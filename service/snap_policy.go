@@ -0,0 +1,204 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	types "github.com/dell/gopowermax/types/v90"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxSnapshotTTLDays is the longest time to live of a SnapVX snapshot
+const maxSnapshotTTLDays = 400
+
+// snapshotTTLPattern matches a time to live in hours or days, e.g. 12h or 7d
+var snapshotTTLPattern = regexp.MustCompile(`^([0-9]+)([hd])$`)
+
+var expiredSnapshotScanInterval = 1 * time.Hour // changed for unit testing
+
+// parseSnapshotTTL parses the TTL parameter of a VolumeSnapshotClass and returns the time to live
+// of the snapshot in days, or 0 if it is not set. Snapshots are created with a time to live in days,
+// so a time to live in hours is rounded up to whole days.
+func parseSnapshotTTL(ttl string) (int64, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	return parseDays(SnapshotTTLParam, ttl)
+}
+
+// parseDays parses a snapshot parameter in hours or days, and returns it in whole days
+func parseDays(param, value string) (int64, error) {
+	match := snapshotTTLPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, status.Errorf(codes.InvalidArgument,
+			"An invalid %s parameter was specified: %s, it must be a number of hours or days such as 12h or 7d", param, value)
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil || n == 0 {
+		return 0, status.Errorf(codes.InvalidArgument,
+			"An invalid %s parameter was specified: %s, it must be greater than zero", param, value)
+	}
+	days := n
+	if match[2] == "h" {
+		days = (n + 23) / 24
+		if n%24 != 0 {
+			log.Warningf("%s %s is rounded up to %d days", param, value, days)
+		}
+	}
+	if days > maxSnapshotTTLDays {
+		return 0, status.Errorf(codes.InvalidArgument,
+			"An invalid %s parameter was specified: %s, it must not exceed %d days", param, value, maxSnapshotTTLDays)
+	}
+	return days, nil
+}
+
+// parseMaxSnapshotsPerVolume parses the MaxSnapshotsPerVolume parameter of a VolumeSnapshotClass,
+// and returns 0 if it is not set
+func parseMaxSnapshotsPerVolume(maxSnapshots string) (int, error) {
+	if maxSnapshots == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(maxSnapshots)
+	if err != nil || n <= 0 {
+		return 0, status.Errorf(codes.InvalidArgument,
+			"An invalid %s parameter was specified: %s, it must be a positive number", MaxSnapshotsPerVolumeParam, maxSnapshots)
+	}
+	return n, nil
+}
+
+// pruneSnapshots deletes the oldest snapshots created by the driver on a source volume
+// until no more than maxSnapshots remain. The snapshot which was just created is never pruned.
+// It returns the names of the snapshots which were pruned.
+func (s *service) pruneSnapshots(symID, devID, newSnapID string, maxSnapshots int, reqID string) ([]string, error) {
+	lockHandle := fmt.Sprintf("%s%s", devID, symID)
+	lockNum := RequestLock(lockHandle, reqID)
+	defer ReleaseLock(lockHandle, reqID, lockNum)
+
+	srcSessions, _, err := s.GetSnapSessions(symID, devID)
+	if err != nil {
+		return nil, err
+	}
+	csiSnapTag := fmt.Sprintf("%s%s-", CsiVolumePrefix, s.getClusterPrefix())
+	snapshots := make([]SnapSession, 0)
+	for _, session := range srcSessions {
+		if session.Generation == 0 && strings.HasPrefix(session.Name, csiSnapTag) {
+			snapshots = append(snapshots, session)
+		}
+	}
+	if len(snapshots) <= maxSnapshots {
+		return nil, nil
+	}
+	// oldest first; snapshots with an unknown creation time are pruned first
+	creationTime := func(session SnapSession) time.Time {
+		t, err := parseSnapshotTimestamp(session.Timestamp)
+		if err != nil {
+			return time.Time{}
+		}
+		return t
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return creationTime(snapshots[i]).Before(creationTime(snapshots[j]))
+	})
+
+	pruned := make([]string, 0)
+	excess := len(snapshots) - maxSnapshots
+	for _, session := range snapshots {
+		if len(pruned) == excess {
+			break
+		}
+		if session.Name == newSnapID {
+			continue
+		}
+		if lockedUntil, locked := snapshotRetention(srcSessions, session.Name, time.Now()); locked {
+			log.Infof("Not pruning secure snapshot (%s) of volume (%s) before %s", session.Name, devID, lockedUntil)
+			continue
+		}
+		log.Infof("Pruning snapshot (%s) of volume (%s) as it has more than %d snapshots", session.Name, devID, maxSnapshots)
+		delSnapID, err := s.MarkSnapshotForDeletion(symID, session.Name, devID)
+		if err != nil {
+			return pruned, err
+		}
+		if err := s.UnlinkAndTerminate(symID, devID, delSnapID); err != nil {
+			log.Warningf("Snapshot (%s) is left to the cleanup worker: %s", delSnapID, err.Error())
+			snapCleaner.requestCleanup(&snapCleanupRequest{
+				snapshotID:  delSnapID,
+				symmetrixID: symID,
+				volumeID:    devID,
+				requestID:   reqID,
+			})
+		}
+		pruned = append(pruned, session.Name)
+	}
+	return pruned, nil
+}
+
+// findSnapshotsForCleanup returns the requests to terminate the temporary snapshots, the
+// snapshots marked for deletion and the expired snapshots created by the driver on an array.
+// The array terminates expired snapshots itself unless they are still linked to a volume.
+func (s *service) findSnapshotsForCleanup(symID string) ([]snapCleanupRequest, error) {
+	tempSnapTag := fmt.Sprintf("%s%s", TempSnap, s.getClusterPrefix())
+	delSnapTag := fmt.Sprintf("%s-%s%s", SnapDelPrefix, CsiVolumePrefix, s.getClusterPrefix())
+	csiSnapTag := fmt.Sprintf("%s%s-", CsiVolumePrefix, s.getClusterPrefix())
+
+	volList, err := s.adminClient.GetSnapVolumeList(symID, types.QueryParams{
+		types.IncludeDetails: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]snapCleanupRequest, 0)
+	for _, id := range volList.SymDevice {
+		checkExpiry := false
+		for _, snap := range id.Snapshot {
+			if snap.Generation != 0 {
+				continue
+			}
+			success, snapID := s.findSnapIDFromSnapName(snap.Name)
+			if !success {
+				log.Infof("Snapshot ID (%s) is not in supported format", snapID)
+				continue
+			}
+			if strings.HasPrefix(snapID, tempSnapTag) || strings.HasPrefix(snapID, delSnapTag) {
+				log.Debugf("Pushing (%s) on vol (%s) to the queue", snapID, id.Name)
+				reqs = append(reqs, snapCleanupRequest{snapshotID: snapID, symmetrixID: symID, volumeID: id.Name})
+			} else if strings.HasPrefix(snapID, csiSnapTag) {
+				checkExpiry = true
+			}
+		}
+		if !checkExpiry {
+			continue
+		}
+		srcSessions, _, err := s.GetSnapSessions(symID, id.Name)
+		if err != nil {
+			log.Errorf("Could not check the expiry of the snapshots on vol (%s): %s", id.Name, err.Error())
+			continue
+		}
+		for _, session := range srcSessions {
+			if session.Expired && session.Generation == 0 && strings.HasPrefix(session.Name, csiSnapTag) {
+				log.Debugf("Pushing expired snapshot (%s) on vol (%s) to the queue", session.Name, id.Name)
+				reqs = append(reqs, snapCleanupRequest{snapshotID: session.Name, symmetrixID: symID, volumeID: id.Name})
+			}
+		}
+	}
+	return reqs, nil
+}
@@ -0,0 +1,375 @@
+/*
+ Copyright © 2020 Dell Inc. or its subsidiaries. All Rights Reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+      http://www.apache.org/licenses/LICENSE-2.0
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dell/gofsutil"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultStaleDeviceCheckInterval is how often the node looks for stale devices
+// if X_CSI_POWERMAX_STALE_DEVICE_CHECK_INTERVAL is not set
+const defaultStaleDeviceCheckInterval = 10 * time.Minute
+
+// Prefixes of the /dev/disk/by-id links of PowerMax devices. All PowerMax WWNs
+// start with the EMC Symmetrix OUI, followed by the array serial number.
+const (
+	powerMaxWWNPrefix       = "60000970"
+	diskByIDWWNPrefix       = "wwn-0x"
+	diskByIDMultipathPrefix = "dm-uuid-mpath-3"
+)
+
+var diskByIDDir = "/dev/disk/by-id" // changed for unit testing
+
+// driverDeviceSuffix is the suffix of the files in privDir which record the WWNs of the
+// devices of the driver, until the devices are gone from the node
+const driverDeviceSuffix = ".device"
+
+// staleDeviceMetrics publishes the number of stale devices removed from the node
+var staleDeviceMetrics = expvar.NewInt("powermax_stale_devices_removed")
+
+// staleDeviceState holds the devices found to be stale by the last check, which
+// are removed if they are still stale on the next check
+type staleDeviceState struct {
+	sync.Mutex
+	collectorStarted bool
+	candidates       map[string]bool
+}
+
+// startStaleDeviceCollector starts a goroutine which periodically removes the PowerMax
+// devices of the driver which the array no longer maps to the node, e.g. because the
+// volume was unpublished after disconnectVolume exceeded its retry limit.
+// It is only started once.
+func (s *service) startStaleDeviceCollector() {
+	interval := s.opts.StaleDeviceCheckInterval
+	if interval <= 0 {
+		log.Info("Stale device collector is disabled")
+		return
+	}
+	s.staleDevices.Lock()
+	defer s.staleDevices.Unlock()
+	if s.staleDevices.collectorStarted {
+		return
+	}
+	s.staleDevices.collectorStarted = true
+	log.Infof("Starting stale device collector, checking every %s", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if s.isNodeInitialized() {
+				s.removeStaleDevices()
+			}
+		}
+	}()
+}
+
+// wwnFromDiskByIDName returns the WWN of a PowerMax device from the name of
+// its /dev/disk/by-id link, or an empty string if it is not a PowerMax device
+func wwnFromDiskByIDName(name string) string {
+	var wwn string
+	switch {
+	case strings.HasPrefix(name, diskByIDWWNPrefix):
+		wwn = strings.TrimPrefix(name, diskByIDWWNPrefix)
+	case strings.HasPrefix(name, diskByIDMultipathPrefix):
+		wwn = strings.TrimPrefix(name, diskByIDMultipathPrefix)
+	default:
+		return ""
+	}
+	// partitions have a -partN suffix
+	if strings.Contains(wwn, "-") || !strings.HasPrefix(wwn, powerMaxWWNPrefix) {
+		return ""
+	}
+	return wwn
+}
+
+// symIDFromWWN returns the serial number of the array of a PowerMax device WWN
+func symIDFromWWN(wwn string) string {
+	if len(wwn) < len(powerMaxWWNPrefix)+12 {
+		return ""
+	}
+	return wwn[len(powerMaxWWNPrefix) : len(powerMaxWWNPrefix)+12]
+}
+
+// getNodeDevices returns the devices of each PowerMax WWN found in /dev/disk/by-id
+func getNodeDevices() (map[string][]string, error) {
+	entries, err := ioutil.ReadDir(diskByIDDir)
+	if err != nil {
+		return nil, err
+	}
+	devices := make(map[string][]string)
+	for _, entry := range entries {
+		wwn := wwnFromDiskByIDName(entry.Name())
+		if wwn == "" {
+			continue
+		}
+		devicePath, err := filepath.EvalSymlinks(filepath.Join(diskByIDDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		devices[wwn] = append(devices[wwn], devicePath)
+	}
+	return devices, nil
+}
+
+// getStagedWWNs returns the WWNs of the volumes staged on the node, from the WWN files in privDir
+func (s *service) getStagedWWNs() (map[string]bool, error) {
+	files, err := filepath.Glob(filepath.Join(s.privDir, "*.wwn"))
+	if err != nil {
+		return nil, err
+	}
+	wwns := make(map[string]bool)
+	for _, file := range files {
+		wwn, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		wwns[strings.ToLower(strings.TrimSpace(string(wwn)))] = true
+	}
+	return wwns, nil
+}
+
+// recordDriverDevice records in privDir that the device of a WWN is a device of the driver,
+// so that it is known to be one after the node plugin restarts
+func (s *service) recordDriverDevice(wwn string) error {
+	fileName := filepath.Join(s.privDir, strings.ToLower(wwn)+driverDeviceSuffix)
+	return ioutil.WriteFile(fileName, []byte{}, 0644)
+}
+
+// getDriverDevices returns the WWNs of the devices recorded as devices of the driver
+func (s *service) getDriverDevices() (map[string]bool, error) {
+	files, err := filepath.Glob(filepath.Join(s.privDir, "*"+driverDeviceSuffix))
+	if err != nil {
+		return nil, err
+	}
+	wwns := make(map[string]bool)
+	for _, file := range files {
+		wwns[strings.TrimSuffix(filepath.Base(file), driverDeviceSuffix)] = true
+	}
+	return wwns, nil
+}
+
+// removeDriverDevice removes the record of a device of the driver
+func (s *service) removeDriverDevice(wwn string) {
+	os.Remove(filepath.Join(s.privDir, strings.ToLower(wwn)+driverDeviceSuffix))
+}
+
+// getMountedDevices returns the devices which have a filesystem or bind mount on the node
+func getMountedDevices(ctx context.Context) (map[string]bool, error) {
+	mounts, err := gofsutil.GetMounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	devices := make(map[string]bool)
+	for _, mnt := range mounts {
+		for _, device := range []string{mnt.Device, mnt.Source} {
+			if device == "" {
+				continue
+			}
+			devices[device] = true
+			if devicePath, err := filepath.EvalSymlinks(device); err == nil {
+				devices[devicePath] = true
+			}
+		}
+	}
+	return devices, nil
+}
+
+// deviceIsHeld returns true if one of the paths of a device has partitions, or holders
+// other than the multipath device of its paths, e.g. LVM or a partition mapping
+func deviceIsHeld(paths []string) bool {
+	names := make(map[string]bool)
+	for _, path := range paths {
+		names[filepath.Base(path)] = true
+	}
+	for name := range names {
+		holders, _ := ioutil.ReadDir(filepath.Join(sysBlock, name, "holders"))
+		for _, holder := range holders {
+			if !names[holder.Name()] {
+				return true
+			}
+		}
+		entries, _ := ioutil.ReadDir(filepath.Join(sysBlock, name))
+		for _, entry := range entries {
+			if entry.IsDir() && strings.HasPrefix(entry.Name(), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getNodeMappedWWNs returns the WWNs of the volumes in the storage groups of the
+// masking views of the node on an array
+func (s *service) getNodeMappedWWNs(symID string) (map[string]bool, error) {
+	sgList, err := s.adminClient.GetStorageGroupIDList(symID)
+	if err != nil {
+		return nil, err
+	}
+	wwns := make(map[string]bool)
+	for _, obj := range s.getNodeObjects(s.getHostNodeName()) {
+		if !contains(sgList.StorageGroupIDs, obj.storageGroupID) {
+			continue
+		}
+		volumeIDs, err := s.adminClient.GetVolumeIDListInStorageGroup(symID, obj.storageGroupID)
+		if err != nil {
+			return nil, err
+		}
+		for _, volumeID := range volumeIDs {
+			vol, err := s.adminClient.GetVolumeByID(symID, volumeID)
+			if err != nil {
+				return nil, err
+			}
+			if contains(vol.StorageGroupIDList, obj.storageGroupID) {
+				wwns[strings.ToLower(vol.WWN)] = true
+			}
+		}
+	}
+	return wwns, nil
+}
+
+// removeStaleDevices flushes and removes the stale PowerMax devices of the node.
+// A device is stale if it is neither staged, mounted, partitioned nor held by another
+// device, if it is a device of the driver, and if the array no longer maps it to the
+// node. The devices staged or found mapped to the node by the driver are recorded as
+// devices of the driver in privDir until they are gone from the node, so that devices
+// left behind before the node plugin restarted are still removed. Devices the driver
+// never used, e.g. boot devices, are never removed. A device must be found stale by two
+// consecutive checks before it is removed.
+// It returns the WWNs of the devices which were removed.
+func (s *service) removeStaleDevices() []string {
+	devices, err := getNodeDevices()
+	if err != nil {
+		log.Errorf("Stale device collector: unable to list the devices: %s", err.Error())
+		return nil
+	}
+	staged, err := s.getStagedWWNs()
+	if err != nil {
+		log.Errorf("Stale device collector: unable to read the WWN files: %s", err.Error())
+		return nil
+	}
+	mounted, err := getMountedDevices(context.Background())
+	if err != nil {
+		log.Errorf("Stale device collector: unable to get the mounts: %s", err.Error())
+		return nil
+	}
+
+	driverDevices, err := s.getDriverDevices()
+	if err != nil {
+		log.Errorf("Stale device collector: unable to read the devices of the driver: %s", err.Error())
+		return nil
+	}
+	for wwn := range driverDevices {
+		if _, ok := devices[wwn]; !ok {
+			s.removeDriverDevice(wwn)
+		}
+	}
+	s.staleDevices.Lock()
+	previous := s.staleDevices.candidates
+	s.staleDevices.Unlock()
+
+	unused := make(map[string][]string)
+	for wwn, paths := range devices {
+		if staged[strings.ToLower(wwn)] {
+			s.addDriverDevice(driverDevices, wwn)
+			continue
+		}
+		inUse := false
+		for _, path := range paths {
+			if mounted[path] {
+				inUse = true
+				break
+			}
+		}
+		if inUse || deviceIsHeld(paths) {
+			continue
+		}
+		unused[wwn] = paths
+	}
+
+	// the arrays are only queried for the devices which are unused
+	mapped := make(map[string]map[string]bool)
+	for wwn := range unused {
+		symID := symIDFromWWN(wwn)
+		if _, ok := mapped[symID]; ok {
+			continue
+		}
+		wwns, err := s.getNodeMappedWWNs(symID)
+		if err != nil {
+			log.Errorf("Stale device collector: unable to get the volumes mapped to the node by %s, its devices are kept: %s", symID, err.Error())
+		}
+		mapped[symID] = wwns
+	}
+
+	candidates := make(map[string]bool)
+	removed := make([]string, 0)
+	for wwn, paths := range unused {
+		symID := symIDFromWWN(wwn)
+		if mapped[symID] == nil {
+			continue
+		}
+		if mapped[symID][strings.ToLower(wwn)] {
+			// mapped to the node by the driver, it is about to be staged
+			s.addDriverDevice(driverDevices, wwn)
+			continue
+		}
+		if !driverDevices[wwn] {
+			log.Debugf("Stale device collector: device %s %v was not used by the driver, it is kept", wwn, paths)
+			continue
+		}
+		if !previous[wwn] {
+			log.Infof("Stale device collector: device %s %v is no longer mapped to the node, it will be removed if still unused on the next check", wwn, paths)
+			candidates[wwn] = true
+			continue
+		}
+		log.WithFields(log.Fields{"SymmetrixID": symID, "WWN": wwn, "Devices": paths}).Warning("Stale device collector: removing stale device")
+		if err := s.disconnectVolume("", symID, "", wwn, ""); err != nil {
+			log.Errorf("Stale device collector: unable to remove device %s: %s", wwn, err.Error())
+			candidates[wwn] = true
+			continue
+		}
+		s.removeDriverDevice(wwn)
+		removed = append(removed, wwn)
+		staleDeviceMetrics.Add(1)
+	}
+	if len(removed) > 0 {
+		log.Infof("Stale device collector: removed %d stale devices: %v", len(removed), removed)
+	}
+
+	s.staleDevices.Lock()
+	s.staleDevices.candidates = candidates
+	s.staleDevices.Unlock()
+	return removed
+}
+
+// addDriverDevice records a device as a device of the driver, if it is not recorded yet
+func (s *service) addDriverDevice(driverDevices map[string]bool, wwn string) {
+	if driverDevices[wwn] {
+		return
+	}
+	if err := s.recordDriverDevice(wwn); err != nil {
+		log.Errorf("Stale device collector: unable to record device %s as a device of the driver: %s", wwn, err.Error())
+	}
+	driverDevices[wwn] = true
+}
@@ -14,13 +14,20 @@
 package service
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -39,6 +46,7 @@ import (
 	ptypes "github.com/golang/protobuf/ptypes"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/metadata"
+	yaml "gopkg.in/yaml.v2"
 
 	types "github.com/dell/gopowermax/types/v90"
 )
@@ -67,11 +75,15 @@ const (
 	nodePublishSymlinkDir      = "test/dev/disk/by-id"
 	nodePublishPathSymlinkDir  = "test/dev/disk/by-path"
 	nodePublishPrivateDir      = "test/tmp"
+	nodePublishSysBlockDir     = "test/sys/block"
 	nodePublishWWN             = "60000970000197900046533030300501"
 	nodePublishAltWWN          = "60000970000197900046533030300502"
 	nodePublishLUNID           = "3"
 	iSCSIEtcDir                = "test/etc/iscsi"
 	iSCSIEtcFile               = "initiatorname.iscsi"
+	defaultNQN                 = "nqn.2014-08.org.nvmexpress:uuid:csi-test-node"
+	defaultNVMeDirPort         = "OR-1C:001"
+	defaultNVMeSubsystemNQN    = "nqn.1988-11.com.dell:powermax:00:000197900046"
 	goodSnapID                 = "444-444"
 	altSnapID                  = "555-555"
 	defaultStorageGroup        = "DefaultStorageGroup"
@@ -128,6 +140,14 @@ type feature struct {
 	noNodeID                             bool
 	omitAccessMode, omitVolumeCapability bool
 	wrongCapacity, wrongStoragePool      bool
+	cloneServiceLevel                    string
+	prunedSnapshots                      []string
+	adoptedVolume                        *types.Volume
+	modifiedStorageGroup                 *types.StorageGroup
+	removedStaleDevices                  []string
+	persistentVolume                     string
+	orphanReport                         *orphanReport
+	decommissioned                       []string
 	useAccessTypeMount                   bool
 	capability                           *csi.VolumeCapability
 	capabilities                         []*csi.VolumeCapability
@@ -138,6 +158,7 @@ type feature struct {
 	snapshotNameToID                     map[string]string
 	snapshotIndex                        int
 	selectedPortGroup                    string
+	selectedPortGroups                   []string
 	sgID                                 string
 	mvID                                 string
 	hostID                               string
@@ -150,6 +171,7 @@ type feature struct {
 	lastUnmounted                        bool
 	errType                              string
 	isSnapSrc                            bool
+	mkfsCommands                         []string
 }
 
 var inducedErrors struct {
@@ -190,6 +212,7 @@ func (f *feature) aPowerMaxService() error {
 	f.lastTime = now
 	induceOverloadError = false
 	gofsutil.GOFSWWNPath = "test/dev/disk/by-id/wwn-0x"
+	diskByIDDir = nodePublishSymlinkDir
 	nodePublishSleepTime = 5 * time.Millisecond
 	removeDeviceSleepTime = 5 * time.Millisecond
 	targetMountRecheckSleepTime = 30 * time.Millisecond
@@ -216,6 +239,11 @@ func (f *feature) aPowerMaxService() error {
 	f.getPluginCapabilitiesResponse = nil
 	f.probeResponse = nil
 	f.createVolumeResponse = nil
+	f.mkfsCommands = nil
+	execCommand = fakeBlockdevCommand
+	sysBlock = nodePublishSysBlockDir
+	os.RemoveAll(nodePublishSysBlockDir)
+	iscsiPasswordCommands = nil
 	f.nodeGetInfoResponse = nil
 	f.nodeGetCapabilitiesResponse = nil
 	f.getCapacityResponse = nil
@@ -231,6 +259,14 @@ func (f *feature) aPowerMaxService() error {
 	f.useAccessTypeMount = false
 	f.wrongCapacity = false
 	f.wrongStoragePool = false
+	f.cloneServiceLevel = ""
+	f.prunedSnapshots = nil
+	f.adoptedVolume = nil
+	f.modifiedStorageGroup = nil
+	f.removedStaleDevices = nil
+	f.orphanReport = nil
+	f.decommissioned = nil
+	f.persistentVolume = ""
 	f.deleteVolumeRequest = nil
 	f.deleteVolumeResponse = nil
 	f.listVolumesRequest = nil
@@ -247,6 +283,8 @@ func (f *feature) aPowerMaxService() error {
 	f.volumeIDList = f.volumeIDList[:0]
 	f.sgID = ""
 	f.mvID = ""
+	f.selectedPortGroups = nil
+	pgRoundRobin.next = make(map[string]int)
 	f.hostID = ""
 	f.initiators = make([]string, 0)
 	f.ninitiators = 0
@@ -304,6 +342,7 @@ func (f *feature) aPowerMaxService() error {
 	f.getService()
 	f.service.storagePoolCacheDuration = 4 * time.Hour
 	f.service.SetPmaxTimeoutSeconds(3)
+	f.service.orphanAudit.emptyStorageGroups = nil
 
 	// create the mock iscsi client
 	f.service.iscsiClient = goiscsi.NewMockISCSI(map[string]string{})
@@ -328,7 +367,7 @@ func (f *feature) aPowerMaxService() error {
 
 	// Make sure the snapshot cleanup thread is started.
 	f.service.startSnapCleanupWorker()
-	snapCleaner.PollingInterval = 2 * time.Second
+	snapCleaner.RetryInterval = 2 * time.Second
 	// Start the lock workers
 	f.service.StartLockManager(1 * time.Minute)
 	// Make sure the deletion worker is started.
@@ -365,6 +404,7 @@ func (f *feature) getService() *service {
 	opts.Insecure = true
 	opts.DisableCerts = true
 	opts.EnableBlock = true
+	opts.ClusterFsTypes = defaultClusterFsTypes
 	opts.PortGroups = []string{"portgroup1", "portgroup2"}
 	mock.AddPortGroup("portgroup1", "ISCSI", []string{defaultISCSIDirPort1, defaultISCSIDirPort2})
 	mock.AddPortGroup("portgroup2", "ISCSI", []string{defaultISCSIDirPort1, defaultISCSIDirPort2})
@@ -384,7 +424,9 @@ ip6t_rpfilter          12595  1
 	svc.arrayTransportProtocolMap[mock.DefaultSymmetrixID] = IscsiTransportProtocol
 	svc.fcConnector = &mockFCGobrick{}
 	svc.iscsiConnector = &mockISCSIGobrick{}
+	svc.nvmeConnector = &mockNVMeGobrick{}
 	mockGobrickReset()
+	nvmeDevDir = nodePublishDeviceDir
 	disconnectVolumeRetryTime = 10 * time.Millisecond
 	f.service = svc
 	return svc
@@ -695,6 +737,173 @@ func (f *feature) iSpecifyAApplicationPrefix() error {
 	return nil
 }
 
+func (f *feature) iSpecifyFsCheck(fsCheck string) error {
+	req := f.getTypicalCreateVolumeRequest()
+	params := req.GetParameters()
+	params[FsCheckParam] = fsCheck
+	req.Parameters = params
+	f.createVolumeRequest = req
+	return nil
+}
+
+func (f *feature) iSpecifyMkfsOptionsForFstype(options, fstype string) error {
+	req := f.getTypicalCreateVolumeRequest()
+	req.Parameters[MkfsOptionsParam] = options
+	req.VolumeCapabilities[0].AccessType = &csi.VolumeCapability_Mount{
+		Mount: &csi.VolumeCapability_MountVolume{FsType: fstype},
+	}
+	f.createVolumeRequest = req
+	return nil
+}
+
+func (f *feature) iSpecifyAllowMultiWriterMountForFstype(allow, fstype string) error {
+	req := f.getTypicalCreateVolumeRequest()
+	req.Parameters[MultiWriterMountParam] = allow
+	req.VolumeCapabilities[0].AccessType = &csi.VolumeCapability_Mount{
+		Mount: &csi.VolumeCapability_MountVolume{FsType: fstype},
+	}
+	req.VolumeCapabilities[0].AccessMode = &csi.VolumeCapability_AccessMode{
+		Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+	}
+	f.createVolumeRequest = req
+	return nil
+}
+
+func (f *feature) theNodePublishVolumeRequestAllowsMultiWriterMounts(allow string) error {
+	if f.nodePublishVolumeRequest == nil {
+		return errors.New("No NodePublishVolumeRequest")
+	}
+	f.nodePublishVolumeRequest.VolumeContext[MultiWriterMountParam] = allow
+	return nil
+}
+
+func (f *feature) theVolumeDeviceIsFormattedWith(fsType string) error {
+	if fsType != "none" {
+		gofsutil.GOFSMock.InduceGetDiskFormatType = fsType
+	}
+	return nil
+}
+
+func (f *feature) deviceIsMountedOutsideOfTheDriver(device string) error {
+	gofsutil.GOFSMockMounts = append(gofsutil.GOFSMockMounts, gofsutil.Info{
+		Device: device,
+		Path:   "test/mnt/cluster",
+		Source: device,
+	})
+	return nil
+}
+
+func (f *feature) thePrivateMountOfTheVolumeRemains(remains string) error {
+	privTgt := getPrivateMountPoint(f.service.privDir, f.nodePublishVolumeRequest.VolumeId)
+	found := false
+	for _, mnt := range gofsutil.GOFSMockMounts {
+		found = found || mnt.Path == privTgt
+	}
+	if found != (remains == "true") {
+		return fmt.Errorf("Expected the private mount %s to remain %s", privTgt, remains)
+	}
+	return nil
+}
+
+func (f *feature) theNodePublishVolumeRequestHasMkfsOptions(options string) error {
+	if f.nodePublishVolumeRequest == nil {
+		return errors.New("No NodePublishVolumeRequest")
+	}
+	f.nodePublishVolumeRequest.VolumeContext[MkfsOptionsParam] = options
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		f.mkfsCommands = append(f.mkfsCommands, name+" "+strings.Join(args, " "))
+		return exec.Command("true")
+	}
+	return nil
+}
+
+func (f *feature) mkfsIsRunWith(command string) error {
+	for _, cmd := range f.mkfsCommands {
+		if strings.HasPrefix(cmd, command) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Expected mkfs to be run with %s but the commands run were %v", command, f.mkfsCommands)
+}
+
+// fakeBlockdevCommand runs all commands except blockdev, which cannot set the test devices
+// read only. It records their read only state in sysBlock instead.
+// iscsiPasswordCommands are the iscsiadm commands run by setISCSIPassword
+var iscsiPasswordCommands []*exec.Cmd
+
+func fakeBlockdevCommand(name string, args ...string) *exec.Cmd {
+	if name == "sh" && len(args) > 2 && args[2] == "iscsiadm" {
+		cmd := exec.Command("true", args...)
+		iscsiPasswordCommands = append(iscsiPasswordCommands, cmd)
+		return cmd
+	}
+	if name != "blockdev" || len(args) != 2 {
+		return exec.Command(name, args...)
+	}
+	ro := "0"
+	if args[0] == "--setro" {
+		ro = "1"
+	}
+	if err := setTestDeviceReadOnly(args[1], ro); err != nil {
+		return exec.Command("false")
+	}
+	return exec.Command("true")
+}
+
+func setTestDeviceReadOnly(device, ro string) error {
+	dir := filepath.Join(sysBlock, filepath.Base(device))
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "ro"), []byte(ro+"\n"), 0644)
+}
+
+func (f *feature) iSetTheRequestReadOnly(readOnly string) error {
+	f.nodePublishVolumeRequest.Readonly = readOnly == "true"
+	return nil
+}
+
+func (f *feature) theVolumeDeviceIsSetReadOnly() error {
+	return setTestDeviceReadOnly(nodePublishBlockDevicePath, "1")
+}
+
+func (f *feature) theVolumeDeviceIsReadOnly(expected string) error {
+	readOnly := isDeviceReadOnly(&Device{RealDev: nodePublishBlockDevicePath})
+	if fmt.Sprintf("%t", readOnly) != expected {
+		return fmt.Errorf("Expected the volume device to be read only %s but it was %t", expected, readOnly)
+	}
+	return nil
+}
+
+func (f *feature) theTargetIsMountedReadOnly(expected string) error {
+	for _, mnt := range gofsutil.GOFSMockMounts {
+		if mnt.Path == f.nodePublishVolumeRequest.TargetPath {
+			if readOnly := contains(mnt.Opts, "ro"); fmt.Sprintf("%t", readOnly) != expected {
+				return fmt.Errorf("Expected the target to be mounted read only %s but the mount options were %v", expected, mnt.Opts)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Target %s is not mounted", f.nodePublishVolumeRequest.TargetPath)
+}
+
+func (f *feature) mkfsIsRunTimes(count int) error {
+	if len(f.mkfsCommands) != count {
+		return fmt.Errorf("Expected mkfs to be run %d times but the commands run were %v", count, f.mkfsCommands)
+	}
+	return nil
+}
+
+func (f *feature) theVolumeContextContains(key, value string) error {
+	if f.createVolumeResponse == nil {
+		return errors.New("No CreateVolumeResponse returned")
+	}
+	if actual := f.createVolumeResponse.GetVolume().GetVolumeContext()[key]; actual != value {
+		return fmt.Errorf("Expected VolumeContext %s to be %s but it was %s", key, value, actual)
+	}
+	return nil
+}
+
 func (f *feature) iSpecifyAStorageGroup() error {
 	req := f.getTypicalCreateVolumeRequest()
 	params := req.GetParameters()
@@ -801,6 +1010,8 @@ func (f *feature) iInduceError(errtype string) error {
 		mock.InducedErrors.DeleteStorageGroupError = true
 	case "GetPortGroupError":
 		mock.InducedErrors.GetPortGroupError = true
+	case "CreatePortGroupError":
+		mock.InducedErrors.CreatePortGroupError = true
 	case "GetPortError":
 		mock.InducedErrors.GetPortError = true
 	case "GetDirectorError":
@@ -1174,6 +1385,12 @@ func (f *feature) iHaveANodeWithHost(nodeID string) error {
 		initID := defaultFCDirPort + ":" + initiator
 		mock.AddInitiator(initID, initiator, "Fibre", []string{defaultFCDirPort}, "")
 		mock.AddHost(f.hostID, "Fibre", initiators)
+	} else if isNVMeTransportProtocol(transportProtocol) {
+		f.hostID, _, _ = f.service.GetHostSGAndMVIDFromNodeID(nodeID, transportProtocol)
+		initiators := []string{defaultNQN}
+		initID := defaultNVMeDirPort + ":" + defaultNQN
+		mock.AddInitiator(initID, defaultNQN, "Fibre", []string{defaultNVMeDirPort}, "")
+		mock.AddHost(f.hostID, "Fibre", initiators)
 	} else {
 		f.hostID, _, _ = f.service.GetISCSIHostSGAndMVIDFromNodeID(nodeID)
 		initiator := defaultIscsiInitiator
@@ -2216,12 +2433,21 @@ func (f *feature) iCallCreateSnapshotWith(SnapID string) error {
 }
 
 func (f *feature) iCallCreateSnapshotOn(snapshotName, volumeName string) error {
+	return f.createSnapshotOn(snapshotName, volumeName, nil)
+}
+
+func (f *feature) iCallCreateSnapshotOnWithParameter(snapshotName, volumeName, key, value string) error {
+	return f.createSnapshotOn(snapshotName, volumeName, map[string]string{key: value})
+}
+
+func (f *feature) createSnapshotOn(snapshotName, volumeName string, params map[string]string) error {
 	header := metadata.New(map[string]string{"csi.requestid": "1"})
 	ctx := metadata.NewIncomingContext(context.Background(), header)
 
 	req := &csi.CreateSnapshotRequest{
 		SourceVolumeId: f.volumeNameToID[volumeName],
 		Name:           snapshotName,
+		Parameters:     params,
 	}
 	f.createSnapshotResponse, f.err = f.service.CreateSnapshot(ctx, req)
 	if f.createSnapshotResponse != nil {
@@ -2240,6 +2466,328 @@ func (f *feature) aValidCreateSnapshotResponseIsReturned() error {
 	return nil
 }
 
+func (f *feature) theSnapshotHasStateAndTimestamp(snapshotName, state, timestamp string) error {
+	snapID, _, devID, err := f.service.parseCsiID(f.snapshotNameToID[snapshotName])
+	if err != nil {
+		return err
+	}
+	snap := mock.Data.VolIDToSnapshots[devID][snapID]
+	if snap == nil {
+		return fmt.Errorf("Snapshot %s not found on %s", snapID, devID)
+	}
+	snap.State = state
+	snap.Timestamp = timestamp
+	return nil
+}
+
+func (f *feature) theSnapshotIsReadyToUseWithCreationTime(ready, creationTime string) error {
+	snapshot := f.createSnapshotResponse.GetSnapshot()
+	if snapshot.GetReadyToUse() != (ready == "true") {
+		return fmt.Errorf("Expected ReadyToUse %s but got %t", ready, snapshot.GetReadyToUse())
+	}
+	if ptypes.TimestampString(snapshot.GetCreationTime()) != creationTime {
+		return fmt.Errorf("Expected CreationTime %s but got %s", creationTime, ptypes.TimestampString(snapshot.GetCreationTime()))
+	}
+	return nil
+}
+
+func (f *feature) theSnapshotExistsOnTheArray(snapshotName, exists string) error {
+	snapID, _, devID, err := f.service.parseCsiID(f.snapshotNameToID[snapshotName])
+	if err != nil {
+		return err
+	}
+	found := mock.Data.VolIDToSnapshots[devID][snapID] != nil
+	if found != (exists == "true") {
+		return fmt.Errorf("Expected snapshot %s to exist %s but it exists %t", snapID, exists, found)
+	}
+	return nil
+}
+
+func (f *feature) iPruneTheSnapshotsOfKeepingExcept(volumeName string, maxSnapshots int, snapshotName string) error {
+	_, symID, devID, err := f.service.parseCsiID(f.volumeNameToID[volumeName])
+	if err != nil {
+		return err
+	}
+	snapID, _, _, err := f.service.parseCsiID(f.snapshotNameToID[snapshotName])
+	if err != nil {
+		return err
+	}
+	f.prunedSnapshots, f.err = f.service.pruneSnapshots(symID, devID, snapID, maxSnapshots, "1")
+	return nil
+}
+
+// the mock drops the other snapshots of a volume when a snapshot is renamed for deletion,
+// so the snapshots chosen to be pruned are checked rather than the snapshots left
+func (f *feature) thePrunedSnapshotsAre(snapshotNames string) error {
+	expected := make([]string, 0)
+	for _, name := range strings.Split(snapshotNames, ",") {
+		if name == "" {
+			continue
+		}
+		snapID, _, _, err := f.service.parseCsiID(f.snapshotNameToID[name])
+		if err != nil {
+			return err
+		}
+		expected = append(expected, snapID)
+	}
+	if strings.Join(f.prunedSnapshots, ",") != strings.Join(expected, ",") {
+		return fmt.Errorf("Expected the pruned snapshots to be %v but got %v", expected, f.prunedSnapshots)
+	}
+	return nil
+}
+
+func (f *feature) aLegacyDeviceNamedInStorageGroup(devID, name, sgID string) error {
+	if _, ok := mock.Data.StorageGroupIDToStorageGroup[sgID]; !ok {
+		if _, err := mock.AddStorageGroup(sgID, "SRP_1", "Bronze"); err != nil {
+			return err
+		}
+	}
+	return mock.AddNewVolume(devID, name, 100, sgID)
+}
+
+func (f *feature) aLegacyDeviceNamedInTheMaskingViewOfTheNode(devID, name string) error {
+	return mock.AddNewVolume(devID, name, 100, f.sgID)
+}
+
+func (f *feature) iAdoptTheDeviceAsWithRenameAndServiceLevel(devID, name, rename, serviceLevel string) error {
+	req := &adoptRequest{
+		symID:         f.symmetrixID,
+		devID:         devID,
+		name:          name,
+		rename:        rename == "true",
+		srp:           "SRP_1",
+		serviceLevel:  serviceLevel,
+		fsType:        "xfs",
+		volumeMode:    "Filesystem",
+		accessMode:    "ReadWriteOnce",
+		reclaimPolicy: "Retain",
+	}
+	f.adoptedVolume, f.err = f.service.adoptVolume(req)
+	if f.err != nil {
+		return nil
+	}
+	var pv bytes.Buffer
+	if err := f.service.writePersistentVolume(&pv, req, f.adoptedVolume); err != nil {
+		return err
+	}
+	f.persistentVolume = pv.String()
+	return nil
+}
+
+func (f *feature) theDeviceIsNamedInStorageGroup(devID, name, sgID string) error {
+	vol := mock.Data.VolumeIDToVolume[devID]
+	if vol == nil {
+		return fmt.Errorf("Device %s does not exist", devID)
+	}
+	if vol.VolumeIdentifier != name {
+		return fmt.Errorf("Expected device %s to be named %s but it is named %s", devID, name, vol.VolumeIdentifier)
+	}
+	if !stringSlicesEqual(vol.StorageGroupIDList, []string{sgID}) {
+		return fmt.Errorf("Expected device %s to be in storage group %s but it is in %v", devID, sgID, vol.StorageGroupIDList)
+	}
+	return nil
+}
+
+func (f *feature) thePersistentVolumeHasAValidVolumeHandle(name string) error {
+	var pv struct {
+		Metadata struct {
+			Name string `yaml:"name"`
+		} `yaml:"metadata"`
+		Spec struct {
+			Capacity struct {
+				Storage int64 `yaml:"storage"`
+			} `yaml:"capacity"`
+			CSI struct {
+				Driver           string            `yaml:"driver"`
+				VolumeHandle     string            `yaml:"volumeHandle"`
+				FsType           string            `yaml:"fsType"`
+				VolumeAttributes map[string]string `yaml:"volumeAttributes"`
+			} `yaml:"csi"`
+		} `yaml:"spec"`
+	}
+	if err := yaml.Unmarshal([]byte(f.persistentVolume), &pv); err != nil {
+		return fmt.Errorf("Invalid PersistentVolume %s: %s", f.persistentVolume, err.Error())
+	}
+	if pv.Metadata.Name != name || pv.Spec.CSI.Driver != Name || pv.Spec.CSI.FsType != "xfs" {
+		return fmt.Errorf("Unexpected PersistentVolume %s", f.persistentVolume)
+	}
+	if pv.Spec.Capacity.Storage != int64(f.adoptedVolume.CapacityCYL)*cylinderSizeInBytes {
+		return fmt.Errorf("Unexpected capacity %d for a device of %d cylinders", pv.Spec.Capacity.Storage, f.adoptedVolume.CapacityCYL)
+	}
+	_, devID, vol, err := f.service.GetVolumeByID(pv.Spec.CSI.VolumeHandle)
+	if err != nil {
+		return err
+	}
+	if devID != f.adoptedVolume.VolumeID || vol.VolumeIdentifier != f.adoptedVolume.VolumeIdentifier {
+		return fmt.Errorf("Volume handle %s is not the adopted device %s", pv.Spec.CSI.VolumeHandle, f.adoptedVolume.VolumeID)
+	}
+	return nil
+}
+
+func (f *feature) theDeviceIsPublishedToTheNode(devID string) error {
+	return f.service.adminClient.AddVolumesToStorageGroup(f.symmetrixID, f.sgID, devID)
+}
+
+func (f *feature) iChangeTheServiceLevelOfTheDeviceTo(devID, serviceLevel string) error {
+	volumeHandle := fmt.Sprintf("csi-TST-modified-%s-%s", f.symmetrixID, devID)
+	if vol := mock.Data.VolumeIDToVolume[devID]; vol != nil {
+		volumeHandle = fmt.Sprintf("%s-%s-%s", vol.VolumeIdentifier, f.symmetrixID, devID)
+	}
+	f.modifiedStorageGroup, f.err = f.service.modifyServiceLevel(volumeHandle, serviceLevel)
+	return nil
+}
+
+func (f *feature) theDeviceIsInStorageGroupWithServiceLevel(devID, sgID, serviceLevel string) error {
+	vol := mock.Data.VolumeIDToVolume[devID]
+	if vol == nil {
+		return fmt.Errorf("Device %s does not exist", devID)
+	}
+	if !contains(vol.StorageGroupIDList, sgID) {
+		return fmt.Errorf("Expected device %s to be in storage group %s but it is in %v", devID, sgID, vol.StorageGroupIDList)
+	}
+	if f.modifiedStorageGroup == nil || f.modifiedStorageGroup.StorageGroupID != sgID || f.modifiedStorageGroup.SLO != serviceLevel {
+		return fmt.Errorf("Expected storage group %s with service level %s to be returned but got %#v", sgID, serviceLevel, f.modifiedStorageGroup)
+	}
+	return nil
+}
+
+func (f *feature) theDeviceIsStillPublishedToTheNode(devID string) error {
+	vol := mock.Data.VolumeIDToVolume[devID]
+	if vol == nil || !contains(vol.StorageGroupIDList, f.sgID) {
+		return fmt.Errorf("Expected device %s to still be in storage group %s of the node", devID, f.sgID)
+	}
+	if _, ok := mock.Data.MaskingViewIDToMaskingView[f.mvID]; !ok {
+		return fmt.Errorf("Masking view %s of the node does not exist", f.mvID)
+	}
+	return nil
+}
+
+func (f *feature) theHostOfTheNodeHasNoInitiators() error {
+	host := mock.Data.HostIDToHost[f.hostID]
+	if host == nil {
+		return fmt.Errorf("Host %s does not exist", f.hostID)
+	}
+	host.NumberInitiators = 0
+	host.Initiators = nil
+	return nil
+}
+
+func (f *feature) anEmptyStorageGroup(sgID string) error {
+	_, err := mock.AddStorageGroup(sgID, "SRP_1", "Bronze")
+	return err
+}
+
+func (f *feature) iAuditTheOrphansWithKnownDevicesAndCleanup(devIDs, cleanup string) error {
+	var known map[string]bool
+	if devIDs != "none" {
+		known = make(map[string]bool)
+		for _, devID := range strings.Split(devIDs, ",") {
+			vol := mock.Data.VolumeIDToVolume[devID]
+			if vol == nil {
+				return fmt.Errorf("Device %s does not exist", devID)
+			}
+			known[fmt.Sprintf("%s-%s-%s", vol.VolumeIdentifier, f.symmetrixID, devID)] = true
+		}
+	}
+	f.orphanReport, f.err = f.service.auditOrphans(f.symmetrixID, known, cleanup == "true")
+	return nil
+}
+
+func (f *feature) theOrphanAre(kind, expected string) error {
+	if f.orphanReport == nil {
+		return fmt.Errorf("No orphan report")
+	}
+	var found []string
+	switch kind {
+	case "volumes":
+		// the volumes are expected by device ID, the last part of their handle
+		for _, handle := range f.orphanReport.Volumes {
+			found = append(found, handle[strings.LastIndex(handle, "-")+1:])
+		}
+	case "storage groups":
+		found = f.orphanReport.StorageGroups
+	case "masking views":
+		found = f.orphanReport.MaskingViews
+	case "hosts":
+		found = f.orphanReport.Hosts
+	case "port groups":
+		found = f.orphanReport.PortGroups
+	case "removed objects":
+		found = f.orphanReport.Removed
+	}
+	var expectedList []string
+	if expected != "" {
+		expectedList = strings.Split(expected, ",")
+	}
+	sort.Strings(found)
+	sort.Strings(expectedList)
+	if strings.Join(found, ",") != strings.Join(expectedList, ",") {
+		return fmt.Errorf("Expected the orphan %s to be %v but got %v", kind, expectedList, found)
+	}
+	return nil
+}
+
+func (f *feature) iDecommissionTheNodeWithForce(nodeID, force string) error {
+	f.decommissioned, f.err = f.service.decommissionNode(f.symmetrixID, nodeID, force == "true")
+	return nil
+}
+
+func (f *feature) theDecommissionedObjectsAre(expected string) error {
+	var expectedList []string
+	if expected != "" {
+		expectedList = strings.Split(expected, ",")
+	}
+	sort.Strings(expectedList)
+	sort.Strings(f.decommissioned)
+	if strings.Join(f.decommissioned, ",") != strings.Join(expectedList, ",") {
+		return fmt.Errorf("Expected the decommissioned objects to be %v but got %v", expectedList, f.decommissioned)
+	}
+	return nil
+}
+
+func (f *feature) theStorageGroupAndHostOfTheNodeExist(exist string) error {
+	// the mock does not remove deleted masking views, so only the storage group and host are checked
+	sgExists := mock.Data.StorageGroupIDToStorageGroup[f.sgID] != nil
+	hostExists := mock.Data.HostIDToHost[f.hostID] != nil
+	if sgExists != (exist == "true") || hostExists != (exist == "true") {
+		return fmt.Errorf("Expected the storage group and host of the node to exist %s but storage group %t host %t",
+			exist, sgExists, hostExists)
+	}
+	return nil
+}
+
+func (f *feature) theDeviceIsInNoStorageGroup(devID string) error {
+	vol := mock.Data.VolumeIDToVolume[devID]
+	if vol == nil {
+		return fmt.Errorf("Device %s does not exist", devID)
+	}
+	if len(vol.StorageGroupIDList) != 0 {
+		return fmt.Errorf("Expected device %s to be in no storage group but it is in %v", devID, vol.StorageGroupIDList)
+	}
+	return nil
+}
+
+func (f *feature) theSnapshotCleanupScanFinds(snapshotName, found string) error {
+	snapID, symID, _, err := f.service.parseCsiID(f.snapshotNameToID[snapshotName])
+	if err != nil {
+		return err
+	}
+	reqs, err := f.service.findSnapshotsForCleanup(symID)
+	if err != nil {
+		return err
+	}
+	foundSnap := false
+	for _, req := range reqs {
+		if req.snapshotID == snapID {
+			foundSnap = true
+		}
+	}
+	if foundSnap != (found == "true") {
+		return fmt.Errorf("Expected the cleanup scan to find snapshot %s %s but got %v", snapID, found, reqs)
+	}
+	return nil
+}
+
 func (f *feature) aValidSnapshot() error {
 	return godog.ErrPending
 }
@@ -2315,6 +2863,9 @@ func (f *feature) iCallCreateVolumeFromVolume() error {
 	if f.wrongStoragePool {
 		req.Parameters["storagepool"] = "bad storage pool"
 	}
+	if f.cloneServiceLevel != "" {
+		req.Parameters[ServiceLevelParam] = f.cloneServiceLevel
+	}
 	var volumeID string
 	if inducedErrors.noVolumeSource {
 		volumeID = ""
@@ -2330,6 +2881,7 @@ func (f *feature) iCallCreateVolumeFromVolume() error {
 	if volumeID != "" {
 		req.VolumeContentSource.Type = &csi.VolumeContentSource_Volume{Volume: source}
 	}
+	f.createVolumeRequest = req
 	f.createVolumeResponse, f.err = f.service.CreateVolume(ctx, req)
 	if f.err != nil {
 		fmt.Printf("Error in creating a volume from another volume: %s\n", f.err.Error())
@@ -2337,29 +2889,132 @@ func (f *feature) iCallCreateVolumeFromVolume() error {
 	return nil
 }
 
-func (f *feature) theWrongCapacity() error {
-	f.wrongCapacity = true
-	return nil
-}
-
-func (f *feature) theWrongStoragePool() error {
-	f.wrongStoragePool = true
+func (f *feature) iCloneWithServiceLevel(serviceLevel string) error {
+	f.cloneServiceLevel = serviceLevel
 	return nil
 }
 
-func (f *feature) thereAreValidSnapshotsOfVolume(nsnapshots int, volume string) error {
-	return godog.ErrPending
+// getCloneDevIDs returns the device IDs of the source of the clone and of the clone
+func (f *feature) getCloneDevIDs() (string, string, error) {
+	if f.createVolumeResponse == nil {
+		return "", "", errors.New("expected a CreateVolumeResponse for the clone")
+	}
+	_, _, srcDevID, err := f.service.parseCsiID(f.volumeID)
+	if err != nil {
+		return "", "", err
+	}
+	_, _, tgtDevID, err := f.service.parseCsiID(f.createVolumeResponse.GetVolume().GetVolumeId())
+	if err != nil {
+		return "", "", err
+	}
+	return srcDevID, tgtDevID, nil
 }
 
-func (f *feature) iCallListSnapshotsWithMaxEntriesAndStartingToken(maxEntriesString, startingTokenString string) error {
-	return godog.ErrPending
+func (f *feature) theCloneIsInTheStorageGroupForServiceLevel(serviceLevel string) error {
+	_, tgtDevID, err := f.getCloneDevIDs()
+	if err != nil {
+		return err
+	}
+	if f.createVolumeResponse.GetVolume().GetVolumeContext()[ServiceLevelParam] != serviceLevel {
+		return fmt.Errorf("Expected the clone to have ServiceLevel %s but its volume context is %v",
+			serviceLevel, f.createVolumeResponse.GetVolume().GetVolumeContext())
+	}
+	sgName := fmt.Sprintf("%s-%s-%s-%s-SG", CSIPrefix, f.service.getClusterPrefix(), serviceLevel, mock.DefaultStoragePool)
+	vol := mock.Data.VolumeIDToVolume[tgtDevID]
+	if vol == nil {
+		return fmt.Errorf("Clone %s not found", tgtDevID)
+	}
+	for _, sgID := range vol.StorageGroupIDList {
+		if sgID == sgName {
+			return nil
+		}
+	}
+	return fmt.Errorf("Expected clone %s to be in storage group %s but it is in %v", tgtDevID, sgName, vol.StorageGroupIDList)
 }
 
-func (f *feature) iCallListSnapshotsForVolume(arg1 string) error {
-	return godog.ErrPending
+// getCloneSnapID returns the ID of the temporary snapshot the clone is linked to
+func (f *feature) getCloneSnapID() (string, error) {
+	srcDevID, tgtDevID, err := f.getCloneDevIDs()
+	if err != nil {
+		return "", err
+	}
+	for key, linkedVols := range mock.Data.SnapIDToLinkedVol {
+		if _, ok := linkedVols[tgtDevID]; ok {
+			return strings.TrimSuffix(key, ":"+srcDevID), nil
+		}
+	}
+	return "", fmt.Errorf("Clone %s is not linked to a snapshot", tgtDevID)
 }
 
-func (f *feature) iCallListSnapshotsForSnapshot(arg1 string) error {
+// findTempSnapCleanupRequest returns the cleanup request for the temporary snapshot of the clone
+func (f *feature) findTempSnapCleanupRequest(reqs []*snapCleanupRequest) (*snapCleanupRequest, error) {
+	snapID, err := f.getCloneSnapID()
+	if err != nil {
+		return nil, err
+	}
+	for _, req := range reqs {
+		if req.snapshotID == snapID {
+			return req, nil
+		}
+	}
+	return nil, fmt.Errorf("Expected a cleanup request for the temporary snapshot %s", snapID)
+}
+
+func (f *feature) theTemporarySnapshotOfTheCloneIsQueuedForCleanup() error {
+	snapCleaner.Mutex.Lock()
+	defer snapCleaner.Mutex.Unlock()
+	req, err := f.findTempSnapCleanupRequest(snapCleaner.Queue)
+	if err != nil {
+		return err
+	}
+	if req.notBefore.After(time.Now()) {
+		return fmt.Errorf("Expected the temporary snapshot %s to be due at once but it is due at %s", req.snapshotID, req.notBefore)
+	}
+	return nil
+}
+
+func (f *feature) theSnapshotCleanupScanQueuesTheTemporarySnapshotOfTheClone() error {
+	reqs, err := f.service.findSnapshotsForCleanup(f.symmetrixID)
+	if err != nil {
+		return err
+	}
+	found := make([]*snapCleanupRequest, 0, len(reqs))
+	for i := range reqs {
+		found = append(found, &reqs[i])
+	}
+	req, err := f.findTempSnapCleanupRequest(found)
+	if err != nil {
+		return err
+	}
+	if req.notBefore.After(time.Now()) {
+		return fmt.Errorf("Expected the temporary snapshot %s to be due at once but it is due at %s", req.snapshotID, req.notBefore)
+	}
+	return nil
+}
+
+func (f *feature) theWrongCapacity() error {
+	f.wrongCapacity = true
+	return nil
+}
+
+func (f *feature) theWrongStoragePool() error {
+	f.wrongStoragePool = true
+	return nil
+}
+
+func (f *feature) thereAreValidSnapshotsOfVolume(nsnapshots int, volume string) error {
+	return godog.ErrPending
+}
+
+func (f *feature) iCallListSnapshotsWithMaxEntriesAndStartingToken(maxEntriesString, startingTokenString string) error {
+	return godog.ErrPending
+}
+
+func (f *feature) iCallListSnapshotsForVolume(arg1 string) error {
+	return godog.ErrPending
+}
+
+func (f *feature) iCallListSnapshotsForSnapshot(arg1 string) error {
 	return godog.ErrPending
 }
 
@@ -2537,13 +3192,14 @@ func (f *feature) volumesAreBeingProcessedForDeletion(nVols int) error {
 }
 
 func (f *feature) iRequestAPortGroup() error {
-	f.selectedPortGroup, f.err = f.service.SelectPortGroup()
+	f.selectedPortGroup, f.err = f.service.SelectPortGroup(f.symmetrixID)
 	if f.err != nil {
 		return fmt.Errorf("Error selecting a Port Group from list of (%s): %v", f.service.opts.PortGroups, f.err)
 	}
 	if inducedErrors.portGroupError {
 		f.service.opts.PortGroups = make([]string, 0)
 	}
+	f.selectedPortGroups = append(f.selectedPortGroups, f.selectedPortGroup)
 	return nil
 }
 
@@ -2554,6 +3210,445 @@ func (f *feature) aValidPortGroupIsReturned() error {
 	return nil
 }
 
+func (f *feature) iSetPortGroupSelectionTo(strategy string) error {
+	f.service.opts.PortGroupSelection = getPortGroupSelection(strategy)
+	return nil
+}
+
+func (f *feature) iSetPortGroupsForArrayTo(symID, portGroups string) error {
+	pgMap, err := f.service.parseArrayPortGroups(symID + ":" + portGroups)
+	if err != nil {
+		return err
+	}
+	f.service.opts.ArrayPortGroups = pgMap
+	return nil
+}
+
+func (f *feature) iHaveAnArrayConfigurationFile(fileName string) error {
+	var err error
+	f.service.arrayConfig, err = newArrayConfigCache("features/" + fileName)
+	return err
+}
+
+func (f *feature) theTransportProtocolForArrayIs(symID, transportProtocol string) error {
+	if tp := f.service.getTransportProtocolForArray(symID); tp != transportProtocol {
+		return fmt.Errorf("Expected transport protocol %s for %s but got %s", transportProtocol, symID, tp)
+	}
+	return nil
+}
+
+func (f *feature) iSetTransportProtocolPreferenceTo(preference string) error {
+	var err error
+	f.service.opts.TransportPreference, err = f.service.parseTransportProtocolPreference(preference)
+	return err
+}
+
+func (f *feature) theVolumeIsPublishedToUsing(nodeID, transportProtocol string) error {
+	if f.publishVolumeResponse == nil {
+		return errors.New("no PublishVolumeResponse was returned")
+	}
+	published := f.publishVolumeResponse.PublishContext[PublishContextTransportProtocol]
+	if published != transportProtocol {
+		return fmt.Errorf("Expected the volume to be published to %s using %s but the publish context has %s",
+			nodeID, transportProtocol, published)
+	}
+	return nil
+}
+
+func (f *feature) theTransportProtocolOfTheStagedVolumeIsNotRecorded() error {
+	f.service.removeTransportProtocolFile(volume1)
+	return nil
+}
+
+func (f *feature) theVolumeIsDisconnectedUsing(transportProtocol string) error {
+	if mockGobrickDisconnectedWith != transportProtocol {
+		return fmt.Errorf("Expected the volume to be disconnected using %s but it was disconnected using %q",
+			transportProtocol, mockGobrickDisconnectedWith)
+	}
+	return nil
+}
+
+func (f *feature) theNodeCacheSelectsFor(transportProtocol, nodeID string) error {
+	hostID, ok := nodeCache.Load(f.symmetrixID + ":" + nodeID)
+	if !ok {
+		return fmt.Errorf("node %s is not in the node cache", nodeID)
+	}
+	if getTransportProtocolFromHostID(hostID.(string)) != transportProtocol {
+		return fmt.Errorf("Expected the node cache to select %s for %s but found host %s", transportProtocol, nodeID, hostID.(string))
+	}
+	return nil
+}
+
+// chapISCSIClient is an iSCSI client which records the CHAP settings of the node records
+type chapISCSIClient struct {
+	goiscsi.ISCSIinterface
+	chapTargets map[string]bool
+}
+
+func (c *chapISCSIClient) CreateOrUpdateNode(target goiscsi.ISCSITarget, options map[string]string) error {
+	if _, ok := options[iscsiSessionAuthPassword]; ok {
+		return errors.New("the CHAP password must not be passed to iscsiadm")
+	}
+	if options[iscsiSessionAuthMethod] == chapAuthMethod {
+		c.chapTargets[target.Portal+":"+target.Target] = true
+	}
+	return c.ISCSIinterface.CreateOrUpdateNode(target, options)
+}
+
+func (f *feature) iSetISCSICHAPCredentials(username, password string) error {
+	f.service.opts.ISCSICHAP = chapCredentials{Username: username, Password: password}
+	f.service.iscsiClient = &chapISCSIClient{ISCSIinterface: f.service.iscsiClient, chapTargets: make(map[string]bool)}
+	return nil
+}
+
+func (f *feature) chapIsSetOnISCSITargets(count int) error {
+	client, ok := f.service.iscsiClient.(*chapISCSIClient)
+	if !ok {
+		return errors.New("the iSCSI client does not record CHAP settings")
+	}
+	if len(client.chapTargets) != count {
+		return fmt.Errorf("Expected CHAP on %d iSCSI targets but found %d", count, len(client.chapTargets))
+	}
+	passwordTargets := make(map[string]bool)
+	for _, cmd := range iscsiPasswordCommands {
+		args := strings.Join(cmd.Args, " ")
+		if strings.Contains(args, f.service.opts.ISCSICHAP.Password) {
+			return fmt.Errorf("The CHAP password was passed to iscsiadm on its command line: %s", args)
+		}
+		for _, env := range cmd.Env {
+			if env == iscsiPasswordEnv+"="+f.service.opts.ISCSICHAP.Password && strings.Contains(args, "-m node") {
+				passwordTargets[args] = true
+			}
+		}
+	}
+	if len(passwordTargets) != count {
+		return fmt.Errorf("Expected the CHAP password to be set on %d iSCSI targets but it was set on %d", count, len(passwordTargets))
+	}
+	return nil
+}
+
+func (f *feature) iCallBeforeServeWithCHAPUsernameAndPassword(username, password string) error {
+	ctxOSEnviron := interface{}("os.Environ")
+	stringSlice := f.getTypicalEnviron()
+	stringSlice = append(stringSlice, EnvClusterPrefix+"=TST")
+	stringSlice = append(stringSlice, EnvISCSICHAPUsername+"="+username)
+	stringSlice = append(stringSlice, EnvISCSICHAPPassword+"="+password)
+	ctx := context.WithValue(context.Background(), ctxOSEnviron, stringSlice)
+	listener, err := net.Listen("tcp", "127.0.0.1:65000")
+	if err != nil {
+		return err
+	}
+	f.err = f.service.BeforeServe(ctx, nil, listener)
+	listener.Close()
+	return nil
+}
+
+// sessionISCSIClient is an iSCSI client with a configurable list of sessions,
+// which records the targets logged into
+type sessionISCSIClient struct {
+	goiscsi.ISCSIinterface
+	sessions []goiscsi.ISCSISession
+	logins   []goiscsi.ISCSITarget
+}
+
+func (c *sessionISCSIClient) GetSessions() ([]goiscsi.ISCSISession, error) {
+	return c.sessions, nil
+}
+
+func (c *sessionISCSIClient) PerformLogin(target goiscsi.ISCSITarget) error {
+	c.logins = append(c.logins, target)
+	return c.ISCSIinterface.PerformLogin(target)
+}
+
+func (c *sessionISCSIClient) DiscoverTargets(address string, login bool) ([]goiscsi.ISCSITarget, error) {
+	targets, err := c.ISCSIinterface.DiscoverTargets(address, login)
+	if login && err == nil {
+		c.logins = append(c.logins, targets...)
+	}
+	return targets, err
+}
+
+func (f *feature) theNodeHasISCSISessionsToPortals(portals string) error {
+	client := &sessionISCSIClient{ISCSIinterface: f.service.iscsiClient}
+	list, _ := f.service.parseCommaSeperatedList(portals)
+	for _, portal := range list {
+		client.sessions = append(client.sessions, goiscsi.ISCSISession{
+			Portal:            portal + ":3260",
+			Target:            "iqn.1992-04.com.emc:600009700bcbb70e3287017400000001",
+			ISCSISessionState: goiscsi.ISCSISessionState_LOGGED_IN,
+		})
+	}
+	f.service.iscsiClient = client
+	return nil
+}
+
+func (f *feature) iCheckTheISCSISessions() error {
+	f.service.checkISCSISessions()
+	return nil
+}
+
+func (f *feature) theNodeNoLongerUsesISCSIWithArray(symID string) error {
+	f.service.mutex.Lock()
+	defer f.service.mutex.Unlock()
+	f.service.arrayTransportProtocolMap[symID] = FcTransportProtocol
+	return nil
+}
+
+func (f *feature) iSetTheISCSISessionCheckIntervalTo(interval string) error {
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return err
+	}
+	f.service.opts.ISCSISessionCheckInterval = d
+	return nil
+}
+
+func (f *feature) theISCSISessionMonitorIsStarted(started string) error {
+	f.service.iscsiSessions.Lock()
+	defer f.service.iscsiSessions.Unlock()
+	if f.service.iscsiSessions.monitorStarted != (started == "true") {
+		return fmt.Errorf("Expected the iSCSI session monitor to be started %s", started)
+	}
+	return nil
+}
+
+func (f *feature) theISCSISessionMetricsReportSessionsToArray(count, symID string) error {
+	recorder := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	var metrics struct {
+		ISCSISessions map[string]int `json:"powermax_iscsi_sessions"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &metrics); err != nil {
+		return fmt.Errorf("Invalid metrics %s: %s", recorder.Body.String(), err.Error())
+	}
+	found, ok := metrics.ISCSISessions[symID]
+	if count == "no" {
+		if ok {
+			return fmt.Errorf("Expected no iSCSI session metric for %s but found %d", symID, found)
+		}
+		return nil
+	}
+	if !ok || strconv.Itoa(found) != count {
+		return fmt.Errorf("Expected the iSCSI session metric for %s to be %s but the metrics are %v", symID, count, metrics.ISCSISessions)
+	}
+	return nil
+}
+
+func (f *feature) iSCSILoginsArePerformed(count int) error {
+	client, ok := f.service.iscsiClient.(*sessionISCSIClient)
+	if !ok {
+		return errors.New("the iSCSI client does not record logins")
+	}
+	if len(client.logins) != count {
+		return fmt.Errorf("Expected %d iSCSI logins but found %d: %v", count, len(client.logins), client.logins)
+	}
+	return nil
+}
+
+func (f *feature) theNodeReportsISCSISessionsToArray(count int, symID string) error {
+	counts := f.service.getISCSISessionCounts()
+	if counts[symID] != count {
+		return fmt.Errorf("Expected %d iSCSI sessions to %s but found %d", count, symID, counts[symID])
+	}
+	if metric := iscsiSessionMetrics.Get(symID); metric == nil || metric.String() != strconv.Itoa(count) {
+		return fmt.Errorf("Expected the iSCSI session metric for %s to be %d but it was %v", symID, count, metric)
+	}
+	return nil
+}
+
+func (f *feature) theVolumeDeviceIsLeftOnTheNode() error {
+	gofsutil.GOFSMockWWNToDevice[nodePublishWWN] = nodePublishBlockDevicePath
+	return nil
+}
+
+func (f *feature) theVolumeDeviceIsMappedToTheNode() error {
+	return mock.AddNewVolume("00501", "CSIXX-Int409498632", 8, f.sgID)
+}
+
+func (f *feature) theVolumeDeviceIsUnmappedFromTheNode() error {
+	_, err := f.service.adminClient.RemoveVolumesFromStorageGroup(f.symmetrixID, f.sgID, "00501")
+	return err
+}
+
+func (f *feature) theVolumeDeviceHasAHolder() error {
+	return os.MkdirAll(filepath.Join(nodePublishSysBlockDir, nodePublishBlockDevice, "holders", "dm-9"), 0777)
+}
+
+func (f *feature) theVolumeDeviceIsMounted() error {
+	gofsutil.GOFSMockMounts = append(gofsutil.GOFSMockMounts, gofsutil.Info{
+		Device: nodePublishBlockDevicePath,
+		Path:   datadir,
+		Type:   "xfs",
+	})
+	return nil
+}
+
+func (f *feature) iCheckForStaleDevices() error {
+	f.removedStaleDevices = append(f.removedStaleDevices, f.service.removeStaleDevices()...)
+	return nil
+}
+
+func (f *feature) theNodePluginRestarts() error {
+	f.service.staleDevices = staleDeviceState{}
+	return nil
+}
+
+func (f *feature) theVolumeDeviceIsRecordedAsADeviceOfTheDriver(recorded string) error {
+	devices, err := f.service.getDriverDevices()
+	if err != nil {
+		return err
+	}
+	if devices[nodePublishWWN] != (recorded == "true") {
+		return fmt.Errorf("Expected device %s to be recorded as a device of the driver %s but the devices are %v", nodePublishWWN, recorded, devices)
+	}
+	return nil
+}
+
+func (f *feature) staleDevicesAreRemoved(count int) error {
+	removed := f.removedStaleDevices
+	if len(removed) != count {
+		return fmt.Errorf("Expected %d stale devices to be removed but found %d: %v", count, len(removed), removed)
+	}
+	for _, wwn := range removed {
+		if wwn != nodePublishWWN {
+			return fmt.Errorf("Expected stale device %s to be removed but %s was removed", nodePublishWWN, wwn)
+		}
+	}
+	return nil
+}
+
+func (f *feature) theVolumeDeviceLinkExists(exists string) error {
+	_, err := os.Lstat(fmt.Sprintf("%s/wwn-0x%s", nodePublishSymlinkDir, nodePublishWWN))
+	if (err == nil) != (exists == "true") {
+		return fmt.Errorf("Expected the device link to exist to be %s but it was %t", exists, err == nil)
+	}
+	return nil
+}
+
+func (f *feature) theNodeIsRebooted() error {
+	delete(gofsutil.GOFSMockWWNToDevice, nodePublishWWN)
+	return nil
+}
+
+func (f *feature) theVolumeIsDeletedFromTheArray() error {
+	_, _, devID, err := f.service.parseCsiID(volume1)
+	if err != nil {
+		return err
+	}
+	delete(mock.Data.VolumeIDToVolume, devID)
+	return nil
+}
+
+func (f *feature) iReconcileTheStagedVolumes() error {
+	f.service.reconcileStagedVolumes()
+	return nil
+}
+
+func (f *feature) theVolumeDeviceIsConnected(connected string) error {
+	ok := gofsutil.GOFSMockWWNToDevice[nodePublishWWN] != ""
+	if ok != (connected == "true") {
+		return fmt.Errorf("Expected the volume device connected to be %s but it was %t", connected, ok)
+	}
+	return nil
+}
+
+func (f *feature) theWWNFileOfTheVolumeExists(exists string) error {
+	_, err := os.Stat(fmt.Sprintf("%s/%s.wwn", f.service.privDir, volume1))
+	if (err == nil) != (exists == "true") {
+		return fmt.Errorf("Expected the WWN file to exist to be %s but it was %t", exists, err == nil)
+	}
+	return nil
+}
+
+func (f *feature) iHaveAnNVMeTCPPortWithAddress(dirPortKey, address string) error {
+	mock.AddPort(dirPortKey, defaultNVMeSubsystemNQN, "GigE")
+	mock.Data.PortIDToSymmetrixPortType[dirPortKey].IPAddresses = []string{address}
+	return nil
+}
+
+func (f *feature) thePublishContextContains(key, value string) error {
+	if f.publishVolumeResponse == nil {
+		return errors.New("No PublishVolumeResponse returned")
+	}
+	if actual := f.publishVolumeResponse.PublishContext[key]; !strings.Contains(actual, value) {
+		return fmt.Errorf("Expected PublishContext %s to contain %s but it was %s", key, value, actual)
+	}
+	return nil
+}
+
+func (f *feature) theNVMeVolumeIsConnected(connected string) error {
+	_, ok := mockNVMeNamespaces[normalizeNGUID(nodePublishWWN)]
+	if ok != (connected == "true") {
+		return fmt.Errorf("Expected NVMe namespace connected to be %s but it was %t", connected, ok)
+	}
+	return nil
+}
+
+func (f *feature) theNodePublishRequestUses(transportProtocol string) error {
+	if f.nodePublishVolumeRequest == nil {
+		return errors.New("No NodePublishVolumeRequest")
+	}
+	ctx := f.nodePublishVolumeRequest.PublishContext
+	ctx[PublishContextTransportProtocol] = transportProtocol
+	switch transportProtocol {
+	case NvmeTCPTransportProtocol:
+		ctx[PortIdentifiers] = formatNVMeTCPTarget(defaultNVMeSubsystemNQN, "192.168.1.10") + ","
+	case NvmeFCTransportProtocol:
+		ctx[PortIdentifiers] = "0x" + defaultFcStoragePortWWN + ","
+	}
+	return nil
+}
+
+func (f *feature) theNodeUsesForArray(transportProtocol, symID string) error {
+	if tp := f.service.arrayTransportProtocolMap[symID]; tp != transportProtocol {
+		return fmt.Errorf("Expected the node to use %s for %s but it uses %s", transportProtocol, symID, tp)
+	}
+	return nil
+}
+
+func (f *feature) iHaveAnISCSIPortGroupWithPorts(portGroupID, ports string) error {
+	dirPorts, _ := f.service.parseCommaSeperatedList(ports)
+	_, err := mock.AddPortGroup(portGroupID, "ISCSI", dirPorts)
+	return err
+}
+
+func (f *feature) portGroupHasMaskingViews(portGroupID string, nViews int) error {
+	pg, ok := mock.Data.PortGroupIDToPortGroup[portGroupID]
+	if !ok {
+		return fmt.Errorf("Port Group %s not found", portGroupID)
+	}
+	pg.NumberMaskingViews = int64(nViews)
+	return nil
+}
+
+func (f *feature) thePortGroupCacheOfTheArrayExpires() error {
+	f.service.cacheMutex.Lock()
+	defer f.service.cacheMutex.Unlock()
+	cache := getPmaxCache(f.symmetrixID)
+	if cache.portGroups == nil {
+		return fmt.Errorf("The port groups of %s are not cached", f.symmetrixID)
+	}
+	cache.portGroups.second = time.Now().Add(-PortGroupCacheDuration)
+	return nil
+}
+
+func (f *feature) iRequestAPortGroupTimes(count int) error {
+	for i := 0; i < count; i++ {
+		if err := f.iRequestAPortGroup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *feature) theSelectedPortGroupsAre(portGroups string) error {
+	expected, _ := f.service.parseCommaSeperatedList(portGroups)
+	if strings.Join(expected, ",") != strings.Join(f.selectedPortGroups, ",") {
+		return fmt.Errorf("Expected Port Groups %v but got %v", expected, f.selectedPortGroups)
+	}
+	return nil
+}
+
 func (f *feature) iInvokeCreateOrUpdateIscsiHost(hostName string) error {
 	f.service.SetPmaxTimeoutSeconds(3)
 	symID := f.symmetrixID
@@ -2623,10 +3718,11 @@ func (f *feature) initiatorsAreFound(expected int) error {
 func (f *feature) iInvokeNodeHostSetupWithAService(mode string) error {
 	iscsiInitiators := []string{defaultIscsiInitiator}
 	fcInitiators := []string{defaultFcInitiator}
+	nvmeInitiators := []string{defaultNQN}
 	symmetrixIDs := []string{f.symmetrixID}
 	f.service.mode = mode
 	f.service.SetPmaxTimeoutSeconds(30)
-	f.err = f.service.nodeHostSetup(fcInitiators, iscsiInitiators, symmetrixIDs)
+	f.err = f.service.nodeHostSetup(fcInitiators, iscsiInitiators, nvmeInitiators, symmetrixIDs)
 	return nil
 }
 
@@ -2880,7 +3976,7 @@ func (f *feature) iCallUnmountPrivMount() error {
 	dev := Device{
 		RealDev: "test/dev/sda",
 	}
-	f.lastUnmounted, f.err = unmountPrivMount(ctx, &dev, "test/mnt1")
+	f.lastUnmounted, f.err = unmountPrivMount(ctx, &dev, "test/mnt1", f.service.opts.ClusterFsTypes)
 	return nil
 }
 
@@ -2983,6 +4079,55 @@ func (f *feature) iCallVerifyInitiatorsNotInADifferentHostForNode(nodeID string)
 	return nil
 }
 
+func (f *feature) iSetTheInitiatorConflictPolicyTo(policy string) error {
+	f.service.opts.InitiatorConflictPolicy = getInitiatorConflictPolicy(policy)
+	return nil
+}
+
+func (f *feature) theInitiatorsOfTheNodeBelongToHost(hostID string) error {
+	initID := defaultISCSIDirPort1 + ":" + defaultIscsiInitiator
+	mock.AddInitiator(initID, defaultIscsiInitiator, "GigE", []string{defaultISCSIDirPort1}, "")
+	_, err := mock.AddHost(hostID, "iSCSI", []string{defaultIscsiInitiator})
+	return err
+}
+
+func (f *feature) theISCSIInitiatorOfTheNodeIsOnTheArray() error {
+	initID := defaultISCSIDirPort1 + ":" + defaultIscsiInitiator
+	mock.AddInitiator(initID, defaultIscsiInitiator, "GigE", []string{defaultISCSIDirPort1}, "")
+	return nil
+}
+
+func (f *feature) theHostExists(hostID, exist string) error {
+	if (mock.Data.HostIDToHost[hostID] != nil) != (exist == "true") {
+		return fmt.Errorf("Expected host %s to exist %s", hostID, exist)
+	}
+	return nil
+}
+
+func (f *feature) iAdoptTheHostsOfTheInitiatorsOfNode(nodeID string) error {
+	f.service.opts.NodeName = nodeID
+	f.service.adoptHostsOfInitiators([]string{f.symmetrixID}, []string{defaultIscsiInitiator})
+	return nil
+}
+
+func (f *feature) theHostsOfTheNodeAreNamedAfter(nodeName string) error {
+	if hostNodeName := f.service.getHostNodeName(); hostNodeName != nodeName {
+		return fmt.Errorf("Expected the hosts of the node to be named after %s but they are named after %s", nodeName, hostNodeName)
+	}
+	return nil
+}
+
+func (f *feature) theNodeIDIs(nodeID string) error {
+	resp, err := f.service.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		return err
+	}
+	if resp.NodeId != nodeID {
+		return fmt.Errorf("Expected the node ID to be %s but it is %s", nodeID, resp.NodeId)
+	}
+	return nil
+}
+
 func (f *feature) validInitiatorsAreReturned(expected int) error {
 	if expected != f.ninitiators {
 		return fmt.Errorf("expected %d initiators but got %d", expected, f.ninitiators)
@@ -3123,6 +4268,44 @@ func (f *feature) iCallUnlinkAndTerminateSnapshot() error {
 	return nil
 }
 
+func (f *feature) iCallTheSnapshotCleanupOfTheSnapshot() error {
+	snapshotName, arrayID, deviceID, err := f.service.parseCsiID(f.createSnapshotResponse.GetSnapshot().GetSnapshotId())
+	if err != nil {
+		return err
+	}
+	snapCleaner.terminateSnapshot(f.service, &snapCleanupRequest{snapshotID: snapshotName, symmetrixID: arrayID, volumeID: deviceID})
+	return nil
+}
+
+func (f *feature) checkingTheRetentionOfTheSnapshotFails() error {
+	snapshotName, arrayID, deviceID, err := f.service.parseCsiID(f.createSnapshotResponse.GetSnapshot().GetSnapshotId())
+	if err != nil {
+		return err
+	}
+	if _, locked, err := f.service.getSnapshotRetention(arrayID, deviceID, snapshotName); err == nil {
+		return fmt.Errorf("Expected checking the retention of snapshot %s to fail but got locked %v", snapshotName, locked)
+	}
+	return nil
+}
+
+func (f *feature) theSnapshotCleanupOfTheSnapshotIsRetried() error {
+	snapshotName, _, _, err := f.service.parseCsiID(f.createSnapshotResponse.GetSnapshot().GetSnapshotId())
+	if err != nil {
+		return err
+	}
+	snapCleaner.Mutex.Lock()
+	defer snapCleaner.Mutex.Unlock()
+	for _, req := range snapCleaner.Queue {
+		if req.snapshotID == snapshotName {
+			if req.retries != 1 || !req.notBefore.After(time.Now()) {
+				return fmt.Errorf("Expected snapshot %s to be retried later but got %d retries due at %s", snapshotName, req.retries, req.notBefore)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Expected the cleanup of snapshot %s to be queued for retry", snapshotName)
+}
+
 func (f *feature) aValidDeleteSnapshotResponseIsReturned() error {
 	if f.err != nil {
 		return f.err
@@ -3322,6 +4505,37 @@ func FeatureContext(s *godog.Suite) {
 	s.Step(`^then I use a different nodeID$`, f.thenIUseADifferentNodeID)
 	s.Step(`^I use AccessType Mount$`, f.iUseAccessTypeMount)
 	s.Step(`^no error was received$`, f.noErrorWasReceived)
+	s.Step(`^the snapshot "([^"]*)" has state "([^"]*)" and timestamp "([^"]*)"$`, f.theSnapshotHasStateAndTimestamp)
+	s.Step(`^the snapshot is ready to use "(true|false)" with creation time "([^"]*)"$`, f.theSnapshotIsReadyToUseWithCreationTime)
+	s.Step(`^I call CreateSnapshot "([^"]*)" on "([^"]*)" with parameter "([^"]*)" "([^"]*)"$`, f.iCallCreateSnapshotOnWithParameter)
+	s.Step(`^the snapshot "([^"]*)" exists on the array "(true|false)"$`, f.theSnapshotExistsOnTheArray)
+	s.Step(`^I prune the snapshots of "([^"]*)" keeping (\d+) except "([^"]*)"$`, f.iPruneTheSnapshotsOfKeepingExcept)
+	s.Step(`^the pruned snapshots are "([^"]*)"$`, f.thePrunedSnapshotsAre)
+	s.Step(`^the snapshot cleanup scan finds "([^"]*)" "(true|false)"$`, f.theSnapshotCleanupScanFinds)
+	s.Step(`^a legacy device "([^"]*)" named "([^"]*)" in storage group "([^"]*)"$`, f.aLegacyDeviceNamedInStorageGroup)
+	s.Step(`^a legacy device "([^"]*)" named "([^"]*)" in the masking view of the node$`, f.aLegacyDeviceNamedInTheMaskingViewOfTheNode)
+	s.Step(`^I adopt the device "([^"]*)" as "([^"]*)" with rename "(true|false)" and service level "([^"]*)"$`, f.iAdoptTheDeviceAsWithRenameAndServiceLevel)
+	s.Step(`^the device "([^"]*)" is named "([^"]*)" in storage group "([^"]*)"$`, f.theDeviceIsNamedInStorageGroup)
+	s.Step(`^the persistent volume "([^"]*)" has a valid volume handle$`, f.thePersistentVolumeHasAValidVolumeHandle)
+	s.Step(`^the device "([^"]*)" is published to the node$`, f.theDeviceIsPublishedToTheNode)
+	s.Step(`^I change the service level of the device "([^"]*)" to "([^"]*)"$`, f.iChangeTheServiceLevelOfTheDeviceTo)
+	s.Step(`^the device "([^"]*)" is in storage group "([^"]*)" with service level "([^"]*)"$`, f.theDeviceIsInStorageGroupWithServiceLevel)
+	s.Step(`^the device "([^"]*)" is still published to the node$`, f.theDeviceIsStillPublishedToTheNode)
+	s.Step(`^the host of the node has no initiators$`, f.theHostOfTheNodeHasNoInitiators)
+	s.Step(`^an empty storage group "([^"]*)"$`, f.anEmptyStorageGroup)
+	s.Step(`^I audit the orphans with known devices "([^"]*)" and cleanup "(true|false)"$`, f.iAuditTheOrphansWithKnownDevicesAndCleanup)
+	s.Step(`^the orphan (volumes|storage groups|masking views|hosts|port groups|removed objects) are "([^"]*)"$`, f.theOrphanAre)
+	s.Step(`^I decommission the node "([^"]*)" with force "(true|false)"$`, f.iDecommissionTheNodeWithForce)
+	s.Step(`^the decommissioned objects are "([^"]*)"$`, f.theDecommissionedObjectsAre)
+	s.Step(`^the storage group and host of the node exist "(true|false)"$`, f.theStorageGroupAndHostOfTheNodeExist)
+	s.Step(`^the device "([^"]*)" is in no storage group$`, f.theDeviceIsInNoStorageGroup)
+	s.Step(`^I clone with service level "([^"]*)"$`, f.iCloneWithServiceLevel)
+	s.Step(`^the clone is in the storage group for service level "([^"]*)"$`, f.theCloneIsInTheStorageGroupForServiceLevel)
+	s.Step(`^the temporary snapshot of the clone is queued for cleanup$`, f.theTemporarySnapshotOfTheCloneIsQueuedForCleanup)
+	s.Step(`^the snapshot cleanup scan queues the temporary snapshot of the clone for cleanup at once$`, f.theSnapshotCleanupScanQueuesTheTemporarySnapshotOfTheClone)
+	s.Step(`^I call the snapshot cleanup of the snapshot$`, f.iCallTheSnapshotCleanupOfTheSnapshot)
+	s.Step(`^the snapshot cleanup of the snapshot is retried$`, f.theSnapshotCleanupOfTheSnapshotIsRetried)
+	s.Step(`^checking the retention of the snapshot fails$`, f.checkingTheRetentionOfTheSnapshotFails)
 	s.Step(`^I call UnpublishVolume from "([^"]*)"$`, f.iCallUnpublishVolumeFrom)
 	s.Step(`^a valid UnpublishVolumeResponse is returned$`, f.aValidUnpublishVolumeResponseIsReturned)
 	s.Step(`^I call NodeGetInfo$`, f.iCallNodeGetInfo)
@@ -3354,6 +4568,47 @@ func FeatureContext(s *godog.Suite) {
 	s.Step(`^I call BeforeServe$`, f.iCallBeforeServe)
 	s.Step(`^I call BeforeServe without ClusterPrefix$`, f.iCallBeforeServeWithoutClusterPrefix)
 	s.Step(`^I call BeforeServe with an invalid ClusterPrefix$`, f.iCallBeforeServeWithAnInvalidClusterPrefix)
+	s.Step(`^I call BeforeServe with CHAP username "([^"]*)" and password "([^"]*)"$`, f.iCallBeforeServeWithCHAPUsernameAndPassword)
+	s.Step(`^I set iSCSI CHAP credentials "([^"]*)" "([^"]*)"$`, f.iSetISCSICHAPCredentials)
+	s.Step(`^CHAP is set on (\d+) iSCSI targets$`, f.chapIsSetOnISCSITargets)
+	s.Step(`^the node has iSCSI sessions to portals "([^"]*)"$`, f.theNodeHasISCSISessionsToPortals)
+	s.Step(`^I check the iSCSI sessions$`, f.iCheckTheISCSISessions)
+	s.Step(`^the node no longer uses iSCSI with array "([^"]*)"$`, f.theNodeNoLongerUsesISCSIWithArray)
+	s.Step(`^the iSCSI session metrics report (\d+|no) sessions to array "([^"]*)"$`, f.theISCSISessionMetricsReportSessionsToArray)
+	s.Step(`^the volume device is left on the node$`, f.theVolumeDeviceIsLeftOnTheNode)
+	s.Step(`^the volume device is mounted$`, f.theVolumeDeviceIsMounted)
+	s.Step(`^the volume device is mapped to the node$`, f.theVolumeDeviceIsMappedToTheNode)
+	s.Step(`^the volume device is unmapped from the node$`, f.theVolumeDeviceIsUnmappedFromTheNode)
+	s.Step(`^the volume device has a holder$`, f.theVolumeDeviceHasAHolder)
+	s.Step(`^I check for stale devices$`, f.iCheckForStaleDevices)
+	s.Step(`^(\d+) stale devices are removed$`, f.staleDevicesAreRemoved)
+	s.Step(`^the node plugin restarts$`, f.theNodePluginRestarts)
+	s.Step(`^the volume device is recorded as a device of the driver "(true|false)"$`, f.theVolumeDeviceIsRecordedAsADeviceOfTheDriver)
+	s.Step(`^the volume device link exists "([^"]*)"$`, f.theVolumeDeviceLinkExists)
+	s.Step(`^the node is rebooted$`, f.theNodeIsRebooted)
+	s.Step(`^I specify FsCheck "([^"]*)"$`, f.iSpecifyFsCheck)
+	s.Step(`^the VolumeContext "([^"]*)" is "([^"]*)"$`, f.theVolumeContextContains)
+	s.Step(`^I specify MkfsOptions "([^"]*)" for fstype "([^"]*)"$`, f.iSpecifyMkfsOptionsForFstype)
+	s.Step(`^the Node Publish Volume Request has MkfsOptions "([^"]*)"$`, f.theNodePublishVolumeRequestHasMkfsOptions)
+	s.Step(`^mkfs is run with "([^"]*)"$`, f.mkfsIsRunWith)
+	s.Step(`^I set the request read only "([^"]*)"$`, f.iSetTheRequestReadOnly)
+	s.Step(`^the volume device is set read only$`, f.theVolumeDeviceIsSetReadOnly)
+	s.Step(`^the volume device is read only "([^"]*)"$`, f.theVolumeDeviceIsReadOnly)
+	s.Step(`^the target is mounted read only "([^"]*)"$`, f.theTargetIsMountedReadOnly)
+	s.Step(`^I specify AllowMultiWriterMount "([^"]*)" for fstype "([^"]*)"$`, f.iSpecifyAllowMultiWriterMountForFstype)
+	s.Step(`^the Node Publish Volume Request allows multi-writer mounts "([^"]*)"$`, f.theNodePublishVolumeRequestAllowsMultiWriterMounts)
+	s.Step(`^the volume device is formatted with "([^"]*)"$`, f.theVolumeDeviceIsFormattedWith)
+	s.Step(`^device "([^"]*)" is mounted outside of the driver$`, f.deviceIsMountedOutsideOfTheDriver)
+	s.Step(`^the private mount of the volume remains "(true|false)"$`, f.thePrivateMountOfTheVolumeRemains)
+	s.Step(`^mkfs is run (\d+) times$`, f.mkfsIsRunTimes)
+	s.Step(`^the volume is deleted from the array$`, f.theVolumeIsDeletedFromTheArray)
+	s.Step(`^I reconcile the staged volumes$`, f.iReconcileTheStagedVolumes)
+	s.Step(`^the volume device is connected "([^"]*)"$`, f.theVolumeDeviceIsConnected)
+	s.Step(`^the WWN file of the volume exists "([^"]*)"$`, f.theWWNFileOfTheVolumeExists)
+	s.Step(`^(\d+) iSCSI logins are performed$`, f.iSCSILoginsArePerformed)
+	s.Step(`^the node reports (\d+) iSCSI sessions to array "([^"]*)"$`, f.theNodeReportsISCSISessionsToArray)
+	s.Step(`^I set the iSCSI session check interval to "([^"]*)"$`, f.iSetTheISCSISessionCheckIntervalTo)
+	s.Step(`^the iSCSI session monitor is started "(true|false)"$`, f.theISCSISessionMonitorIsStarted)
 	s.Step(`^I call NodeStageVolume$`, f.iCallNodeStageVolume)
 	s.Step(`^I call NodeUnstageVolume$`, f.iCallNodeUnstageVolume)
 	s.Step(`^I call NodeGetCapabilities$`, f.iCallNodeGetCapabilities)
@@ -3383,6 +4638,25 @@ func FeatureContext(s *godog.Suite) {
 	s.Step(`^deletion worker processes "([^"]*)" which results in "([^"]*)"$`, f.deletionWorkerProcessesWhichResultsIn)
 	s.Step(`^I request a PortGroup$`, f.iRequestAPortGroup)
 	s.Step(`^a valid PortGroup is returned$`, f.aValidPortGroupIsReturned)
+	s.Step(`^I set port group selection to "([^"]*)"$`, f.iSetPortGroupSelectionTo)
+	s.Step(`^I set port groups for array "([^"]*)" to "([^"]*)"$`, f.iSetPortGroupsForArrayTo)
+	s.Step(`^I have an array configuration file "([^"]*)"$`, f.iHaveAnArrayConfigurationFile)
+	s.Step(`^the transport protocol for array "([^"]*)" is "([^"]*)"$`, f.theTransportProtocolForArrayIs)
+	s.Step(`^I set transport protocol preference to "([^"]*)"$`, f.iSetTransportProtocolPreferenceTo)
+	s.Step(`^the volume is published to "([^"]*)" using "([^"]*)"$`, f.theVolumeIsPublishedToUsing)
+	s.Step(`^the node cache selects "([^"]*)" for "([^"]*)"$`, f.theNodeCacheSelectsFor)
+	s.Step(`^the transport protocol of the staged volume is not recorded$`, f.theTransportProtocolOfTheStagedVolumeIsNotRecorded)
+	s.Step(`^the volume is disconnected using "([^"]*)"$`, f.theVolumeIsDisconnectedUsing)
+	s.Step(`^the node uses "([^"]*)" for array "([^"]*)"$`, f.theNodeUsesForArray)
+	s.Step(`^I have an NVMe/TCP port "([^"]*)" with address "([^"]*)"$`, f.iHaveAnNVMeTCPPortWithAddress)
+	s.Step(`^the PublishContext "([^"]*)" contains "([^"]*)"$`, f.thePublishContextContains)
+	s.Step(`^the NVMe volume is connected "([^"]*)"$`, f.theNVMeVolumeIsConnected)
+	s.Step(`^the Node Publish Volume Request uses "([^"]*)"$`, f.theNodePublishRequestUses)
+	s.Step(`^I have an iSCSI PortGroup "([^"]*)" with ports "([^"]*)"$`, f.iHaveAnISCSIPortGroupWithPorts)
+	s.Step(`^PortGroup "([^"]*)" has (\d+) masking views$`, f.portGroupHasMaskingViews)
+	s.Step(`^I request a PortGroup (\d+) times$`, f.iRequestAPortGroupTimes)
+	s.Step(`^the port group cache of the array expires$`, f.thePortGroupCacheOfTheArrayExpires)
+	s.Step(`^the selected PortGroups are "([^"]*)"$`, f.theSelectedPortGroupsAre)
 	s.Step(`^I invoke createOrUpdateIscsiHost "([^"]*)"$`, f.iInvokeCreateOrUpdateIscsiHost)
 	s.Step(`^I invoke nodeHostSetup with a "([^"]*)" service$`, f.iInvokeNodeHostSetupWithAService)
 	s.Step(`^the error clears after (\d+) seconds$`, f.theErrorClearsAfterSeconds)
@@ -3436,6 +4710,13 @@ func FeatureContext(s *godog.Suite) {
 	s.Step(`^I have (\d+) sysblock deviceso$`, f.iHaveSysblockDevices)
 	s.Step(`^I call linearScanToRemoveDevices$`, f.iCallLinearScanToRemoveDevices)
 	s.Step(`^I call verifyInitiatorsNotInADifferentHost for node "([^"]*)"$`, f.iCallVerifyInitiatorsNotInADifferentHostForNode)
+	s.Step(`^I set the initiator conflict policy to "([^"]*)"$`, f.iSetTheInitiatorConflictPolicyTo)
+	s.Step(`^the initiators of the node belong to host "([^"]*)"$`, f.theInitiatorsOfTheNodeBelongToHost)
+	s.Step(`^the host "([^"]*)" exists "(true|false)"$`, f.theHostExists)
+	s.Step(`^the iSCSI initiator of the node is on the array$`, f.theISCSIInitiatorOfTheNodeIsOnTheArray)
+	s.Step(`^I adopt the hosts of the initiators of node "([^"]*)"$`, f.iAdoptTheHostsOfTheInitiatorsOfNode)
+	s.Step(`^the hosts of the node are named after "([^"]*)"$`, f.theHostsOfTheNodeAreNamedAfter)
+	s.Step(`^the node ID is "([^"]*)"$`, f.theNodeIDIs)
 	s.Step(`^(\d+) valid initiators are returned$`, f.validInitiatorsAreReturned)
 	s.Step(`^I check the snapshot license$`, f.iCheckTheSnapshotLicense)
 	s.Step(`^I call IsVolumeInSnapSession on "([^"]*)"$`, f.iCallIsVolumeInSnapSessionOn)